@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// CircleCI rate-limits its API, and a run of cart can make more requests
+// than expected: retries, probes for -sort size, the builds of a workflow.
+// doRequest counts every request sent, by kind, and -v reports the counts
+// at the end of the run.
+
+const (
+	callMe           = "me"
+	callBuildList    = "build-list"
+	callBuild        = "build"
+	callArtifactList = "artifact-list"
+	callWorkflowJobs = "workflow-jobs"
+	callWorkflow     = "workflow"
+	callPipeline     = "pipeline"
+	callProbe        = "probe"
+	callDownload     = "download"
+)
+
+type callCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var apiCalls = &callCounter{}
+
+var buildPath = regexp.MustCompile(`/\d+$`)
+
+// callKind classifies req by the URL templates it was made from.
+func callKind(req *http.Request) string {
+	p := req.URL.Path
+	switch {
+	case req.Method == http.MethodHead || req.Header.Get("Range") != "":
+		return callProbe
+	case !strings.HasPrefix(p, "/api/"):
+		return callDownload
+	case strings.HasSuffix(p, "/me"):
+		return callMe
+	case strings.HasSuffix(p, "/artifacts"):
+		return callArtifactList
+	case strings.HasPrefix(p, "/api/v2/workflow/") && strings.HasSuffix(p, "/job"):
+		return callWorkflowJobs
+	case strings.HasPrefix(p, "/api/v2/workflow/"):
+		return callWorkflow
+	case strings.HasPrefix(p, "/api/v2/pipeline/"):
+		return callPipeline
+	case buildPath.MatchString(p):
+		return callBuild
+	}
+	return callBuildList
+}
+
+func (c *callCounter) count(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = map[string]int{}
+	}
+	c.counts[callKind(req)]++
+}
+
+// String summarizes the counts, eg "3 requests: build-list 1, download 2".
+func (c *callCounter) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := 0
+	for _, n := range c.counts {
+		total += n
+	}
+	return fmt.Sprintf("%d requests: %s", total, callCounts(c.counts))
+}
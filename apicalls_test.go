@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_apiCallsCounted(t *testing.T) {
+	defer func(c *callCounter) { apiCalls = c }(apiCalls)
+	apiCalls = &callCounter{}
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v1.1/me":
+			io.WriteString(w, `{"login": "nbio"}`)
+		case strings.HasSuffix(r.URL.Path, "/tree/master"):
+			io.WriteString(w, `[{"build_num": 7, "outcome": "success"}]`)
+		case strings.HasSuffix(r.URL.Path, "/7/artifacts"):
+			fmt.Fprintf(w, `[{"path": "a.txt", "url": "%[1]s/0/a.txt"}, {"path": "b.txt", "url": "%[1]s/0/b.txt"}]`, ts.URL)
+		default:
+			io.WriteString(w, "hi")
+		}
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10}
+	if err := preflight(opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchBuilds(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.BuildNum = 7
+	artifacts, err := fetchBuildArtifacts(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range artifacts {
+		if _, err := probeArtifact(context.Background(), a); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := verifyArtifact(a, a.Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "7 requests: artifact-list 1, build-list 1, download 2, me 1, probe 2"
+	if got := apiCalls.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
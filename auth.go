@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// API v1.1 documents the token as a circle-token query parameter, which is
+// what we send by default.  Other installs (eg, CircleCI server behind a
+// proxy) may instead want it in a header, so the scheme can be chosen per
+// host with -auth-scheme.  All requests go through doRequest, which calls
+// authorize, so this is the one place where credentials are attached.
+
+type authScheme string
+
+const (
+	authQuery       authScheme = "query"        // ?circle-token=
+	authCircleToken authScheme = "circle-token" // Circle-Token: header
+	authBearer      authScheme = "bearer"       // Authorization: Bearer
+
+	defaultAuthScheme = authQuery
+)
+
+// authSchemes maps hostnames to how they want the token sent.
+var authSchemes = map[string]authScheme{}
+
+func parseAuthSchemes(s string) (map[string]authScheme, error) {
+	schemes := map[string]authScheme{}
+	for _, pair := range strings.Split(s, ",") {
+		host, scheme, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("bad -auth-scheme %q: want host=scheme", pair)
+		}
+		switch as := authScheme(strings.ToLower(scheme)); as {
+		case authQuery, authCircleToken, authBearer:
+			schemes[strings.ToLower(host)] = as
+		default:
+			return nil, fmt.Errorf("bad -auth-scheme %q: scheme must be query, circle-token or bearer", pair)
+		}
+	}
+	return schemes, nil
+}
+
+// loadToken returns the token from -token (as flagValue) or else from the
+// environment.  Tokens are often pasted with a trailing newline, which would
+// make for a malformed header and a confusing 401, so whitespace is trimmed
+// here, whatever the source.  So is the scheme, which some secret managers
+// hand back with the token.
+func loadToken(flagValue string) string {
+	if flagValue == "" {
+		flagValue = os.Getenv("CIRCLE_TOKEN")
+	}
+	return stripTokenScheme(strings.TrimSpace(flagValue))
+}
+
+// tokenSchemes are the words which, leading a token, are its scheme (or
+// header name) rather than part of it; authorize adds its own.
+var tokenSchemes = []string{"bearer", "circle-token"}
+
+// stripTokenScheme returns token without a leading scheme, as in "Bearer
+// abc123" or "Circle-Token: abc123".  Only the known schemes are stripped,
+// and only from before a single word, which tokens are.
+func stripTokenScheme(token string) string {
+	word, rest, ok := strings.Cut(token, " ")
+	rest = strings.TrimSpace(rest)
+	if !ok || rest == "" || strings.ContainsAny(rest, " \t") {
+		return token
+	}
+	word = strings.ToLower(strings.TrimSuffix(word, ":"))
+	for _, scheme := range tokenSchemes {
+		if word == scheme {
+			return rest
+		}
+	}
+	return token
+}
+
+func authSchemeFor(host string) authScheme {
+	if as, ok := authSchemes[strings.ToLower(host)]; ok {
+		return as
+	}
+	return defaultAuthScheme
+}
+
+// The token is only sent to trusted hosts: that of -host, CircleCI's
+// artifact store, and any given with -trusted-host.  Server installs may keep
+// artifacts in a store of their own, which is only trusted if named.
+// Entries with a leading dot match any subdomain.
+var trustedHosts = defaultTrustedHosts(defaultHost)
+
+func defaultTrustedHosts(host string) []string {
+	hosts := []string{".circle-artifacts.com"}
+	if u, err := url.Parse(host); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, strings.ToLower(u.Hostname()))
+	}
+	return hosts
+}
+
+// parseTrustedHosts parses the comma-separated -trusted-host, where
+// "*.example.com" is the same as ".example.com".
+func parseTrustedHosts(s string) ([]string, error) {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		h = strings.TrimPrefix(h, "*")
+		if strings.Trim(h, ".") == "" || strings.ContainsAny(h, "/:*") {
+			return nil, fmt.Errorf("bad -trusted-host %q: want a hostname, or .domain for its subdomains", h)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+func trusted(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	for _, h := range trustedHosts {
+		if hostname == h || strings.HasPrefix(h, ".") && strings.HasSuffix(hostname, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize attaches the token to req, as its host wants it, if the host is
+// trusted with it.
+func authorize(req *http.Request) {
+	if circleToken == "" || !trusted(req.URL.Hostname()) {
+		return
+	}
+	switch authSchemeFor(req.URL.Hostname()) {
+	case authCircleToken:
+		req.Header.Set("Circle-Token", circleToken)
+	case authBearer:
+		req.Header.Set("Authorization", "Bearer "+circleToken)
+	default:
+		q := req.URL.Query()
+		q.Set("circle-token", circleToken)
+		req.URL.RawQuery = q.Encode()
+	}
+}
+
+// preflight checks the token with one cheap request, before a long
+// operation (eg, -all) can discover a problem with it part of the way in.
+func preflight(opts URLOptions) error {
+	e, err := opts.expander()
+	if err != nil {
+		return err
+	}
+	u := e.ExpandURL(meURL)
+	verboseln("Preflight:", censorURL(u))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("preflight: %s rejected the token (%s): check $CIRCLE_TOKEN or -token, and -auth-scheme (or -skip-preflight)",
+			req.URL.Host, res.Status)
+	case res.StatusCode != http.StatusOK:
+		return fmt.Errorf("preflight: %s responded %s (check http://status.circleci.com, or -skip-preflight)", req.URL.Host, res.Status)
+	}
+	return nil
+}
+
+// checkRedirect is as net/http's default, except that the token goes with
+// the redirect only to a trusted host, however it was sent: net/http would
+// pass our Circle-Token header to any host, and drop Authorization on the way
+// from the API to its artifact store.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if trusted(req.URL.Hostname()) {
+		authorize(req)
+		return nil
+	}
+	req.Header.Del("Circle-Token")
+	req.Header.Del("Authorization")
+	if q := req.URL.Query(); q.Has("circle-token") {
+		q.Del("circle-token")
+		req.URL.RawQuery = q.Encode()
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_authorizePerHost(t *testing.T) {
+	defer func(s map[string]authScheme) { authSchemes = s }(authSchemes)
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+	trustedHosts = append(defaultTrustedHosts(defaultHost), ".example.com")
+	circleToken = "secret-token"
+	defer func() { circleToken = "" }()
+
+	var err error
+	authSchemes, err = parseAuthSchemes("circle.example.com=bearer, proxy.example.com=circle-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		url, query, circle, bearer string
+	}{
+		{"https://circleci.com/api/v1.1/me", "secret-token", "", ""},
+		{"https://circle.example.com/api/v1.1/me", "", "", "Bearer secret-token"},
+		{"https://proxy.example.com/api/v1.1/me", "", "secret-token", ""},
+	} {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorize(req)
+		if got := req.URL.Query().Get("circle-token"); got != tc.query {
+			t.Errorf("%s: Expected query token %q, got %q", tc.url, tc.query, got)
+		}
+		if got := req.Header.Get("Circle-Token"); got != tc.circle {
+			t.Errorf("%s: Expected Circle-Token %q, got %q", tc.url, tc.circle, got)
+		}
+		if got := req.Header.Get("Authorization"); got != tc.bearer {
+			t.Errorf("%s: Expected Authorization %q, got %q", tc.url, tc.bearer, got)
+		}
+	}
+
+	if _, err := parseAuthSchemes("circle.example.com=basic"); err == nil {
+		t.Errorf("Expected error for unknown scheme")
+	}
+}
+
+func Test_loadTokenTrimmed(t *testing.T) {
+	defer func(s map[string]authScheme) { authSchemes = s }(authSchemes)
+	authSchemes = map[string]authScheme{"circle.example.com": authBearer}
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+	trustedHosts = defaultTrustedHosts("https://circle.example.com")
+	defer func() { circleToken = "" }()
+
+	t.Setenv("CIRCLE_TOKEN", " \tfrom-env\r\n")
+	for _, tc := range []struct{ flag, want string }{
+		{"from-flag\n", "from-flag"},
+		{"", "from-env"},
+	} {
+		circleToken = loadToken(tc.flag)
+		req, err := http.NewRequest("GET", "https://circle.example.com/api/v1.1/me", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorize(req)
+		if got, want := req.Header.Get("Authorization"), "Bearer "+tc.want; got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+}
+
+func Test_loadTokenScheme(t *testing.T) {
+	defer func(s map[string]authScheme) { authSchemes = s }(authSchemes)
+	authSchemes = map[string]authScheme{"circle.example.com": authBearer}
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+	trustedHosts = defaultTrustedHosts("https://circle.example.com")
+	defer func() { circleToken = "" }()
+
+	for _, tc := range []struct{ token, want string }{
+		{"Bearer abc123", "abc123"},
+		{"bearer  abc123\n", "abc123"},
+		{"Circle-Token abc123", "abc123"},
+		{"Circle-Token: abc123", "abc123"},
+		{"abc123", "abc123"},
+		{"Token abc123", "Token abc123"}, // not a scheme we know
+		{"Bearer a b", "Bearer a b"},
+		{"Bearer", "Bearer"},
+	} {
+		circleToken = loadToken(tc.token)
+		if circleToken != tc.want {
+			t.Errorf("%q: Expected %q, got %q", tc.token, tc.want, circleToken)
+		}
+	}
+
+	circleToken = loadToken("Bearer abc123")
+	req, err := http.NewRequest("GET", "https://circle.example.com/api/v1.1/me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize(req)
+	if got, want := req.Header.Get("Authorization"), "Bearer abc123"; got != want {
+		t.Errorf("Expected %q, not double-prefixed, got %q", want, got)
+	}
+}
+
+func Test_checkRedirectStripsToken(t *testing.T) {
+	defer func(s map[string]authScheme) { authSchemes = s }(authSchemes)
+	authSchemes = map[string]authScheme{"127.0.0.1": authCircleToken}
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+	trustedHosts = []string{"127.0.0.1"}
+	circleToken = "secret-token"
+	defer func() { circleToken = "" }()
+
+	var sent, leaked string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Get("Circle-Token")
+	}))
+	defer storage.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get("Circle-Token")
+		// localhost is another host than 127.0.0.1, as far as redirects go
+		http.Redirect(w, r, strings.Replace(storage.URL, "127.0.0.1", "localhost", 1)+"/a.txt", http.StatusFound)
+	}))
+	defer api.Close()
+
+	req, err := http.NewRequest("GET", api.URL+"/a.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if sent != circleToken {
+		t.Errorf("Expected Circle-Token %q to the API, got %q", circleToken, sent)
+	}
+	if leaked != "" {
+		t.Errorf("Expected no Circle-Token after cross-host redirect, got %q", leaked)
+	}
+}
+
+func Test_trustedHostDownload(t *testing.T) {
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+	circleToken = "secret-token"
+	defer func() { circleToken = "" }()
+
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get("circle-token")
+		io.WriteString(w, "hello")
+	}))
+	defer ts.Close()
+	// the same server, by a name which is not trusted
+	untrusted := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	trustedHosts = defaultTrustedHosts(ts.URL)
+	for _, tc := range []struct{ url, want string }{
+		{ts.URL + "/0/bin/cart", "secret-token"},
+		{untrusted + "/0/bin/cart", ""},
+	} {
+		got = "unset"
+		if _, _, err := verifyArtifact(artifact{URL: tc.url}, "bin/cart"); err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: Expected token %q, got %q", tc.url, tc.want, got)
+		}
+	}
+
+	hosts, err := parseTrustedHosts("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedHosts = append(trustedHosts, hosts...)
+	if _, _, err := verifyArtifact(artifact{URL: untrusted + "/0/bin/cart"}, "bin/cart"); err != nil {
+		t.Fatal(err)
+	}
+	if got != circleToken {
+		t.Errorf("-trusted-host localhost: Expected token %q, got %q", circleToken, got)
+	}
+
+	if !trusted("123-456-gh.circle-artifacts.com") || trusted("circle-artifacts.com.evil.example") {
+		t.Errorf("Expected subdomains of circle-artifacts.com trusted, and only those")
+	}
+	if _, err := parseTrustedHosts("https://example.com/"); err == nil {
+		t.Errorf("Expected error for a URL as -trusted-host")
+	}
+}
+
+func Test_preflight(t *testing.T) {
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+	trustedHosts = []string{"127.0.0.1"}
+	circleToken = "bad-token"
+	defer func() { circleToken = "" }()
+
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Query().Get("circle-token") != "good-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"login": "nbio"}`)
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart"}
+	err := preflight(opts)
+	if err == nil || !strings.Contains(err.Error(), "rejected the token") {
+		t.Errorf("Expected token rejected, got %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/api/v1.1/me" {
+		t.Errorf("Expected a single request of /api/v1.1/me, got %v", paths)
+	}
+
+	circleToken = "good-token"
+	if err := preflight(opts); err != nil {
+		t.Errorf("Expected preflight to pass, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Between retries, doRequest and fetchArtifact wait as -backoff says:
+// "fixed" waits the base delay every time, which is predictable;
+// "exponential" doubles it for each retry, up to the cap; and "jitter" (the
+// default) waits a random time up to that of exponential, so that many
+// clients retrying at once don't hit a struggling server in step.
+
+const (
+	defaultBackoff     = "jitter"
+	defaultBackoffBase = time.Second
+	defaultBackoffCap  = 30 * time.Second
+)
+
+type backoff interface {
+	// delay is the wait before retry number n, counting from 0.
+	delay(n int) time.Duration
+}
+
+type fixedBackoff struct{ base time.Duration }
+
+func (b fixedBackoff) delay(int) time.Duration { return b.base }
+
+type exponentialBackoff struct{ base, cap time.Duration }
+
+func (b exponentialBackoff) delay(n int) time.Duration {
+	d := b.base
+	for i := 0; i < n && d < b.cap; i++ {
+		d *= 2
+	}
+	if d > b.cap {
+		return b.cap
+	}
+	return d
+}
+
+type jitterBackoff struct {
+	exponentialBackoff
+	rand func(n int64) int64 // in [0, n)
+}
+
+func (b jitterBackoff) delay(n int) time.Duration {
+	d := b.exponentialBackoff.delay(n)
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(b.rand(int64(d) + 1))
+}
+
+var retryBackoff, _ = newBackoff(defaultBackoff, defaultBackoffBase, defaultBackoffCap)
+
+func newBackoff(kind string, base, cap time.Duration) (backoff, error) {
+	if base < 0 || cap < base {
+		return nil, fmt.Errorf("bad backoff: want 0 <= -backoff-base (%s) <= -backoff-cap (%s)", base, cap)
+	}
+	switch kind {
+	case "fixed":
+		return fixedBackoff{base}, nil
+	case "exponential":
+		return exponentialBackoff{base, cap}, nil
+	case "jitter":
+		return jitterBackoff{exponentialBackoff{base, cap}, rand.Int63n}, nil
+	}
+	return nil, fmt.Errorf("bad -backoff %q: want fixed, exponential or jitter", kind)
+}
+
+// sleep waits for d, or until ctx is done.  Tests may replace it.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
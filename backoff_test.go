@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func delays(b backoff, n int) []time.Duration {
+	var ds []time.Duration
+	for i := 0; i < n; i++ {
+		ds = append(ds, b.delay(i))
+	}
+	return ds
+}
+
+func Test_backoffDelays(t *testing.T) {
+	const s = time.Second
+	exp := exponentialBackoff{s, 10 * s}
+	for _, tc := range []struct {
+		name string
+		b    backoff
+		want []time.Duration
+	}{
+		{"fixed", fixedBackoff{s}, []time.Duration{s, s, s, s, s}},
+		{"exponential", exp, []time.Duration{s, 2 * s, 4 * s, 8 * s, 10 * s}},
+		// rand at its greatest is exponential, at its least no wait at all
+		{"jitter max", jitterBackoff{exp, func(n int64) int64 { return n - 1 }}, []time.Duration{s, 2 * s, 4 * s, 8 * s, 10 * s}},
+		{"jitter half", jitterBackoff{exp, func(n int64) int64 { return n / 2 }}, []time.Duration{s / 2, s, 2 * s, 4 * s, 5 * s}},
+		{"jitter min", jitterBackoff{exp, func(int64) int64 { return 0 }}, []time.Duration{0, 0, 0, 0, 0}},
+	} {
+		if got := delays(tc.b, len(tc.want)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: Expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	b, err := newBackoff("jitter", s, 10*s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range delays(b, 8) {
+		if d < 0 || d > exp.delay(i) {
+			t.Errorf("jitter %d: Expected 0 to %s, got %s", i, exp.delay(i), d)
+		}
+	}
+	for _, bad := range []struct {
+		kind      string
+		base, cap time.Duration
+	}{
+		{"linear", s, s},
+		{"fixed", 2 * s, s},
+		{"fixed", -s, s},
+	} {
+		if _, err := newBackoff(bad.kind, bad.base, bad.cap); err == nil {
+			t.Errorf("%+v: Expected error", bad)
+		}
+	}
+}
+
+func Test_doRequestBackoff(t *testing.T) {
+	defer func(b backoff) { retryBackoff = b }(retryBackoff)
+	defer func(f func(context.Context, time.Duration) error) { sleep = f }(sleep)
+	var slept []time.Duration
+	sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	retryBackoff = exponentialBackoff{time.Second, 3 * time.Second}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := doRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if want := delays(retryBackoff, maxRetries); !reflect.DeepEqual(slept, want) {
+		t.Errorf("Expected waits of %v, got %v", want, slept)
+	}
+}
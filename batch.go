@@ -0,0 +1,67 @@
+package main
+
+import "fmt"
+
+// The batch modes (-all, -last-n and -workflow-artifacts) act on several
+// items, any of which may fail.  -fail-fast stops at the first failure;
+// -keep-going attempts every item and reports the failures at the end.
+// Either way, a failure means a failed exit.  Without either, each mode
+// keeps its own default: -last-n keeps going, as a missing artifact from one
+// build shouldn't lose the others, and the rest stop.
+
+type errorPolicy int
+
+const (
+	policyDefault errorPolicy = iota
+	policyFailFast
+	policyKeepGoing
+)
+
+var (
+	batchPolicy errorPolicy
+	batchFailed bool // by a batch which kept going
+)
+
+// batch tallies the outcomes of a batch's items.
+type batch struct {
+	keepGoing bool
+	total     int
+	failed    int
+	first     error
+}
+
+// newBatch starts a batch, which keeps going after failures if the policy
+// says so, or else if keepGoing is the mode's default.
+func newBatch(keepGoing bool) *batch {
+	switch batchPolicy {
+	case policyFailFast:
+		keepGoing = false
+	case policyKeepGoing:
+		keepGoing = true
+	}
+	return &batch{keepGoing: keepGoing}
+}
+
+// done records the outcome of an item, and reports whether to carry on.
+func (b *batch) done(err error) bool {
+	b.total++
+	if err == nil {
+		return true
+	}
+	b.failed++
+	if b.first == nil {
+		b.first = err
+	}
+	return b.keepGoing
+}
+
+// err summarizes the failures, if any.
+func (b *batch) err() error {
+	switch {
+	case b.failed == 0:
+		return nil
+	case !b.keepGoing:
+		return b.first
+	}
+	return fmt.Errorf("%d of %d failed, the first with: %s", b.failed, b.total, b.first)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_downloadAllPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/gone.txt") {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+	defer func() { batchPolicy = policyDefault }()
+
+	for _, tc := range []struct {
+		policy    errorPolicy
+		wroteLast bool
+		errWant   string
+	}{
+		{policyDefault, false, "404"},
+		{policyFailFast, false, "404"},
+		{policyKeepGoing, true, "1 of 3 failed"},
+	} {
+		batchPolicy = tc.policy
+		dir := t.TempDir()
+		var plan []plannedDownload
+		for _, name := range []string{"first.txt", "gone.txt", "last.txt"} {
+			plan = append(plan, plannedDownload{artifact{URL: ts.URL + "/" + name, Path: name}, filepath.Join(dir, name)})
+		}
+		err := downloadAll(plan)
+		if err == nil || !strings.Contains(err.Error(), tc.errWant) {
+			t.Errorf("policy %d: Expected error with %q, got %v", tc.policy, tc.errWant, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "first.txt")); err != nil {
+			t.Errorf("policy %d: Expected first.txt written, got %v", tc.policy, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "last.txt")); (err == nil) != tc.wroteLast {
+			t.Errorf("policy %d: Expected last.txt written %v, got %v", tc.policy, tc.wroteLast, err)
+		}
+	}
+}
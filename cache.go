@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The artifact list of a build is fetched once per invocation, but separate
+// invocations for the same build, eg `cart -build 123 a; cart -build 123 b`,
+// would each fetch it again.  With -artifact-list-cache we keep the list on
+// disk for a short while, keyed by host, project and build number.
+
+const defaultArtifactCacheTTL = 10 * time.Minute
+
+// cacheDirFlag, if set with -cache-dir, is where cart keeps its on-disk
+// caches, rather than in the user's cache directory: artifact lists under
+// artifacts/, and git remote URLs under repos/.  A -cas-dir is not a cache:
+// it's the user's own store, wherever they put it.
+var cacheDirFlag string
+
+// cacheSubdirs are those of cacheDir which cart writes, and -clear-cache
+// removes.
+var cacheSubdirs = []string{"artifacts", "repos"}
+
+// cacheDir is where cart keeps any on-disk caches.
+func cacheDir() string {
+	if cacheDirFlag != "" {
+		return cacheDirFlag
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "cart")
+}
+
+type artifactCache struct {
+	dir string
+	ttl time.Duration
+	now func() time.Time
+}
+
+type artifactCacheEntry struct {
+	Fetched   time.Time  `json:"fetched"`
+	Artifacts []artifact `json:"artifacts"`
+}
+
+func (c artifactCache) path(opts URLOptions) string {
+	host := opts.Host
+	if host == "" {
+		host = defaultHost
+	}
+	// The same project and build number may be at several VCS providers.
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s %s/%s %d", host, opts.provider().VCSType(), opts.Project, opts.BuildNum)))
+	return filepath.Join(c.dir, hex.EncodeToString(key[:])+".json")
+}
+
+// get returns the cached artifact list for the build in opts, if there is
+// one which has not yet expired.
+func (c artifactCache) get(opts URLOptions) ([]artifact, bool) {
+	b, err := os.ReadFile(c.path(opts))
+	if err != nil {
+		return nil, false
+	}
+	var entry artifactCacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return nil, false
+	}
+	if c.now().Sub(entry.Fetched) > c.ttl {
+		return nil, false
+	}
+	return entry.Artifacts, true
+}
+
+func (c artifactCache) put(opts URLOptions, artifacts []artifact) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(artifactCacheEntry{Fetched: c.now(), Artifacts: artifacts})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(opts), b, 0600)
+}
+
+// clearCache removes the caches cart keeps under dir, and then dir itself if
+// that leaves it empty.  Only what cart writes is removed, since -cache-dir
+// may name a directory with other things in it.
+func clearCache(dir string) error {
+	for _, sub := range cacheSubdirs {
+		if err := os.RemoveAll(filepath.Join(dir, sub)); err != nil {
+			return err
+		}
+	}
+	err := os.Remove(dir)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if entries, rerr := os.ReadDir(dir); rerr == nil && len(entries) > 0 {
+		return nil // not ours to remove
+	}
+	return err
+}
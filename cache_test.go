@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_artifactCache(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := artifactCache{dir: t.TempDir(), ttl: time.Minute, now: func() time.Time { return now }}
+	opts := URLOptions{Project: "nbio/cart", BuildNum: 123}
+	artifacts := []artifact{{Path: "a", URL: "https://example.com/a"}, {Path: "b", URL: "https://example.com/b", NodeIndex: 1}}
+
+	if _, ok := cache.get(opts); ok {
+		t.Fatalf("Expected cache miss before put")
+	}
+	if err := cache.put(opts, artifacts); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := cache.get(opts)
+	if !ok || len(got) != len(artifacts) || got[0] != artifacts[0] || got[1] != artifacts[1] {
+		t.Errorf("Expected cache hit with %+v, got %+v (%t)", artifacts, got, ok)
+	}
+	if _, ok := cache.get(URLOptions{Project: "nbio/cart", BuildNum: 124}); ok {
+		t.Errorf("Expected cache miss for another build")
+	}
+	if _, ok := cache.get(URLOptions{Provider: bitbucket, Project: "nbio/cart", BuildNum: 123}); ok {
+		t.Errorf("Expected cache miss for the same build at another VCS provider")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.get(opts); ok {
+		t.Errorf("Expected cache miss after TTL")
+	}
+}
+
+func Test_clearCache(t *testing.T) {
+	defer func(d string) { cacheDirFlag = d }(cacheDirFlag)
+	cacheDirFlag = filepath.Join(t.TempDir(), "cart-cache")
+	if cacheDir() != cacheDirFlag {
+		t.Fatalf("Expected -cache-dir %s honored, got %s", cacheDirFlag, cacheDir())
+	}
+
+	cache := artifactCache{dir: filepath.Join(cacheDir(), "artifacts"), ttl: time.Minute, now: time.Now}
+	opts := URLOptions{Project: "nbio/cart", BuildNum: 123}
+	if err := cache.put(opts, []artifact{{Path: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cache.path(opts)); err != nil {
+		t.Fatalf("Expected the list cached under -cache-dir: %s", err)
+	}
+	if err := clearCache(cacheDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cacheDir()); !os.IsNotExist(err) {
+		t.Errorf("Expected the cache dir removed, got %v", err)
+	}
+	if err := clearCache(cacheDir()); err != nil {
+		t.Errorf("Expected clearing no cache to be fine, got %s", err)
+	}
+
+	// Other things in -cache-dir are left be.
+	cacheDirFlag = t.TempDir()
+	mine := filepath.Join(cacheDirFlag, "notes.txt")
+	if err := os.WriteFile(mine, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache.dir = filepath.Join(cacheDir(), "artifacts")
+	if err := cache.put(opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := clearCache(cacheDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cache.dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the artifact lists removed, got %v", err)
+	}
+	if _, err := os.Stat(mine); err != nil {
+		t.Errorf("Expected other files kept, got %v", err)
+	}
+}
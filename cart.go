@@ -1,20 +1,29 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -22,11 +31,24 @@ const (
 	// but beware that the summary is missing some method/URL pairs which are
 	// described further down in the page.
 
-	buildListURL = "https://circleci.com/api/v1.1/project/github/${project}/tree/${branch}?limit=${retrieve_count}&filter=successful&circle-token=${circle_token}"
-	artifactsURL = "https://circleci.com/api/v1.1/project/github/${project}/${build_num}/artifacts?circle-token=${circle_token}"
+	// The build lists' query strings are composed by buildListQuery.
+	buildListURL     = "${host}/api/v1.1/project/${vcs}/${project}/tree/${branch}"
+	projectBuildsURL = "${host}/api/v1.1/project/${vcs}/${project}"
+	artifactsURL     = "${host}/api/v1.1/project/${vcs}/${project}/${build_num}/artifacts"
+	buildURL         = "${host}/api/v1.1/project/${vcs}/${project}/${build_num}"
+	meURL            = "${host}/api/v1.1/me"
+
+	defaultHost = "https://circleci.com"
 
 	// We need to account for multiple workflows, and multiple builds within workflows
 	defaultRetrieveCount = 10
+	maxRetrieveCount     = 100 // the most the API will list at once
+
+	defaultBufferSize = 64 << 10
+
+	// Exit codes beyond log.Fatal's 1, for failures which scripts may want to
+	// tell apart.
+	exitTooFewArtifacts = 3
 )
 
 // censorURLfields caveat: keys in the query-map are case-sensitive
@@ -39,22 +61,56 @@ type workflow struct {
 	WorkflowID   string `json:"workflow_id"`
 }
 
+type user struct {
+	Login string `json:"login"`
+}
+
 type build struct {
 	BuildNum  int       `json:"build_num"`
+	Branch    string    `json:"branch"`
 	Revision  string    `json:"vcs_revision"`
-	Workflows *workflow `json:"workflows"` // plural name but singleton struct
+	Tag       string    `json:"vcs_tag"`
+	Workflows *workflow `json:"workflows" strict:"optional"` // plural name but singleton struct
 
 	// We want to skip bad builds, and perhaps print the others so that if
 	// there's a mismatch from expectations, folks might notice.
-	Outcome  string `json:"outcome"`
-	Subject  string `json:"subject"`
-	StopTime string `json:"stop_time"`
+	Outcome   string `json:"outcome"`
+	Subject   string `json:"subject"`
+	StartTime string `json:"start_time"`
+	StopTime  string `json:"stop_time"`
+
+	// User is who triggered the build (for a push, the pusher), which is
+	// what -triggered-by filters upon; Why is how, eg "github" or "api".
+	User *user  `json:"user"`
+	Why  string `json:"why"`
+}
+
+// duration returns how long b took, from its start to its stop time, if it
+// has both; a build which hasn't started or finished has none.
+func (b build) duration() (time.Duration, bool) {
+	start, err := time.Parse(time.RFC3339, b.StartTime)
+	if err != nil || start.IsZero() {
+		return 0, false
+	}
+	stop, err := time.Parse(time.RFC3339, b.StopTime)
+	if err != nil || stop.IsZero() || stop.Before(start) {
+		return 0, false
+	}
+	return stop.Sub(start), true
+}
+
+// running is true for builds which have not yet finished, which have no
+// outcome until they do.
+func (b build) running() bool {
+	return b.Outcome == "" || b.Outcome == "running"
 }
 
 type artifact struct {
 	URL       string `json:"url"`
 	Path      string `json:"path"`
 	NodeIndex int    `json:"node_index"`
+
+	build *build // which produced it, for -long; nil if not known
 }
 
 // FilterSet is the collection of attributes upon which we filter the results
@@ -64,6 +120,150 @@ type FilterSet struct {
 	workflow  string
 	jobname   string
 	anyFlowID bool
+
+	// latestOnly takes the first qualifying build, of -job if given,
+	// whichever workflow it's part of: it overrides any workflow name (eg
+	// one which a wrapper script always passes), and so any latching to the
+	// latest workflow run.
+	latestOnly bool
+
+	includeRunning bool
+	failOnMultiple bool
+
+	// requireArtifact only picks a build which has the artifact, looking at
+	// the artifacts of each candidate in turn, rather than picking first
+	// and failing if it has none.  Like latestOnly, it doesn't latch to the
+	// latest workflow run, as that might be the one without it.
+	requireArtifact bool
+
+	triggeredBy string
+	lastN       int // pick this many builds, rather than one
+
+	// triggerTypes keeps to builds whose pipeline was triggered in one of
+	// these ways, as triggerTypeOf looks up (see triggertype.go).
+	triggerTypes  []string
+	triggerTypeOf func(build) (string, error)
+
+	// tag selects builds triggered by a git tag.  API v1.1 has no endpoint
+	// for the builds of a tag, and they're not on any branch, so we list the
+	// recent builds of the whole project and look at their vcs_tag.  So the
+	// tag's builds need to be within -search-depth of the project's latest.
+	tag string
+
+	// branchGlob selects builds of branches matching a glob, eg "pr-*",
+	// for when the exact name isn't known.  As with tag, that means looking
+	// at the recent builds of the whole project, and their branch.
+	branchGlob string
+
+	// sinceRev asks for the oldest qualifying build newer than this revision.
+	// We can't compute git ancestry from the build list, so we approximate:
+	// scanning newest-first, we stop at the first build of that revision and
+	// pick the last qualifying build seen before it.  Builds are ordered by
+	// build number, so a re-run of an older commit may confuse this.  Builds
+	// are not latched to the latest workflow run either, since we want the
+	// earliest after the revision.
+	sinceRev string
+
+	// workflowMatch is how workflow is compared to workflow names: "exact"
+	// (the default), "prefix" or "regex" (compiled into workflowRe).  With
+	// strictWorkflow, it's an error for several workflow names to match.
+	workflowMatch  string
+	workflowRe     *regexp.Regexp
+	strictWorkflow bool
+}
+
+// compileWorkflowMatch validates the workflow match mode, compiling the
+// pattern for the regex mode.
+func (f *FilterSet) compileWorkflowMatch() error {
+	switch f.workflowMatch {
+	case "", "exact", "prefix":
+		return nil
+	case "regex":
+		re, err := regexp.Compile(f.workflow)
+		if err != nil {
+			return fmt.Errorf("bad -workflow regex: %s", err)
+		}
+		f.workflowRe = re
+		return nil
+	}
+	return fmt.Errorf("bad -workflow-match %q: use exact, prefix or regex", f.workflowMatch)
+}
+
+// workflowPreference splits workflow as an ordered list of the workflows
+// to prefer, eg "main,pr", unless it's a regex.
+func (f FilterSet) workflowPreference() []string {
+	if f.workflowMatch == "regex" || !strings.Contains(f.workflow, ",") {
+		return []string{f.workflow}
+	}
+	var names []string
+	for _, name := range strings.Split(f.workflow, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// matchWorkflow reports whether a build's workflow name passes the filter.
+func (f FilterSet) matchWorkflow(name string) bool {
+	switch {
+	case f.workflow == "":
+		return true
+	case f.workflowMatch == "prefix":
+		return strings.HasPrefix(name, f.workflow)
+	case f.workflowRe != nil:
+		return f.workflowRe.MatchString(name)
+	}
+	return name == f.workflow
+}
+
+// ArtifactFilter is the collection of attributes upon which we narrow the
+// artifacts of a build, both for listing and for downloading.
+type ArtifactFilter struct {
+	nodes      nodeSet // nil for any node
+	pathPrefix string
+	pattern    string
+
+	// pattern is matched against the file name, unless patternFull is set,
+	// when it's matched against the whole path.
+	patternFull bool
+}
+
+func (f ArtifactFilter) active() bool {
+	return f.nodes != nil || f.pathPrefix != "" || f.pattern != ""
+}
+
+func (f ArtifactFilter) match(a artifact) bool {
+	if f.nodes != nil && !f.nodes.has(a.NodeIndex) {
+		return false
+	}
+	if !strings.HasPrefix(a.Path, f.pathPrefix) {
+		return false
+	}
+	if f.pattern != "" {
+		name := filepath.Base(a.Path)
+		if f.patternFull {
+			name = a.Path
+		}
+		// the pattern is validated up-front, so ignore ErrBadPattern here
+		if ok, _ := filepath.Match(f.pattern, name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func filterArtifacts(artifacts []artifact, f ArtifactFilter) []artifact {
+	if !f.active() {
+		return artifacts
+	}
+	var matched []artifact
+	for _, a := range artifacts {
+		if f.match(a) {
+			matched = append(matched, a)
+		}
+	}
+	return matched
 }
 
 // Expander is used to take strings containing ${var} and interpolate them,
@@ -94,25 +294,161 @@ func (e *Expander) ExpandURL(src string) string {
 	return normalizeURL(os.Expand(src, e.Get))
 }
 
+// URLOptions holds the fields from which the CircleCI API URLs are built.
+// The URLs carry no credentials: those are added to each request as it is
+// sent, according to the -auth-scheme of its host.
+type URLOptions struct {
+	Host     string // scheme and host, eg "https://circleci.com"; empty for that default
+	Project  string // username/repo
+	Branch   string // empty for builds of all branches (and tags)
+	BuildNum int
+	Limit    int    // how many builds to list
+	Offset   int    // how many of the most recent builds to skip
+	Filter   string // server-side filter of builds listed, eg "successful"; empty for none
+
+	Provider Provider // the project's VCS host; nil for GitHub
+}
+
+func (o URLOptions) provider() Provider {
+	if o.Provider == nil {
+		return github
+	}
+	return o.Provider
+}
+
+func (o URLOptions) expander() (Expander, error) {
+	host := o.Host
+	if host == "" {
+		host = defaultHost
+	}
+	if err := checkHost(host); err != nil {
+		return nil, err
+	}
+	return Expander{
+		"host":      strings.TrimSuffix(host, "/"),
+		"project":   o.Project,
+		"branch":    o.Branch,
+		"build_num": strconv.Itoa(o.BuildNum),
+	}, nil
+}
+
+// listFilters are the values of the build list's filter parameter which the
+// API accepts, besides none.
+var listFilters = map[string]bool{
+	"completed":  true,
+	"successful": true,
+	"failed":     true,
+	"running":    true,
+}
+
+// buildListQuery returns the query string of the build list, having checked
+// its values, so that a typo is reported rather than quietly ignored by the
+// server.
+func buildListQuery(o URLOptions) (url.Values, error) {
+	q := url.Values{}
+	if o.Limit < 1 || o.Limit > maxRetrieveCount {
+		return nil, fmt.Errorf("list limit %d out of range: must be 1 to %d", o.Limit, maxRetrieveCount)
+	}
+	q.Set("limit", strconv.Itoa(o.Limit))
+	if o.Offset < 0 {
+		return nil, fmt.Errorf("list offset %d must not be negative", o.Offset)
+	}
+	if o.Offset > 0 {
+		q.Set("offset", strconv.Itoa(o.Offset))
+	}
+	if o.Filter != "" {
+		if !listFilters[o.Filter] {
+			return nil, fmt.Errorf("unknown list filter %q: want completed, successful, failed or running", o.Filter)
+		}
+		q.Set("filter", o.Filter)
+	}
+	return q, nil
+}
+
+func checkListQuery(o URLOptions) error {
+	_, err := buildListQuery(o)
+	return err
+}
+
+// BuildListURL returns the URL listing the recent builds of a branch, or of
+// the whole project if there's no branch.
+func BuildListURL(opts URLOptions) (*url.URL, error) {
+	return opts.provider().BuildListURL(opts)
+}
+
+// ArtifactsURL returns the URL listing the artifacts of a build.
+func ArtifactsURL(opts URLOptions) (*url.URL, error) {
+	return opts.provider().ArtifactsURL(opts)
+}
+
+// BuildURL returns the URL of a single build's summary.
+func BuildURL(opts URLOptions) (*url.URL, error) {
+	return opts.provider().BuildURL(opts)
+}
+
+// checkHost validates a -host override, which we interpolate into URLs,
+// since bad URLs there would otherwise be panics in ExpandURL.
+func checkHost(host string) error {
+	u, err := url.Parse(host)
+	if err != nil {
+		return fmt.Errorf("bad host %q: %s", host, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("bad host %q: need scheme://hostname", host)
+	}
+	// Plain http is for testing against local mocks.
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("bad host %q: scheme must be https or http", host)
+	}
+	return nil
+}
+
 var (
 	circleToken string
 	filter      FilterSet
+	artFilter   ArtifactFilter
 	dryRun      bool
 	verbosity   int
+	dumpBuilds  string
+	bufferSize  = defaultBufferSize
+
+	// rawDownload keeps artifacts' bytes as served, even if gzip-encoded.
+	rawDownload bool
+	// verifyOnly downloads artifacts but, rather than write them, reports
+	// their size and checksum.
+	verifyOnly bool
+
+	resolveTimeout time.Duration
+	httpClient     = newHTTPClient(false)
+
+	// diag is where verbose output and notes on finding the build go: stdout
+	// usually, but stderr when stdout is for the result (-resolve-only or
+	// -artifact-count).
+	diag io.Writer = output.Out
 )
 
+// newHTTPClient returns a client like http.DefaultClient, except that it
+// won't pass our credentials on to other hosts when redirected and with
+// noCompression it doesn't ask for (and transparently decode) gzip, so that
+// responses cross proxies and dumps as they are.
+func newHTTPClient(noCompression bool) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableCompression = noCompression
+	return &http.Client{Transport: t, CheckRedirect: checkRedirect}
+}
+
 func verbosenln(level int, items ...interface{}) {
 	if level > verbosity {
 		return
 	}
-	fmt.Println(items...)
+	fmt.Fprintln(diag, items...)
 }
 
 func verbosenf(level int, spec string, args ...interface{}) {
 	if level > verbosity {
 		return
 	}
-	fmt.Printf(spec, args...)
+	fmt.Fprintf(diag, spec, args...)
 }
 
 func verbosef(spec string, args ...interface{}) { verbosenf(1, spec, args...) }
@@ -121,27 +457,141 @@ func verboseln(items ...interface{})            { verbosenln(1, items...) }
 func main() {
 	var (
 		project             string
+		repoRegex           string
+		host                string
 		buildNum            int
 		outputPath          string
 		retrieveBuildsCount int
+		listOffset          int
+		listFilter          string
 		flagVerbose         bool
 		flagListArtifacts   bool
+		minArtifacts        int
+		useArtifactCache    bool
+		artifactCacheTTL    time.Duration
+		clearCacheOnly      bool
+		refresh             bool
+		fromURL             string
+		workflowURL         string
+		vcsName             string
+		provider            Provider
+		workflowID          string
+		failFast            bool
+		skipPreflight       bool
+		keepGoing           bool
+		workflowArtifacts   bool
+		workflowBuilds      []build
+		found               build
+		printURLFor         string
+		probe               string
+		withToken           bool
+		flagOutcomes        bool
+		jsonOutput          bool
+		noCompression       bool
+		resolveOnly         bool
+		rawBuild            bool
+		showConfig          bool
+		artifactCount       bool
+		flagLong            bool
+		asCommands          bool
+		urlsOnly            bool
+		failOnEmpty         bool
+		probeAll            bool
+		groupByNode         bool
+		flagStat            bool
+		compareSpec         string
+		compareSizes        bool
+		sortBy              string
+		flagAuthSchemes     string
+		flagTrustedHosts    string
+		flagRetryStatus     string
+		flagBackoff         string
+		backoffBase         time.Duration
+		backoffCap          time.Duration
+		flagAll             bool
+		pick                bool
+		outputDir           string
+		flatten             bool
 	)
 
 	log.SetFlags(log.Lshortfile)
-	log.SetOutput(os.Stderr)
+	log.SetOutput(output.Err)
 
 	flag.StringVar(&circleToken, "token", "", "CircleCI auth token")
+	flag.StringVar(&flagAuthSchemes, "auth-scheme", "", "how to send the token to each host, as `host=scheme,...` with schemes query, circle-token or bearer")
+	flag.StringVar(&flagTrustedHosts, "trusted-host", "", "also send the token to these `hosts`, comma-separated (.example.com for its subdomains)")
 	flag.StringVar(&outputPath, "o", "", "output file `path`")
+	flag.IntVar(&bufferSize, "buffer-size", defaultBufferSize, "write downloads through a buffer of this many `bytes`")
+	flag.BoolVar(&flagAll, "all", false, "download all of the (filtered) artifacts, into -output-dir")
+	flag.StringVar(&downloadOrder, "download-order", orderAsListed, "download -all or -pick in `order`: api, name, size (smallest first, asking for each size) or as-listed")
+	flag.BoolVar(&pick, "pick", false, "list the artifacts on stderr, and download those whose paths (or list lines) are read from stdin, into -output-dir")
+	flag.StringVar(&outputDir, "output-dir", ".", "with -all, output `directory`, within which artifact paths are kept")
+	flag.BoolVar(&tarMode, "tar", false, "with -all or -pick, write the artifacts as a tar archive to -o (- for stdout), not as files")
+	flag.BoolVar(&flatten, "flatten", false, "with -all, write artifacts by file name, not keeping their paths")
 	flag.BoolVar(&flagVerbose, "v", false, "verbose output (env $VERBOSITY=2|3|.. to see more)")
 	flag.BoolVar(&dryRun, "dry-run", false, "skip artifact download")
 	flag.BoolVar(&dryRun, "n", false, "(short for -dry-run)")
 	flag.BoolVar(&flagListArtifacts, "list-artifacts", false, "list artifacts")
 	flag.BoolVar(&flagListArtifacts, "l", false, "short for -list-artifacts")
+	flag.StringVar(&sortBy, "sort", "", "order -list-artifacts by `key`: path, node, or size (which asks for each artifact's size)")
+	flag.BoolVar(&failOnEmpty, "fail-on-empty", false, "fail, removing the file, if the artifact downloaded is empty")
+	flag.BoolVar(&urlsOnly, "urls-only", false, "with -list-artifacts, print just the URL of each artifact, instead")
+	flag.BoolVar(&asCommands, "as-commands", false, "with -list-artifacts, print a cart command to download each artifact, instead")
+	flag.BoolVar(&groupByNode, "group-by-node", false, "with -list-artifacts, group the artifacts under a header for each node")
+	flag.StringVar(&compareSpec, "compare", "", "print how the artifacts of two builds differ, given as `a:b`, eg 41:42; with -sizes, by size too")
+	flag.BoolVar(&compareSizes, "sizes", false, "with -compare, also list the artifacts whose size changed, asking for the size of each")
+	flag.BoolVar(&flagStat, "stat", false, "with -list-artifacts, tally the artifacts by file extension instead, with -long probing and totalling their sizes")
+	flag.BoolVar(&flagLong, "long", false, "with -list-artifacts, prefix each line with the build number and revision")
+	flag.BoolVar(&resolveOnly, "resolve-only", false, "print just the build number found to stdout, and exit")
+	flag.StringVar(&markerPath, "since-marker", "", "download only if the build found is new since the one recorded in this `file`, and record it")
+	flag.StringVar(&markerPath, "marker", "", "(short for -since-marker)")
+	flag.StringVar(&markerOn, "marker-on", defaultMarkerOn, "what makes a build new for -since-marker: a higher `build` number, or a different `rev`ision")
+	flag.BoolVar(&rawBuild, "raw-build", false, "print the API's JSON for the build found, as is (but for the token), and exit")
+	flag.BoolVar(&showConfig, "show-config", false, "print the effective settings, and where each came from, then exit (as JSON with -json)")
+	flag.BoolVar(&artifactCount, "artifact-count", false, "print just the number of (filtered) artifacts to stdout, and exit")
+	flag.BoolVar(&flagOutcomes, "outcomes", false, "summarize the outcomes of recent builds of the branch")
+	flag.BoolVar(&jsonOutput, "json", false, "JSON output, where supported; when searching for builds, why each was picked or skipped, and when downloading, the result of each")
+	flag.StringVar(&printURLFor, "print-url-for", "", "print the URL of `artifact` instead of downloading it")
+	flag.BoolVar(&probeAll, "probe-all", false, "print the number and total size of the artifacts which pass the filters, instead of downloading them")
+	flag.DurationVar(&headTimeout, "head-timeout", defaultHeadTimeout, "give up on the size of an artifact, for -probe-all, -stat -long, -compare -sizes and sorting by size, after this long, or 0 for never")
+	flag.StringVar(&probe, "probe", "", "print the status, size and type of `artifact` instead of downloading it")
+	flag.BoolVar(&withToken, "with-token", false, "include the auth token in URLs printed (careful!)")
+	flag.StringVar(&casDir, "cas-dir", "", "store the artifact by content, under `dir`/<sha256 prefix>/<sha256>, instead of -o")
+	flag.Func("max-size", "refuse artifacts larger than this many `bytes` (eg, 500MB)", func(s string) (err error) {
+		maxSize, err = parseByteSize(s)
+		return err
+	})
+	flag.Func("limit-rate", "cap the bandwidth of downloads at this many `bytes` a second (eg, 2MB)", func(s string) (err error) {
+		limitRate, err = parseByteSize(s)
+		return err
+	})
+	flag.Func("min-disk-free", "before writing, check the disk has room for the artifact and this many `bytes` (eg, 2GB) more", func(s string) (err error) {
+		minDiskFree, err = parseByteSize(s)
+		return err
+	})
+	flag.BoolVar(&keepTemp, "keep-temp", false, "leave the download in its temporary file, printing its path, rather than renaming it to the output (for debugging)")
+	flag.BoolVar(&outputIfChanged, "output-if-changed", false, "replace existing output files only if the artifact differs, keeping their mtime otherwise")
+	flag.BoolVar(&verifyOnly, "verify", false, "download the artifact(s) to check size and SHA-256, but write nothing")
+	flag.BoolVar(&rawDownload, "raw", false, "write artifacts served gzip-encoded as they are, rather than decoded")
+	flag.BoolVar(&noCompression, "no-compression", false, "don't ask for gzip-compressed responses (for debugging via proxies)")
+	flag.IntVar(&maxRetries, "retries", defaultRetries, "retry transient failures of idempotent requests this many times")
+	flag.BoolVar(&strictJSON, "strict-json", false, "fail if a build or artifact lacks a field cart reads, has it with another type, or has a field the API isn't known to send, to catch API drift")
+	flag.IntVar(&hostRetries.per, "host-retry-budget", 0, "retry the requests to each host this many times in all, or 0 for no limit beyond -retries")
+	flag.StringVar(&flagBackoff, "backoff", defaultBackoff, "how to wait between retries: fixed, exponential, or jitter (a random part of exponential)")
+	flag.DurationVar(&backoffBase, "backoff-base", defaultBackoffBase, "the wait before the first retry")
+	flag.DurationVar(&backoffCap, "backoff-cap", defaultBackoffCap, "the longest wait between retries")
+	flag.StringVar(&flagRetryStatus, "retry-status", defaultRetryStatus, "HTTP status `codes`, comma-separated, which are transient failures to retry")
 
-	flag.StringVar(&project, "repo", "", "github `username/repo`")
+	flag.StringVar(&project, "repo", "", "`username/repo` (at GitHub, unless -vcs)")
+	flag.StringVar(&vcsName, "vcs", "", "the project's VCS host: github or bitbucket (default as the git remote, else github)")
+	flag.StringVar(&repoRegex, "repo-regex", "", "extract username/repo from the git remote URL with this `regexp`, which has one capture group")
+	flag.StringVar(&host, "host", defaultHost, "CircleCI `URL` (scheme and hostname), for CircleCI server installs")
 	flag.IntVar(&buildNum, "build", 0, "get artifact for build number, ignoring branch")
-	flag.StringVar(&filter.branch, "branch", "master", "search builds for branch `name`")
+	flag.StringVar(&workflowURL, "workflow-url", "", "get artifact for the build of -job (or the only job) of the workflow at this CircleCI `URL`")
+	flag.StringVar(&fromURL, "from-url", "", "get artifact for the build (job) at this CircleCI `URL`, ignoring repo and branch")
+	flag.StringVar(&filter.branch, "branch", "master", "search builds for branch `name` (default: the branch checked out, or master)")
+	flag.StringVar(&filter.tag, "tag", "", "search builds for git tag `name`, instead of a branch")
+	flag.StringVar(&filter.branchGlob, "branch-glob", "", "search builds of branches matching `glob`, eg 'pr-*', instead of one branch")
 
 	// Workflows:
 	// If there are multiple workflows, then the latest "build" is perhaps unrelated to building,
@@ -166,24 +616,151 @@ func main() {
 	// "the latest build of that name, in any workflow matching this name",
 	// then use -ignore-later-workflows.
 
-	flag.StringVar(&filter.workflow, "workflow", "", "only consider builds which are part of this workflow")
+	flag.StringVar(&filter.workflow, "workflow", "", "only consider builds which are part of this workflow, or the first with a qualifying build of a comma-separated list")
 	flag.StringVar(&filter.workflow, "w", "", "(short for -workflow)")
+	flag.StringVar(&filter.workflowMatch, "workflow-match", "exact", "how -workflow matches workflow names: exact, prefix or regex")
+	flag.BoolVar(&filter.strictWorkflow, "strict-workflow", false, "fail if -workflow matches more than one workflow name")
 	flag.StringVar(&filter.jobname, "job", "", "look within workflow for artifacts from this build/step/job")
 	flag.StringVar(&filter.jobname, "j", "", "(short for -job)")
+	flag.Func("node", "only consider artifacts from these node `indexes`, eg 2, 2-5 or 0,2,4 (default any)", func(s string) (err error) {
+		artFilter.nodes, err = parseNodeSet(s)
+		return err
+	})
+	flag.StringVar(&artFilter.pathPrefix, "path-prefix", "", "only consider artifacts whose path starts with `prefix`")
+	flag.StringVar(&artFilter.pattern, "pattern", "", "only consider artifacts whose file name (basename) matches the `glob`")
+	flag.BoolVar(&artFilter.patternFull, "pattern-full", false, "match -pattern against the whole artifact path, not just the file name")
+	flag.IntVar(&minArtifacts, "min-artifacts", 0, "fail (exit 3) if the build has fewer than `N` matching artifacts")
+	flag.StringVar(&cacheDirFlag, "cache-dir", "", "keep on-disk caches under `dir` (default: cart in the user's cache directory)")
+	flag.BoolVar(&noRepoCache, "no-repo-cache", false, "ask git for the remote and branch every time, rather than cache them for the working directory")
+	flag.BoolVar(&clearCacheOnly, "clear-cache", false, "remove cart's on-disk caches, and exit")
+	flag.BoolVar(&useArtifactCache, "artifact-list-cache", false, "cache the build's artifact list on disk, for later invocations")
+	flag.DurationVar(&artifactCacheTTL, "artifact-list-cache-ttl", defaultArtifactCacheTTL, "how long a cached artifact list remains valid")
+	flag.BoolVar(&refresh, "refresh", false, "ignore cached data, fetching afresh")
+	flag.BoolVar(&workflowArtifacts, "workflow-artifacts", false, "consider the artifacts of all builds in the workflow of the build found")
 	flag.IntVar(&retrieveBuildsCount, "search-depth", defaultRetrieveCount, "how far back to search in build history")
+	flag.IntVar(&retrieveBuildsCount, "list-limit", defaultRetrieveCount, "same as -search-depth: how many builds to list (at most 100)")
+	flag.IntVar(&listOffset, "list-offset", 0, "skip this many of the most recent builds")
+	flag.StringVar(&listFilter, "list-filter", "successful", "server-side filter of the builds listed: completed, successful, failed, running, or none")
 	flag.BoolVar(&filter.anyFlowID, "ignore-later-workflows", false, "latest build of any matching workflow will do")
+	flag.BoolVar(&filter.latestOnly, "latest-only", false, "take the latest green build (of -job, if given), whatever workflow it's part of, overriding any -workflow")
+	flag.StringVar(&filter.sinceRev, "since-rev", "", "pick the first qualifying build after revision `sha` (approximate, see docs)")
+	flag.BoolVar(&prefetch, "prefetch", false, "fetch the artifact list of the likely build while still confirming it's the one")
+	flag.StringVar(&progressMode, "progress", progressAuto, "show the progress of downloads on stderr, by `mode`: always, never, or auto (on a terminal, but not in CI)")
+	flag.StringVar(&progressJSON, "progress-json", "", "report the progress of downloads as NDJSON events to `stream`: stdout, stderr or a file")
+	flag.DurationVar(&progressInterval, "progress-interval", defaultProgressInterval, "update progress at most this often")
+	flag.DurationVar(&stallTimeout, "stall-timeout", 0, "abandon (and retry) a download which receives no data for this `duration` (0 for no limit)")
+	flag.DurationVar(&resolveTimeout, "resolve-timeout", 0, "give up searching for the build after this `duration` (0 for no limit)")
+	flag.StringVar(&dumpBuilds, "dump-builds-json", "", "write the builds list seen to `file`, for bug reports")
+	flag.StringVar(&filter.triggeredBy, "triggered-by", "", "only consider builds triggered by this user `login`")
+	flag.Func("trigger-type", "only consider builds whose pipeline was triggered in one of these `ways`, eg webhook or webhook,scheduled_pipeline (looked up in API v2)", func(s string) (err error) {
+		filter.triggerTypes, err = parseTriggerTypes(s)
+		return err
+	})
+	flag.BoolVar(&skipPreflight, "skip-preflight", false, "don't check the token before -all, -last-n or -workflow-artifacts")
+	flag.BoolVar(&failFast, "fail-fast", false, "with -all, -last-n or -workflow-artifacts, stop at the first failure")
+	flag.BoolVar(&warnIfSuperseded, "warn-if-superseded", false, "warn if a newer green build of the same branch, workflow and job as -build exists")
+	flag.BoolVar(&failIfSuperseded, "fail-if-superseded", false, "fail if a newer green build of the same branch, workflow and job as -build exists")
+	flag.BoolVar(&useServerFilename, "use-server-filename", false, "without -o, name the download by the server's Content-Disposition filename, if any")
+	flag.BoolVar(&dedupe, "dedupe", false, "with -all or -pick, number artifacts which would be written to the same path (eg by -flatten), rather than fail")
+	flag.BoolVar(&allowMissing, "allow-missing", false, "with -all or -pick, skip artifacts which are gone (404) by the time they're downloaded, rather than fail")
+	flag.BoolVar(&lockOutput, "lock", false, "hold a lock on <output>.lock while downloading, so concurrent runs writing the same file take turns")
+	flag.DurationVar(&lockTimeout, "lock-timeout", defaultLockTimeout, "with -lock, give up waiting for another run's lock after this `duration` (0 to wait forever)")
+	flag.BoolVar(&keepGoing, "keep-going", false, "with -all, -last-n or -workflow-artifacts, attempt everything, and report failures at the end")
+	flag.IntVar(&filter.lastN, "last-n", 0, "download <artifact> from each of the last `n` matching builds, to -o with {build} in it")
+	flag.BoolVar(&filter.failOnMultiple, "fail-on-multiple", false, "fail unless exactly one build in the search depth qualifies")
+	flag.BoolVar(&filter.requireArtifact, "require-artifact", false, "only pick a build which has <artifact>, or with -all or -pick any artifact passing the filters, looking at each candidate within -search-depth")
+	flag.BoolVar(&filter.includeRunning, "include-running", false, "also consider running builds which already have the artifact")
 
+	flag.CommandLine.SetOutput(output.Err)
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <artifact>\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(output.Err, "Usage: %s [flags] <artifact>\n\n", filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
+	removeTempsOnSignal()
+	jsonFatal = jsonOutput
+
+	if clearCacheOnly {
+		if len(flag.Args()) > 0 {
+			flag.Usage()
+			fatal("-clear-cache takes no <artifact>")
+		}
+		dir := cacheDir()
+		if err := clearCache(dir); err != nil {
+			fatal(err)
+		}
+		fmt.Fprintln(output.Err, "Cleared cache:", dir)
+		return
+	}
 
 	// TODO: should we support multiple downloads in one invocation?
 	if len(flag.Args()) > 1 {
 		flag.Usage()
-		log.Fatal("stray unparsed parameters left in command-line")
+		fatal("stray unparsed parameters left in command-line")
+	}
+
+	if noCompression {
+		httpClient = newHTTPClient(noCompression)
+	}
+	showProgress, plainProgress = progressStyle(progressMode, progressTerminal(), inCI(os.Getenv))
+	if resolveOnly || artifactCount || rawBuild || probeAll || (tarMode && outputPath == "-") {
+		diag = output.Err
+	}
+	switch {
+	case failFast && keepGoing:
+		flag.Usage()
+		fatal("-fail-fast and -keep-going are exclusive")
+	case failFast:
+		batchPolicy = policyFailFast
+	case keepGoing:
+		batchPolicy = policyKeepGoing
+	}
+	// Failures which a batch kept going past still fail, once it's done.
+	defer func() {
+		verboseln("Requests made:", apiCalls)
+		if batchFailed {
+			os.Exit(1)
+		}
+	}()
+	if jsonOutput && !flagOutcomes {
+		// The decision is the JSON output of a search for builds, and
+		// the results that of downloads.
+		decisions = &decisionLog{}
+		results = &resultLog{}
+		diag = output.Err
+	}
+	if env := os.Getenv(extraHeadersEnv); env != "" {
+		var err error
+		if extraHeaders, err = parseExtraHeaders(env); err != nil {
+			fatal(err)
+		}
+	}
+	codes, err := parseRetryStatus(flagRetryStatus)
+	if err != nil {
+		flag.Usage()
+		fatal(err)
+	}
+	retryStatus = codes
+	if retryBackoff, err = newBackoff(flagBackoff, backoffBase, backoffCap); err != nil {
+		flag.Usage()
+		fatal(err)
+	}
+	trustedHosts = defaultTrustedHosts(host)
+	if flagTrustedHosts != "" {
+		hosts, err := parseTrustedHosts(flagTrustedHosts)
+		if err != nil {
+			flag.Usage()
+			fatal(err)
+		}
+		trustedHosts = append(trustedHosts, hosts...)
+	}
+	if flagAuthSchemes != "" {
+		var err error
+		if authSchemes, err = parseAuthSchemes(flagAuthSchemes); err != nil {
+			flag.Usage()
+			fatal(err)
+		}
 	}
 
 	if flagVerbose {
@@ -191,127 +768,1077 @@ func main() {
 		if t := os.Getenv("VERBOSITY"); t != "" {
 			var err error
 			if verbosity, err = strconv.Atoi(t); err != nil {
-				log.Fatalf("parse $VERBOSITY %q: %s", t, err)
+				fatalf("parse $VERBOSITY %q: %s", t, err)
+			}
+		}
+	}
+
+	if filter.tag != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "branch" {
+				fatal("-tag and -branch are exclusive: tag builds are not on a branch")
+			}
+		})
+		filter.branch = ""
+	}
+	if filter.branchGlob != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "branch" || f.Name == "tag" {
+				fatalf("-branch-glob and -%s are exclusive", f.Name)
 			}
+		})
+		if _, err := path.Match(filter.branchGlob, ""); err != nil {
+			flag.Usage()
+			fatalf("bad -branch-glob: %q", filter.branchGlob)
+		}
+		filter.branch = ""
+	}
+
+	vcsSource := flagSource(flag.CommandLine, "vcs")
+	if vcsName == "gitlab" {
+		fatal("-vcs gitlab: CircleCI addresses GitLab projects as circleci/<org-id>/<project-id>, which API v1.1, and so cart, can't reach")
+	}
+	if vcsName != "" {
+		if provider = providerNamed(vcsName); provider == nil {
+			flag.Usage()
+			fatalf("bad -vcs %q: want github or bitbucket", vcsName)
+		}
+	}
+	projectSource := flagSource(flag.CommandLine, "repo")
+	branchFromGit := false
+	if fromURL != "" {
+		projectSource = "-from-url"
+		var err error
+		if project, buildNum, err = parseCircleURL(fromURL); err != nil {
+			fatal(err)
+		}
+		if provider == nil {
+			provider, vcsSource = urlProvider(fromURL), "-from-url"
+		}
+	}
+	if workflowURL != "" {
+		projectSource = "-workflow-url"
+		var err error
+		if project, workflowID, err = parseWorkflowURL(workflowURL); err != nil {
+			fatal(err)
+		}
+		if provider == nil {
+			provider, vcsSource = urlProvider(workflowURL), "-workflow-url"
 		}
 	}
 
+	repoRe, err := compileRepoRegex(repoRegex)
+	if err != nil {
+		flag.Usage()
+		fatal(err)
+	}
 	if project == "" {
-		out, err := exec.Command("git", "remote", "get-url", "origin").Output()
+		projectSource = "git remote"
+		var out string
+		wd, err := os.Getwd()
+		useRepoCache := !noRepoCache && err == nil
+		repos := repoCache{dir: filepath.Join(cacheDir(), "repos")}
+		if useRepoCache {
+			out, err = repos.remoteURL(wd, gitTimeout)
+		} else {
+			out, err = gitRemoteURL(gitTimeout)
+		}
 		if err != nil {
-			log.Fatalf("exec git: %s", err)
+			fatal(err)
+		}
+		if repoRe != nil {
+			project = gitProjectMatching(repoRe, out)
+		} else {
+			project = gitProject(out)
+		}
+		if p, _ := detectProvider(out); provider == nil && p != nil {
+			provider, vcsSource = p, "git remote"
+		}
+		// In a checkout of the project, search its branch, not master.
+		if flagSource(flag.CommandLine, "branch", "tag", "branch-glob") == "default" {
+			branch := gitBranch
+			if useRepoCache {
+				branch = func(timeout time.Duration) (string, error) { return repos.branch(wd, timeout) }
+			}
+			if b, err := branch(gitTimeout); err == nil {
+				filter.branch, branchFromGit = b, true
+			} else if verbosity > 0 {
+				fmt.Fprintf(diag, "Using branch %s: %s\n", filter.branch, err)
+			}
 		}
-		project = gitProject(string(out))
 	}
 
 	artifactName := flag.Arg(0)
-	if circleToken == "" {
-		circleToken = os.Getenv("CIRCLE_TOKEN")
+	if printURLFor != "" {
+		if artifactName != "" && artifactName != printURLFor {
+			flag.Usage()
+			fatal("-print-url-for and <artifact> disagree")
+		}
+		artifactName = printURLFor
+	}
+	if probe != "" {
+		if artifactName != "" && artifactName != probe {
+			flag.Usage()
+			fatal("-probe and <artifact> disagree")
+		}
+		artifactName = probe
+	}
+	tokenFrom := tokenSource(circleToken)
+	circleToken = loadToken(circleToken)
+
+	urlOpts := URLOptions{
+		Host:     host,
+		Project:  project,
+		Branch:   filter.branch,
+		BuildNum: buildNum,
+		Limit:    retrieveBuildsCount,
+		Offset:   listOffset,
+		Filter:   listFilter,
+		Provider: provider,
+	}
+	if listFilter == "none" {
+		urlOpts.Filter = ""
+	}
+	if filter.includeRunning {
+		// the server-side filter would hide the running builds, unless asked
+		// for specifically
+		flagSet := false
+		flag.Visit(func(f *flag.Flag) { flagSet = flagSet || f.Name == "list-filter" })
+		if !flagSet {
+			urlOpts.Filter = ""
+		}
 	}
 
-	// for URL expansion with sane named parameters, and put in everything
-	// we might want too, including filters, in case there are better
-	// URLs we can switch to in future.
-	expansions := Expander{
-		"project":        project,
-		"artifact":       artifactName,
-		"retrieve_count": strconv.Itoa(retrieveBuildsCount),
-		"build_num":      strconv.Itoa(buildNum),
-		"circle_token":   circleToken,
-		"branch":         filter.branch,
-		"workflow":       filter.workflow,
-		"jobname":        filter.jobname,
+	if showConfig {
+		settings := configSettings(flag.CommandLine, configState{
+			project:       project,
+			projectSource: projectSource,
+			vcsSource:     vcsSource,
+			opts:          urlOpts,
+			filter:        filter,
+			listFilter:    listFilter,
+			fromURL:       fromURL,
+			branchFromGit: branchFromGit,
+			verbose:       flagVerbose,
+			tokenFrom:     tokenFrom,
+			artifactName:  artifactName,
+			outputPath:    outputPath,
+		})
+		if err := writeConfig(output.Out, settings, jsonOutput); err != nil {
+			fatal(err)
+		}
+		return
 	}
 
+	plan := planRequests(planOptions{
+		preflight:         !skipPreflight && (flagAll || filter.lastN > 0 || (workflowArtifacts && buildNum == 0)),
+		pinned:            buildNum > 0 || workflowID != "",
+		workflowURL:       workflowID != "",
+		superseded:        warnIfSuperseded || failIfSuperseded,
+		searchDepth:       retrieveBuildsCount,
+		includeRunning:    filter.includeRunning,
+		requireArtifact:   filter.requireArtifact,
+		triggerTypes:      len(filter.triggerTypes) > 0,
+		lastN:             filter.lastN,
+		all:               flagAll || pick,
+		workflowArtifacts: workflowArtifacts,
+		probeEach:         (flagAll || pick) && downloadOrder == orderSize,
+		probeOne:          useServerFilename,
+		nodes:             len(artFilter.nodes),
+	})
+	// Only downloads are planned; the modes which print don't need it.
+	showPlan := dryRun && !(flagListArtifacts || resolveOnly || artifactCount || rawBuild || probeAll || probe != "" || printURLFor != "")
+	lastNTmpl, lastNErr := lastNOutputTemplate(outputPath, artifactName)
+	compareA, compareB, compareErr := parseCompare(compareSpec)
+	listQueryErr := checkListQuery(urlOpts)
 	switch {
 	case project == "":
 		flag.Usage()
-		log.Fatal("no <username>/<project> provided")
-	case filter.branch == "":
+		fatal("no <username>/<project> provided")
+	case filter.branch == "" && filter.tag == "" && filter.branchGlob == "":
+		flag.Usage()
+		fatal("no <branch> provided")
+	case tarMode && (!flagAll && !pick || outputPath == ""):
+		flag.Usage()
+		fatal("-tar writes the artifacts of -all or -pick to the archive named by -o, or - for stdout")
+	case tarMode && (verifyOnly || outputIfChanged || (jsonOutput && outputPath == "-")):
 		flag.Usage()
-		log.Fatal("no <branch> provided")
-	case artifactName == "" && !flagListArtifacts:
+		fatal("-tar writes an archive, so not with -verify or -output-if-changed, nor -json when it's to stdout")
+	case flagAll && (artifactName != "" || (outputPath != "" && !tarMode)):
 		flag.Usage()
-		log.Fatal("no <artifact> provided")
+		fatal("-all downloads all artifacts into -output-dir; narrow them with filters such as -pattern, not <artifact> or -o")
+	case pick && (flagAll || artifactName != "" || (outputPath != "" && !tarMode) || flagListArtifacts || filter.lastN > 0):
+		flag.Usage()
+		fatal("-pick downloads the artifacts picked into -output-dir, so not with <artifact>, -o, -all, -list-artifacts or -last-n")
+	case compareSpec != "" && (artifactName != "" || buildNum > 0 || workflowURL != "" || flagAll || pick || flagListArtifacts ||
+		filter.lastN > 0 || resolveOnly || artifactCount || rawBuild || probeAll || flagOutcomes):
+		flag.Usage()
+		fatal("-compare names the builds it compares, so works alone")
+	case artifactName == "" && !flagListArtifacts && !flagOutcomes && !flagAll && !pick && !resolveOnly && !artifactCount && !rawBuild && !probeAll && compareSpec == "":
+		flag.Usage()
+		fatal("no <artifact> provided")
 	case circleToken == "":
 		// This one is common enough that showing usage obscures the actual issue,
 		// because ~everyone should be passing the value in through environ, so
 		// there's unlikely to be a problem with parameters, only with loading
 		// sensitive data into environ.  So we skip flag.Usage()
-		log.Fatal("no auth token set: use $CIRCLE_TOKEN or flag -token (try -help)")
+		fatal("no auth token set: use $CIRCLE_TOKEN or flag -token (try -help)")
+	case checkHost(host) != nil:
+		flag.Usage()
+		fatal(checkHost(host))
 	case retrieveBuildsCount < 1:
 		flag.Usage()
-		log.Fatal("workflow depth must be a positive (smallish) integer")
+		fatal("workflow depth must be a positive (smallish) integer")
+	case listQueryErr != nil:
+		flag.Usage()
+		fatal(listQueryErr)
+	case filter.sinceRev != "" && len(filter.sinceRev) < 7:
+		flag.Usage()
+		fatal("-since-rev needs at least 7 characters of the revision")
+	case filter.compileWorkflowMatch() != nil:
+		flag.Usage()
+		fatal(filter.compileWorkflowMatch())
+	case !validProgressMode(progressMode):
+		flag.Usage()
+		fatalf("bad -progress %q: want always, auto or never", progressMode)
+	case progressJSON == "stdout" && (outputPath == "-" || jsonOutput):
+		flag.Usage()
+		fatal("-progress-json stdout would mix with the output; use stderr or a file")
+	case (showProgress || progressJSON != "") && progressInterval <= 0:
+		flag.Usage()
+		fatal("-progress-interval must be positive")
+	case bufferSize < 1:
+		flag.Usage()
+		fatal("-buffer-size must be positive")
+	case (warnIfSuperseded || failIfSuperseded) && (buildNum == 0 || workflowArtifacts):
+		flag.Usage()
+		fatal("-warn-if-superseded and -fail-if-superseded check a build pinned with -build or -from-url")
+	case useServerFilename && (artifactName == "" || outputPath != "" || flagAll || pick || filter.lastN > 0 || casDir != "" || len(artFilter.nodes) > 1):
+		flag.Usage()
+		fatal("-use-server-filename names the one <artifact> downloaded without -o, so not with -o, -all, -pick, -last-n, -cas-dir or several -node")
+	case filter.latestOnly && (filter.anyFlowID || filter.sinceRev != "" || filter.lastN > 0 || filter.failOnMultiple):
+		flag.Usage()
+		fatal("-latest-only takes the one latest build, whatever its workflow, so not with -ignore-later-workflows, -since-rev, -last-n or -fail-on-multiple")
+	case len(filter.triggerTypes) > 0 && (buildNum > 0 || workflowURL != ""):
+		flag.Usage()
+		fatal("-trigger-type filters the builds searched, so not with -build, -from-url or -workflow-url")
+	case filter.requireArtifact && (buildNum > 0 || workflowURL != "" || (artifactName == "" && !flagAll && !pick)):
+		flag.Usage()
+		fatal("-require-artifact searches for a build with <artifact>, or with -all or -pick any artifact, so not with -build, -from-url or -workflow-url")
+	case dedupe && !flagAll && !pick:
+		flag.Usage()
+		fatal("-dedupe only modifies -all or -pick")
+	case allowMissing && !flagAll && !pick:
+		flag.Usage()
+		fatal("-allow-missing only modifies -all or -pick")
+	case lockOutput && (flagAll || pick || tarMode || filter.lastN > 0 || outputPath == "-" ||
+		casDir != "" || keepTemp || verifyOnly || flagListArtifacts || resolveOnly || artifactCount ||
+		rawBuild || probeAll || probe != "" || printURLFor != ""):
+		flag.Usage()
+		fatal("-lock only applies to downloading a single artifact to a file, so not with -cas-dir, -keep-temp, -verify or the modes which print")
+	case !validDownloadOrder(downloadOrder):
+		flag.Usage()
+		fatalf("bad -download-order %q: want api, name, size or as-listed", downloadOrder)
+	case flagSource(flag.CommandLine, "download-order") != "default" && !flagAll && !pick:
+		flag.Usage()
+		fatal("-download-order orders the downloads of -all or -pick")
+	case sortBy != "" && !validSortKey(sortBy):
+		flag.Usage()
+		fatalf("bad -sort %q: want path, node or size", sortBy)
+	case casDir != "" && (flagAll || pick || filter.lastN > 0 || outputPath != "" || outputIfChanged):
+		flag.Usage()
+		fatal("-cas-dir stores the one <artifact> by content, so not with -all, -last-n, -o or -output-if-changed")
+	case keepTemp && (flagAll || pick || filter.lastN > 0 || casDir != "" || outputIfChanged):
+		flag.Usage()
+		fatal("-keep-temp keeps the download of the one <artifact>, so not with -all, -last-n, -cas-dir or -output-if-changed")
+	case !validMarkerOn(markerOn):
+		flag.Usage()
+		fatalf("bad -marker-on %q: want build or rev", markerOn)
+	case markerPath != "" && (buildNum > 0 || workflowURL != "" || filter.lastN > 0 || resolveOnly || rawBuild || artifactCount ||
+		flagListArtifacts || verifyOnly || probe != "" || printURLFor != ""):
+		flag.Usage()
+		fatal("-since-marker records the build searched for and downloaded from, so not with -build, -from-url, -workflow-url, -last-n or modes which only print")
+	case failOnEmpty && (artifactName == "" || flagAll || pick || filter.lastN > 0 || casDir != "" || keepTemp || outputIfChanged || verifyOnly):
+		flag.Usage()
+		fatal("-fail-on-empty checks the one <artifact> downloaded, so not with -all, -last-n, -cas-dir, -keep-temp, -output-if-changed or -verify")
+	case len(artFilter.nodes) > 1 && artifactName != "" && (probe != "" || printURLFor != "" || verifyOnly ||
+		casDir != "" || keepTemp || outputIfChanged || failOnEmpty || filter.lastN > 0):
+		flag.Usage()
+		fatal("-node with several nodes downloads <artifact> from each, so not with -probe, -print-url-for, -verify, -cas-dir, -keep-temp, -output-if-changed, -fail-on-empty or -last-n")
+	case probeAll && (artifactName != "" || flagAll || pick || flagListArtifacts || filter.lastN > 0 || artifactCount):
+		flag.Usage()
+		fatal("-probe-all sizes up the artifacts which pass the filters, so not with <artifact>, -all, -pick, -list-artifacts, -last-n or -artifact-count")
+	case flagLong && !flagListArtifacts:
+		flag.Usage()
+		fatal("-long only modifies -list-artifacts")
+	case compareSizes && compareSpec == "":
+		flag.Usage()
+		fatal("-sizes only modifies -compare")
+	case flagStat && (!flagListArtifacts || groupByNode || urlsOnly || asCommands):
+		flag.Usage()
+		fatal("-stat only modifies -list-artifacts, and not with -group-by-node, -urls-only or -as-commands")
+	case groupByNode && (!flagListArtifacts || asCommands):
+		flag.Usage()
+		fatal("-group-by-node only modifies -list-artifacts, and not with -as-commands")
+	case urlsOnly && (!flagListArtifacts || flagLong || asCommands || groupByNode):
+		flag.Usage()
+		fatal("-urls-only only modifies -list-artifacts, and not with -long, -as-commands or -group-by-node")
+	case asCommands && (!flagListArtifacts || flagLong):
+		flag.Usage()
+		fatal("-as-commands only modifies -list-artifacts, and not with -long")
+	case minArtifacts < 0:
+		flag.Usage()
+		fatal("-min-artifacts must not be negative")
+	case !validPattern(artFilter.pattern):
+		flag.Usage()
+		fatalf("bad -pattern glob: %q", artFilter.pattern)
+	case workflowURL != "" && (fromURL != "" || buildNum > 0 || filter.lastN > 0 || workflowArtifacts):
+		flag.Usage()
+		fatal("-workflow-url names the build, so not with -from-url, -build, -last-n or -workflow-artifacts")
+	case filter.lastN < 0:
+		flag.Usage()
+		fatal("-last-n must not be negative")
+	case filter.lastN > 0 && (artifactName == "" || buildNum > 0 || flagAll || workflowArtifacts ||
+		filter.sinceRev != "" || filter.failOnMultiple || printURLFor != "" || probe != "" ||
+		resolveOnly || artifactCount || flagListArtifacts):
+		flag.Usage()
+		fatal("-last-n downloads <artifact> from several builds which it searches for, so works alone")
+	case buildNum > 0 && workflowArtifacts:
+		flag.Usage()
+		fatal("-workflow-artifacts needs to search for the build, not -build or -from-url")
+	case filter.lastN > 0 && lastNErr != nil:
+		flag.Usage()
+		fatal(lastNErr)
+	case compareSpec != "" && compareErr != nil:
+		flag.Usage()
+		fatal(compareErr)
+	}
+
+	// Opened only once the flags are known good, so as not to leave an
+	// empty stream behind a usage error.
+	if progressJSON != "" {
+		w, err := openProgressJSON(progressJSON)
+		if err != nil {
+			fatal(err)
+		}
+		progressJSONOut = w
+		// Deferred after the batch's exit, so as to run before it.
+		defer func() {
+			if err := w.Close(); err != nil {
+				fatal(err)
+			}
+		}()
+	}
+	switch {
+	case flagOutcomes:
+		// Tally all recent builds, rather than looking for one.
+		urlOpts.Filter = ""
+		builds, err := fetchBuilds(context.Background(), urlOpts)
+		if err != nil {
+			fatal(err)
+		}
+		if err := writeOutcomes(output.Out, filter.branch, builds, jsonOutput); err != nil {
+			fatal(err)
+		}
+		return
+	case filter.lastN > 0:
+		if showPlan {
+			fmt.Fprintln(diag, "Planned:", plan)
+		}
+		if !skipPreflight {
+			if err := preflight(urlOpts); err != nil {
+				fatal(err)
+			}
+		}
+		picked, _, err := circleFindBuilds(urlOpts, filter, artifactName)
+		if decisions != nil {
+			if err := writeDecision(output.Out, decisions); err != nil {
+				fatal(err)
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+		err = downloadLastN(urlOpts, picked, artifactName, lastNTmpl)
+		if results != nil {
+			if err := writeResults(output.Out, results, true); err != nil {
+				fatal(err)
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+		return
+	case compareSpec != "":
+		var sizeOf func(artifact) int64
+		if compareSizes {
+			sizeOf = artifactSize
+		}
+		changes, err := compareBuilds(context.Background(), urlOpts, compareA, compareB, artFilter, sizeOf)
+		if err != nil {
+			fatal(err)
+		}
+		if err := writeChanges(output.Out, changes); err != nil {
+			fatal(err)
+		}
+		return
+	case workflowID != "":
+		if showPlan {
+			fmt.Fprintln(diag, "Planned:", plan)
+		}
+		n, err := resolveWorkflowURL(context.Background(), urlOpts, workflowID, filter.jobname)
+		if err != nil {
+			fatal(err)
+		}
+		buildNum = n
+		urlOpts.BuildNum = buildNum
+		fmt.Fprintf(diag, "Build: %d (of workflow %s)\n", buildNum, workflowID)
+		if flagAll && !skipPreflight {
+			if err := preflight(urlOpts); err != nil {
+				fatal(err)
+			}
+		}
 	case buildNum > 0:
 		// Don't look for a green build.
-		fmt.Printf("Build: %d\n", buildNum)
+		if showPlan {
+			fmt.Fprintln(diag, "Planned:", plan)
+		}
+		fmt.Fprintf(diag, "Build: %d\n", buildNum)
+		if warnIfSuperseded || failIfSuperseded {
+			if err := checkSuperseded(context.Background(), urlOpts); err != nil && failIfSuperseded {
+				fatal(err)
+			} else if err != nil {
+				log.Print("warning: ", err)
+			}
+		}
+		if flagAll && !skipPreflight {
+			if err := preflight(urlOpts); err != nil {
+				fatal(err)
+			}
+		}
 	default:
-		buildNum = circleFindBuild(expansions, filter)
-		expansions["build_num"] = strconv.Itoa(buildNum)
+		if showPlan {
+			fmt.Fprintln(diag, "Planned:", plan)
+		}
+		if (flagAll || workflowArtifacts) && !skipPreflight {
+			if err := preflight(urlOpts); err != nil {
+				fatal(err)
+			}
+		}
+		var (
+			builds []build
+			err    error
+		)
+		found, builds, err = circleFindBuild(urlOpts, filter, artifactName)
+		if decisions != nil {
+			if err := writeDecision(output.Out, decisions); err != nil {
+				fatal(err)
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+		buildNum = found.BuildNum
+		urlOpts.BuildNum = buildNum
+		if workflowArtifacts {
+			if found.Workflows == nil {
+				fatalf("-workflow-artifacts: build %d is not part of a workflow", buildNum)
+			}
+			workflowBuilds = sameWorkflow(builds, found.Workflows.WorkflowID, filter)
+		}
 	}
 
-	// Get artifact from buildNum
-	u := expansions.ExpandURL(artifactsURL)
-	verboseln("Artifact list:", censorURL(u))
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		log.Fatal(err)
+	if resolveOnly {
+		if err := writeResolved(output.Out, buildNum); err != nil {
+			fatal(err)
+		}
+		return
 	}
-	req.Header.Set("Accept", "application/json")
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Fatal(err)
+	if rawBuild {
+		body, err := fetchRawBuild(context.Background(), urlOpts)
+		if err != nil {
+			fatal(err)
+		}
+		if err := writeRawBuild(output.Out, body); err != nil {
+			fatal(err)
+		}
+		return
 	}
-	defer res.Body.Close()
-	var artifacts []artifact
-	if err := json.NewDecoder(res.Body).Decode(&artifacts); err != nil {
-		log.Fatal(err)
+	if results != nil {
+		results.buildNum = buildNum
+	}
+	if markerPath != "" {
+		m, ok, err := readMarker(markerPath)
+		if err != nil {
+			fatal(err)
+		}
+		if ok && !m.isNew(found, markerOn) {
+			fmt.Fprintf(diag, "No new build: %d (%s) is not new since %d (%s)\n", found.BuildNum, found.Revision, m.BuildNum, m.Revision)
+			return
+		}
+		if !dryRun {
+			// Failures exit by fatal, which skips this; a batch which
+			// kept going past failures leaves it to markDone.
+			defer func() {
+				if err := markDone(markerPath, found); err != nil {
+					fatal(err)
+				}
+			}()
+		}
 	}
 
-	if flagListArtifacts {
+	// Get artifact from buildNum
+	var (
+		artifacts []artifact
+		cached    bool
+	)
+	cache := artifactCache{dir: filepath.Join(cacheDir(), "artifacts"), ttl: artifactCacheTTL, now: time.Now}
+	if useArtifactCache && !refresh && !workflowArtifacts {
+		artifacts, cached = cache.get(urlOpts)
+		verboseln("Artifact list cached:", cached)
+	}
+	switch {
+	case workflowArtifacts:
+		var err error
+		if artifacts, err = fetchWorkflowArtifacts(context.Background(), urlOpts, workflowBuilds); err != nil {
+			if batchPolicy != policyKeepGoing {
+				fatal(err)
+			}
+			// carry on with the artifacts of the other builds
+			log.Print(err)
+			batchFailed = true
+		}
+	case !cached:
+		var (
+			err error
+			ok  bool
+		)
+		if artifacts, ok = prefetched.take(buildNum); ok {
+			verboseln("Artifact list prefetched:", buildNum)
+		} else if artifacts, err = fetchBuildArtifacts(context.Background(), urlOpts); err != nil {
+			fatal(err)
+		}
+		if useArtifactCache {
+			if err := cache.put(urlOpts, artifacts); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	if missing := missingNodes(artifacts, artFilter.nodes); len(missing) > 0 {
+		log.Printf("warning: -node: build %d has no artifacts from node %s (beyond its parallelism?)", buildNum, nodeSet(missing))
+	}
+	artifacts = filterArtifacts(artifacts, artFilter)
+	if err := checkMinArtifacts(artifacts, minArtifacts); err != nil {
+		fatalCode(exitTooFewArtifacts, err.Error())
+	}
+	if artifactCount {
+		if err := writeArtifactCount(output.Out, artifacts); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if probeAll {
+		s := probeSizes(artifacts, artifactSize, probeConcurrency)
+		if err := writeSizeSummary(output.Out, s, jsonOutput); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if len(artifacts) == 0 && artFilter.active() {
+		fatal("no artifacts match the given filters")
+	}
+
+	if flagListArtifacts && urlsOnly {
+		listed := artifacts
+		if sortBy != "" {
+			listed = append([]artifact(nil), artifacts...)
+			sortArtifacts(listed, sortBy, artifactSize)
+		}
+		if withToken {
+			log.Print("warning: the URLs printed include your CircleCI token, for trusted hosts")
+		}
+		if err := writeArtifactURLs(output.Out, listed, withToken); err != nil {
+			fatal(err)
+		}
+	} else if flagListArtifacts && asCommands {
 		for i := range artifacts {
-			fmt.Printf("[%d] node_index %d: path %q URL %q\n",
-				i, artifacts[i].NodeIndex, artifacts[i].Path, artifacts[i].URL)
+			if artifacts[i].build == nil {
+				artifacts[i].build = &build{BuildNum: buildNum}
+			}
+		}
+		listed := artifacts
+		if sortBy != "" {
+			listed = append([]artifact(nil), artifacts...)
+			sortArtifacts(listed, sortBy, artifactSize)
+		}
+		writeArtifactCommands(output.Out, listed, urlOpts)
+	} else if flagListArtifacts && flagStat {
+		var sizeOf func(artifact) int64
+		if flagLong {
+			sizeOf = artifactSize
+		}
+		if err := writeStats(output.Out, statArtifacts(artifacts, sizeOf), flagLong); err != nil {
+			fatal(err)
+		}
+	} else if flagListArtifacts {
+		if flagLong && !workflowArtifacts {
+			// Those of a workflow know their builds already.
+			if found.BuildNum == 0 {
+				var err error
+				if found, err = fetchBuild(context.Background(), urlOpts); err != nil {
+					fatal(err)
+				}
+			}
+			for i := range artifacts {
+				artifacts[i].build = &found
+			}
+		}
+		listed := artifacts
+		if sortBy != "" {
+			listed = append([]artifact(nil), artifacts...)
+			sortArtifacts(listed, sortBy, artifactSize)
+		}
+		if groupByNode {
+			writeArtifactGroups(output.Out, listed, flagLong)
+		} else {
+			writeArtifactList(output.Out, listed, flagLong)
 		}
 	}
+	listedByAPI := artifacts
+	if pick {
+		writeArtifactList(output.Err, artifacts, false)
+		picked, err := readPicks(os.Stdin, artifacts)
+		if err != nil {
+			fatal(err)
+		}
+		if len(picked) == 0 {
+			fmt.Fprintln(output.Err, "Nothing picked")
+			return
+		}
+		artifacts, flagAll = picked, true
+	}
+	if flagAll {
+		dir := outputDir
+		if tarMode {
+			dir = "." // named within the archive as they would be in a directory
+		}
+		orderDownloads(artifacts, listedByAPI, downloadOrder, artifactSize)
+		plan, err := planDownloads(artifacts, dir, flatten)
+		if err != nil {
+			fatal(err)
+		}
+		if tarMode {
+			err = saveTar(outputPath, plan)
+		} else {
+			err = downloadAll(plan)
+		}
+		if results != nil && !verifyOnly {
+			if err := writeResults(output.Out, results, true); err != nil {
+				fatal(err)
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
 	if artifactName == "" {
 		return
 	}
+	if len(artFilter.nodes) > 1 {
+		tmpl, err := nodeOutputTemplate(outputPath, artifactName)
+		if err != nil {
+			flag.Usage()
+			fatal(err)
+		}
+		err = downloadNodes(artifacts, artifactName, tmpl)
+		if results != nil {
+			if err := writeResults(output.Out, results, true); err != nil {
+				fatal(err)
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
 
+	if probe != "" {
+		a, ok := findArtifact(artifacts, artifactName)
+		if !ok {
+			fatalf("unable to find artifact: %s", artifactName)
+		}
+		p, err := probeArtifact(context.Background(), a)
+		if err != nil {
+			fatal(err)
+		}
+		writeProbe(output.Out, p)
+		return
+	}
+	if printURLFor != "" {
+		a, ok := findArtifact(artifacts, artifactName)
+		if !ok {
+			fatalf("unable to find artifact: %s", artifactName)
+		}
+		u, err := artifactURL(a, withToken)
+		if err != nil {
+			fatal(err)
+		}
+		if withToken {
+			if h := urlHostname(u); trusted(h) {
+				log.Print("warning: the URL printed includes your CircleCI token")
+			} else {
+				log.Printf("warning: not adding the token for untrusted host %s (see -trusted-host)", h)
+			}
+		}
+		fmt.Fprintln(output.Out, u)
+		return
+	}
+
+	if verifyOnly {
+		a, ok := findArtifact(artifacts, artifactName)
+		if !ok {
+			fatalf("unable to find artifact: %s", artifactName)
+		}
+		n, sum, err := verifyArtifact(a, artifactName)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Fprintf(output.Out, "Verified %s (%d bytes, sha256 %s)\n", artifactName, n, sum)
+		return
+	}
 	if outputPath == "" {
 		outputPath = filepath.Base(artifactName)
+		if useServerFilename {
+			outputPath = serverOutputPath(artifacts, artifactName, outputPath)
+		}
+	}
+	if lockOutput && !dryRun {
+		release, err := acquireLock(outputPath, lockTimeout)
+		if err != nil {
+			fatal(err)
+		}
+		defer release()
 	}
+	if casDir != "" && !dryRun {
+		a, ok := findArtifact(artifacts, artifactName)
+		if !ok {
+			fatalf("unable to find artifact: %s", artifactName)
+		}
+		e, stored, err := saveArtifactCAS(casDir, a, artifactName, buildNum)
+		if err != nil {
+			fatal(err)
+		}
+		object := casObjectPath(casDir, e.SHA256)
+		if stored {
+			fmt.Fprintf(diag, "Stored %s (%d bytes) at %s\n", artifactName, e.Size, object)
+		} else {
+			fmt.Fprintf(diag, "Already stored %s (%d bytes) at %s\n", artifactName, e.Size, object)
+		}
+		return
+	}
+	if keepTemp && !dryRun {
+		a, ok := findArtifact(artifacts, artifactName)
+		if !ok {
+			fatalf("unable to find artifact: %s", artifactName)
+		}
+		if err := saveArtifactKeepTemp(output.Out, a, artifactName, outputPath); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if outputIfChanged && !dryRun {
+		a, ok := findArtifact(artifacts, artifactName)
+		if !ok {
+			fatalf("unable to find artifact: %s", artifactName)
+		}
+		start := time.Now()
+		n, changed, err := saveArtifactIfChanged(a, artifactName, outputPath)
+		if results != nil {
+			results.record(a, artifactName, outputPath, 0, start, n, changed, err)
+			if err := writeResults(output.Out, results, false); err != nil {
+				fatal(err)
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if !changed {
+			fmt.Fprintf(diag, "Unchanged %s (%d bytes) at %s\n", artifactName, n, outputPath)
+		} else {
+			fmt.Fprintf(diag, "Wrote %s (%d bytes) to %s\n", artifactName, n, outputPath)
+		}
+		return
+	}
+	start := time.Now()
 	n, err := downloadArtifact(artifacts, artifactName, outputPath)
+	if err == nil && failOnEmpty {
+		err = rejectEmpty(artifactName, outputPath, n)
+	}
+	if results != nil {
+		a, _ := findArtifact(artifacts, artifactName)
+		results.record(a, artifactName, outputPath, 0, start, n, true, err)
+		if err := writeResults(output.Out, results, false); err != nil {
+			fatal(err)
+		}
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-	fmt.Printf("Wrote %s (%d bytes) to %s\n", artifactName, n, outputPath)
+	fmt.Fprintf(diag, "Wrote %s (%d bytes) to %s\n", artifactName, n, outputPath)
 }
 
-func circleFindBuild(expansions Expander, filter FilterSet) (buildNum int) {
-	u := expansions.ExpandURL(buildListURL)
-	verboseln("Build list:", censorURL(u))
-	req, err := http.NewRequest("GET", u, nil)
+// circleFindBuild returns the build matching filter, and the list of recent
+// builds from which it was picked.
+func circleFindBuild(opts URLOptions, filter FilterSet, artifactName string) (build, []build, error) {
+	picked, builds, err := circleFindBuilds(opts, filter, artifactName)
 	if err != nil {
-		log.Fatal(err)
+		return build{}, nil, err
+	}
+	return picked[0], builds, nil
+}
+
+// circleFindBuilds returns the builds matching filter, most recent first:
+// just one unless -last-n asks for more.  All of the requests made to find
+// them are bounded by -resolve-timeout.
+func circleFindBuilds(opts URLOptions, filter FilterSet, artifactName string) ([]build, []build, error) {
+	ctx := context.Background()
+	if resolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, resolveTimeout)
+		defer cancel()
+	}
+	picked, builds, err := findBuilds(ctx, opts, filter, artifactName)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, nil, fmt.Errorf("build resolution timed out after %s", resolveTimeout)
+	}
+	return picked, builds, err
+}
+
+// fetchBuilds retrieves the list of recent builds.
+func fetchBuilds(ctx context.Context, opts URLOptions) ([]build, error) {
+	u, err := BuildListURL(opts)
+	if err != nil {
+		return nil, err
+	}
+	verboseln("Build list:", censorURL(u.String()))
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
-	res, err := http.DefaultClient.Do(req)
+	res, err := doRequest(req)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer res.Body.Close()
 	body := new(bytes.Buffer)
 	if _, err := io.Copy(body, res.Body); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
+	if len(bytes.TrimSpace(body.Bytes())) == 0 {
+		return nil, emptyResponse(u.String())
+	}
 	var builds []build
-	if err := json.Unmarshal(body.Bytes(), &builds); err != nil {
-		log.Fatalf("%s: %s", err, body.String())
+	if err := unmarshalJSON(body.Bytes(), &builds); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, body.String())
+	}
+	return builds, nil
+}
+
+// emptyResponse is the error for a successful response without a body,
+// which json reports only as EOF.  It's seen from proxies which swallow the
+// body, eg on failing their own authentication.
+func emptyResponse(u string) error {
+	return fmt.Errorf("empty response from %s; possible proxy/auth issue", censorURL(u))
+}
+
+func findBuilds(ctx context.Context, opts URLOptions, filter FilterSet, artifactName string) ([]build, []build, error) {
+	builds, err := fetchBuilds(ctx, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dumpBuilds != "" {
+		if err := writeBuildsJSON(dumpBuilds, builds); err != nil {
+			return nil, nil, err
+		}
+	}
+	if prefetch {
+		if n := prefetchCandidate(builds); n > 0 {
+			prefetched = startPrefetch(opts, n)
+		}
+	}
+
+	// A running build only qualifies if it has already produced the artifact
+	// which we're after, so we need to go and look; with -require-artifact,
+	// so does any build.  Without an <artifact>, as for -all, any which pass
+	// the filters will do.
+	hasArtifact := func(b build) (bool, error) {
+		opts.BuildNum = b.BuildNum
+		artifacts, err := fetchBuildArtifacts(ctx, opts)
+		if err != nil {
+			return false, fmt.Errorf("build %d: artifact list: %w", b.BuildNum, err)
+		}
+		artifacts = filterArtifacts(artifacts, artFilter)
+		if artifactName == "" {
+			return len(artifacts) > 0, nil
+		}
+		_, ok := findArtifact(artifacts, artifactName)
+		return ok, nil
+	}
+
+	if len(filter.triggerTypes) > 0 {
+		filter.triggerTypeOf = newPipelineTriggers(ctx, opts).of
+	}
+	found, err := pickBuilds(builds, filter, hasArtifact)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	picked := make([]build, len(found))
+	for i, k := range found {
+		picked[i] = builds[k]
+		verbosef("\nBuild Subject  : %s\nBuild Started  : %s\nBuild Finished : %s\n",
+			builds[k].Subject, builds[k].StartTime, builds[k].StopTime)
+		if d, ok := builds[k].duration(); ok {
+			verbosef("Build Duration : %s\n", d)
+		}
+
+		// A build which never checked out may have no revision.
+		rev := builds[k].Revision
+		if len(rev) > 8 {
+			rev = rev[:8]
+		}
+		fmt.Fprintf(diag, "build: %d branch: %s rev: %s\n", builds[k].BuildNum, filter.branch, rev)
 	}
+	return picked, builds, nil
+}
+
+// writeBuildsJSON dumps the decoded builds, for attaching to bug reports
+// about the build picked.  Only the fields we decode are written, so there are
+// no credentials, unlike with the raw response and its URL.
+func writeBuildsJSON(path string, builds []build) error {
+	b, err := json.MarshalIndent(struct {
+		jsonHeader
+		Builds []build `json:"builds"`
+	}{newJSONHeader(), builds}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// buildDuration is how long a build took, for -outcomes -json, with no
+// duration_ms for a build which hasn't both started and finished.
+type buildDuration struct {
+	BuildNum   int    `json:"build_num"`
+	Outcome    string `json:"outcome"`
+	StartTime  string `json:"start_time,omitempty"`
+	StopTime   string `json:"stop_time,omitempty"`
+	DurationMS *int64 `json:"duration_ms,omitempty"`
+}
+
+func newBuildDuration(b build) buildDuration {
+	d := buildDuration{BuildNum: b.BuildNum, Outcome: b.Outcome, StartTime: b.StartTime, StopTime: b.StopTime}
+	if t, ok := b.duration(); ok {
+		ms := t.Milliseconds()
+		d.DurationMS = &ms
+	}
+	return d
+}
+
+// writeOutcomes summarizes the outcomes of builds, as a quick check of CI
+// health, eg "8 success, 1 failed, 1 running".
+func writeOutcomes(w io.Writer, branch string, builds []build, asJSON bool) error {
+	tally := map[string]int{}
+	for _, b := range builds {
+		outcome := b.Outcome
+		if b.running() {
+			outcome = "running"
+		}
+		tally[outcome]++
+	}
+	if asJSON {
+		durations := make([]buildDuration, len(builds))
+		for i, b := range builds {
+			durations[i] = newBuildDuration(b)
+		}
+		return json.NewEncoder(w).Encode(struct {
+			jsonHeader
+			Branch    string          `json:"branch"`
+			Builds    int             `json:"builds"`
+			Outcomes  map[string]int  `json:"outcomes"`
+			Durations []buildDuration `json:"durations"`
+		}{newJSONHeader(), branch, len(builds), tally, durations})
+	}
+
+	outcomes := make([]string, 0, len(tally))
+	for outcome := range tally {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Slice(outcomes, func(i, j int) bool {
+		if tally[outcomes[i]] != tally[outcomes[j]] {
+			return tally[outcomes[i]] > tally[outcomes[j]]
+		}
+		return outcomes[i] < outcomes[j]
+	})
+	summary := make([]string, len(outcomes))
+	for i, outcome := range outcomes {
+		summary[i] = fmt.Sprintf("%d %s", tally[outcome], outcome)
+	}
+	_, err := fmt.Fprintf(w, "outcomes: branch %q, last %d builds: %s\n", branch, len(builds), strings.Join(summary, ", "))
+	return err
+}
+
+// pickBuild returns the index within builds of the build matching filter.
+// Running builds (with -include-running) are only picked if hasArtifact
+// reports that they have already produced the artifact which we want.  With
+// -require-artifact, so is any build, and an error from hasArtifact ends
+// the search, rather than passing over a build which may well have it.
+func pickBuild(builds []build, filter FilterSet, hasArtifact func(build) (bool, error)) (int, error) {
+	found, err := pickBuilds(builds, filter, hasArtifact)
+	if err != nil {
+		return -1, err
+	}
+	return found[0], nil
+}
+
+// pickBuilds is pickBuild for -last-n: it returns the indices of up to
+// filter.lastN matching builds, most recent first, or else of just the one.
+// Given a -workflow list, it tries each workflow in turn, in order of
+// preference, returning the builds of the first which has any.
+func pickBuilds(builds []build, filter FilterSet, hasArtifact func(build) (bool, error)) ([]int, error) {
+	if filter.latestOnly {
+		filter.workflow = ""
+	}
+	prefs := filter.workflowPreference()
+	if len(prefs) < 2 || len(builds) == 0 {
+		return pickWorkflowBuilds(builds, filter, hasArtifact)
+	}
+	var errs []string
+	for _, name := range prefs {
+		f := filter
+		f.workflow = name
+		decisions.retry()
+		found, err := pickWorkflowBuilds(builds, f, hasArtifact)
+		if err == nil {
+			fmt.Fprintf(diag, "build: workflow %q was the first of %q with a qualifying build\n", name, filter.workflow)
+			if decisions != nil {
+				decisions.Workflow = name
+			}
+			return found, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("build: none of the workflows %q has a qualifying build:\n\t%s",
+		filter.workflow, strings.Join(errs, "\n\t"))
+}
+
+func pickWorkflowBuilds(builds []build, filter FilterSet, hasArtifact func(build) (bool, error)) ([]int, error) {
 	if len(builds) == 0 {
-		log.Fatalf("no builds found for branch: %s", filter.branch)
+		// Nothing at all, so filters are not the problem.
+		return nil, fmt.Errorf("no builds found for branch: %s (is it the right branch, and has it built?)", filter.branch)
 	}
 
 	// We _want_ to find the last successful workflow; as of APIv1.1 there's
@@ -324,31 +1851,102 @@ func circleFindBuild(expansions Expander, filter FilterSet) (buildNum int) {
 	// pre-build.  Unless the caller told us they don't care about matching
 	// workflow ID to the latest workflow for which we see any builds.
 
-	foundBuild := -1
+	if filter.strictWorkflow && filter.workflow != "" {
+		if names := workflowNames(builds, filter); len(names) > 1 {
+			return nil, fmt.Errorf("build: -workflow %q matches several workflows: %s",
+				filter.workflow, strings.Join(names, ", "))
+		}
+	}
+
+	var qualifying []int
 	onlyWorkflowID := ""
+	sinceFound := false
 	for i := 0; i < len(builds); i++ {
 		headOfWorkflow := false
+		if filter.sinceRev != "" && strings.HasPrefix(builds[i].Revision, filter.sinceRev) {
+			verbosenf(2, "[%d][%d] STOP: reached revision %q\n", i, builds[i].BuildNum, filter.sinceRev)
+			sinceFound = true
+			break
+		}
 		if builds[i].Workflows == nil && (filter.workflow != "" || filter.jobname != "") {
 			verbosenf(2, "[%d][%d] SKIP, no workflow: %+v\n", i, builds[i].BuildNum, builds[i])
+			decisions.skip(builds[i], skipNoWorkflow)
 			// -- these happen, they show in the UI, I wonder if it's a manual trigger?
 			continue
 		}
-		if builds[i].Outcome != "success" {
+		running := filter.includeRunning && builds[i].running()
+		if builds[i].Outcome != "success" && !running {
 			verbosenf(2, "[%d][%d] SKIP: build outcome is %q\n",
 				i, builds[i].BuildNum, builds[i].Outcome)
+			decisions.skip(builds[i], skipOutcome)
+			continue
+		}
+		if filter.tag != "" && builds[i].Tag != filter.tag {
+			verbosenf(3, "[%d][%d] SKIP: tag %q, need %q\n", i, builds[i].BuildNum, builds[i].Tag, filter.tag)
+			decisions.skip(builds[i], skipTag)
+			continue
+		}
+		if filter.branchGlob != "" {
+			if ok, _ := path.Match(filter.branchGlob, builds[i].Branch); !ok {
+				verbosenf(3, "[%d][%d] SKIP: branch %q, need %q\n", i, builds[i].BuildNum, builds[i].Branch, filter.branchGlob)
+				decisions.skip(builds[i], skipBranch)
+				continue
+			}
+		}
+		if filter.triggeredBy != "" && (builds[i].User == nil || !strings.EqualFold(builds[i].User.Login, filter.triggeredBy)) {
+			verbosenf(2, "[%d][%d] SKIP: triggered by %+v (why %q), need %q\n",
+				i, builds[i].BuildNum, builds[i].User, builds[i].Why, filter.triggeredBy)
+			decisions.skip(builds[i], skipTriggeredBy)
 			continue
 		}
 		if onlyWorkflowID != "" && builds[i].Workflows.WorkflowID != onlyWorkflowID {
 			verbosenf(3, "[%d][%d] SKIP: workflow-id %q, need latched workflow-id %q\n",
 				i, builds[i].BuildNum, builds[i].Workflows.WorkflowID, onlyWorkflowID)
+			decisions.skip(builds[i], skipWorkflowID)
 			continue
 		}
-		if filter.workflow != "" && builds[i].Workflows.WorkflowName != filter.workflow {
+		if filter.workflow != "" && !filter.matchWorkflow(builds[i].Workflows.WorkflowName) {
 			verbosenf(2, "[%d][%d] SKIP: workflow is %q, need %q\n",
 				i, builds[i].BuildNum, builds[i].Workflows.WorkflowName, filter.workflow)
+			decisions.skip(builds[i], skipWorkflowName)
 			continue
 		}
-		if onlyWorkflowID == "" && filter.workflow != "" && !filter.anyFlowID {
+		if len(filter.triggerTypes) > 0 {
+			t, err := filter.triggerTypeOf(builds[i])
+			if err != nil {
+				return nil, err
+			}
+			if !filter.allowsTrigger(t) {
+				verbosenf(2, "[%d][%d] SKIP: pipeline trigger type %q, need %q\n",
+					i, builds[i].BuildNum, t, filter.triggerTypes)
+				decisions.skip(builds[i], skipTriggerType)
+				continue
+			}
+		}
+		if running {
+			// A running build must neither latch the workflow-id nor be
+			// picked unless it's the one we want and already has the
+			// artifact; otherwise move on to older builds.
+			if filter.jobname != "" && builds[i].Workflows.JobName != filter.jobname {
+				verbosenf(2, "[%d][%d] SKIP: running, and not jobname %q\n",
+					i, builds[i].BuildNum, filter.jobname)
+				decisions.skip(builds[i], skipJobName)
+				continue
+			}
+			has, err := hasArtifact(builds[i])
+			if err != nil && filter.requireArtifact {
+				return nil, err
+			} else if err != nil {
+				verboseln("Artifact list:", err)
+			}
+			if !has {
+				verbosenf(2, "[%d][%d] SKIP: running, artifact not (yet) available\n",
+					i, builds[i].BuildNum)
+				decisions.skip(builds[i], skipRunningNoArtifact)
+				continue
+			}
+		}
+		if onlyWorkflowID == "" && filter.workflow != "" && !filter.anyFlowID && !filter.requireArtifact && filter.sinceRev == "" && filter.lastN == 0 {
 			onlyWorkflowID = builds[i].Workflows.WorkflowID
 			verbosenf(2, "[%d][%d] Note: first match on workflow %q, workflow id is %q\n",
 				i, builds[i].BuildNum, filter.workflow, onlyWorkflowID)
@@ -356,7 +1954,7 @@ func circleFindBuild(expansions Expander, filter FilterSet) (buildNum int) {
 		}
 		if filter.jobname != "" && builds[i].Workflows.JobName != filter.jobname {
 			if headOfWorkflow {
-				fmt.Printf("build: branch %q build %d is a %q, part of workflow %q, searching for build %q\n",
+				fmt.Fprintf(diag, "build: branch %q build %d is a %q, part of workflow %q, searching for build %q\n",
 					filter.branch, builds[i].BuildNum,
 					builds[i].Workflows.JobName, builds[i].Workflows.WorkflowName,
 					filter.jobname)
@@ -364,21 +1962,50 @@ func circleFindBuild(expansions Expander, filter FilterSet) (buildNum int) {
 				verbosenf(2, "[%d][%d] SKIP, has matching workflow %q, not yet right jobname (saw %q)\n",
 					i, builds[i].BuildNum, builds[i].Workflows.WorkflowName, builds[i].Workflows.JobName)
 			}
+			decisions.skip(builds[i], skipJobName)
 			continue
 		}
-		if builds[i].Workflows == nil {
-			// must mean no filters, so i == 0
-			fmt.Printf("build: workflow-less on branch %q found a build at offset %d\n",
-				filter.branch, i)
-		} else {
-			fmt.Printf("build: workflow %q branch %q found build %q at offset %d\n",
-				builds[i].Workflows.WorkflowName, filter.branch, builds[i].Workflows.JobName, i)
+		if filter.requireArtifact && !running {
+			has, err := hasArtifact(builds[i])
+			if err != nil {
+				return nil, err
+			}
+			if !has {
+				verbosenf(2, "[%d][%d] SKIP: artifact not found\n", i, builds[i].BuildNum)
+				decisions.skip(builds[i], skipNoArtifact)
+				continue
+			}
 		}
+		qualifying = append(qualifying, i)
+		decisions.qualify(builds[i])
+		if filter.sinceRev == "" && !filter.failOnMultiple && len(qualifying) >= filter.lastN {
+			break
+		}
+		// With -since-rev, keep going: we want the oldest qualifying build
+		// before we reach that revision.  With -fail-on-multiple, we need
+		// to know if there are any others.  With -last-n, we want n.
+	}
 
-		foundBuild = i
-		break
+	foundBuild := -1
+	if len(qualifying) > 0 {
+		foundBuild = qualifying[0]
+		if filter.sinceRev != "" {
+			foundBuild = qualifying[len(qualifying)-1]
+		}
+	}
+	if filter.failOnMultiple && len(qualifying) > 1 {
+		nums := make([]string, len(qualifying))
+		for j, k := range qualifying {
+			nums[j] = strconv.Itoa(builds[k].BuildNum)
+		}
+		return nil, fmt.Errorf("build: %d builds qualify (%s); tighten the filters or use -build",
+			len(qualifying), strings.Join(nums, ", "))
 	}
 
+	if filter.sinceRev != "" && !sinceFound {
+		return nil, fmt.Errorf("build: revision %q not found in the last %d builds of branch %q (try a larger -search-depth)",
+			filter.sinceRev, len(builds), filter.branch)
+	}
 	if foundBuild < 0 {
 		labelFlow := filter.workflow
 		labelName := filter.jobname
@@ -388,83 +2015,791 @@ func circleFindBuild(expansions Expander, filter FilterSet) (buildNum int) {
 		if labelName == "" {
 			labelName = "*"
 		}
-		log.Fatalf("build: failed to find a build matching workflow=%q jobname=%q in branch %q",
-			labelFlow, labelName, filter.branch)
+		if filter.sinceRev != "" {
+			return nil, fmt.Errorf("build: failed to find a build matching workflow=%q jobname=%q in branch %q after revision %q",
+				labelFlow, labelName, filter.branch, filter.sinceRev)
+		}
+		if filter.tag != "" {
+			return nil, fmt.Errorf("build: %d builds found, but none matching workflow=%q jobname=%q with tag %q (try a larger -search-depth or looser filters)",
+				len(builds), labelFlow, labelName, filter.tag)
+		}
+		if filter.branchGlob != "" {
+			return nil, fmt.Errorf("build: %d builds found, but none matching workflow=%q jobname=%q in a branch matching %q (try a larger -search-depth or looser filters)",
+				len(builds), labelFlow, labelName, filter.branchGlob)
+		}
+		return nil, fmt.Errorf("build: %d builds found, but none matching workflow=%q jobname=%q in branch %q (try a larger -search-depth or looser filters)",
+			len(builds), labelFlow, labelName, filter.branch)
+	}
+
+	if builds[foundBuild].Workflows == nil {
+		// Only with no -workflow or -job, which skip workflow-less builds.
+		// Then workflow-ful and workflow-less builds are alike to us, and
+		// the newest qualifying build is found, at whatever offset.
+		fmt.Fprintf(diag, "build: workflow-less on branch %q found build %d at offset %d\n",
+			filter.branch, builds[foundBuild].BuildNum, foundBuild)
+	} else {
+		fmt.Fprintf(diag, "build: workflow %q branch %q found build %q at offset %d\n",
+			builds[foundBuild].Workflows.WorkflowName, filter.branch, builds[foundBuild].Workflows.JobName, foundBuild)
+	}
+	if filter.lastN > 0 {
+		if len(qualifying) < filter.lastN {
+			fmt.Fprintf(diag, "build: only %d of the last %d builds qualify, not %d\n",
+				len(qualifying), len(builds), filter.lastN)
+		}
+		decisions.selectBuilds(builds, qualifying)
+		return qualifying, nil
+	}
+	decisions.selectBuilds(builds, []int{foundBuild})
+	return []int{foundBuild}, nil
+}
+
+// workflowNames returns the distinct workflow names among builds which pass
+// the workflow filter.
+func workflowNames(builds []build, filter FilterSet) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, b := range builds {
+		if b.Workflows == nil || seen[b.Workflows.WorkflowName] || !filter.matchWorkflow(b.Workflows.WorkflowName) {
+			continue
+		}
+		seen[b.Workflows.WorkflowName] = true
+		names = append(names, b.Workflows.WorkflowName)
 	}
+	return names
+}
 
-	verbosef("\nBuild Subject  : %s\nBuild Finished : %s\n",
-		builds[foundBuild].Subject, builds[foundBuild].StopTime)
+// fetchBuildArtifacts retrieves the list of artifacts of opts.BuildNum.
+func fetchBuildArtifacts(ctx context.Context, opts URLOptions) ([]artifact, error) {
+	u, err := ArtifactsURL(opts)
+	if err != nil {
+		return nil, err
+	}
+	verboseln("Artifact list:", censorURL(u.String()))
+	return fetchArtifacts(ctx, u.String())
+}
 
-	fmt.Printf("build: %d branch: %s rev: %s\n",
-		builds[foundBuild].BuildNum, filter.branch, builds[foundBuild].Revision[:8])
-	return builds[foundBuild].BuildNum
+// sameWorkflow returns those builds which were part of the workflow run with
+// workflowID and which pass the outcome filter, such as the several jobs of a
+// matrix build.  Only builds within the -search-depth window are seen.
+func sameWorkflow(builds []build, workflowID string, filter FilterSet) []build {
+	var members []build
+	for _, b := range builds {
+		if b.Workflows == nil || b.Workflows.WorkflowID != workflowID {
+			continue
+		}
+		if b.Outcome != "success" && !(filter.includeRunning && b.running()) {
+			continue
+		}
+		members = append(members, b)
+	}
+	return members
+}
+
+// fetchWorkflowArtifacts aggregates the artifacts of several builds.
+func fetchWorkflowArtifacts(ctx context.Context, opts URLOptions, builds []build) ([]artifact, error) {
+	var all []artifact
+	batch := newBatch(false)
+	for _, b := range builds {
+		opts.BuildNum = b.BuildNum
+		artifacts, err := fetchBuildArtifacts(ctx, opts)
+		if err != nil {
+			err = fmt.Errorf("build %d: %s", b.BuildNum, err)
+			if !batch.done(err) {
+				break
+			}
+			log.Printf("workflow: %s", err)
+			continue
+		}
+		batch.done(nil)
+		fmt.Fprintf(diag, "workflow: build %d (%s) has %s\n", b.BuildNum, b.Workflows.JobName, countOf(len(artifacts), "artifact"))
+		for i := range artifacts {
+			artifacts[i].build = &b
+		}
+		all = append(all, artifacts...)
+	}
+	return all, batch.err()
+}
+
+// fetchBuild retrieves the summary of opts.BuildNum, for when it was given
+// rather than searched for.
+func fetchBuild(ctx context.Context, opts URLOptions) (build, error) {
+	var b build
+	body, err := fetchRawBuild(ctx, opts)
+	if err != nil {
+		return b, err
+	}
+	err = unmarshalJSON(body, &b)
+	return b, err
+}
+
+// fetchRawBuild returns the body of the single-build endpoint, as is, for
+// -raw-build.
+func fetchRawBuild(ctx context.Context, opts URLOptions) ([]byte, error) {
+	u, err := BuildURL(opts)
+	if err != nil {
+		return nil, err
+	}
+	verboseln("Build:", censorURL(u.String()))
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("build %d: %s responded %s", opts.BuildNum, req.URL.Host, res.Status)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, emptyResponse(u.String())
+	}
+	return body, nil
+}
+
+// writeResolved writes the build number found, for -resolve-only: that
+// alone, so that a script can take it from stdout.
+func writeResolved(w io.Writer, buildNum int) error {
+	_, err := fmt.Fprintln(w, buildNum)
+	return err
+}
+
+// writeArtifactCount writes the number of artifacts, for -artifact-count:
+// that alone, as for writeResolved.
+func writeArtifactCount(w io.Writer, artifacts []artifact) error {
+	_, err := fmt.Fprintln(w, len(artifacts))
+	return err
+}
+
+// writeRawBuild writes the body of the single-build endpoint, with any
+// occurrence of the token redacted.
+func writeRawBuild(w io.Writer, body []byte) error {
+	if circleToken != "" {
+		body = bytes.ReplaceAll(body, []byte(circleToken), []byte(redacted))
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		_, err := io.WriteString(w, "\n")
+		return err
+	}
+	return nil
+}
+
+// writeArtifactList prints artifacts for -list-artifacts; long prefixes each
+// with the build number and short revision of the build which produced it,
+// so that lists from several runs stay attributable.
+func writeArtifactList(w io.Writer, artifacts []artifact, long bool) {
+	for i, a := range artifacts {
+		writeArtifactLine(w, i, a, long)
+	}
+}
+
+func writeArtifactLine(w io.Writer, i int, a artifact, long bool) {
+	if long {
+		num, rev := "-", "-"
+		if a.build != nil {
+			num, rev = strconv.Itoa(a.build.BuildNum), a.build.Revision
+			if len(rev) > 7 {
+				rev = rev[:7]
+			}
+		}
+		fmt.Fprintf(w, "%s %s ", num, rev)
+	}
+	fmt.Fprintf(w, "[%d] node_index %d: path %q URL %q\n", i, a.NodeIndex, a.Path, a.URL)
+}
+
+// writeArtifactGroups is writeArtifactList for -group-by-node: the artifacts
+// of each node are listed under a header with their count, keeping their
+// order within the node.
+func writeArtifactGroups(w io.Writer, artifacts []artifact, long bool) {
+	grouped := append([]artifact(nil), artifacts...)
+	sort.SliceStable(grouped, func(i, j int) bool { return grouped[i].NodeIndex < grouped[j].NodeIndex })
+	for start := 0; start < len(grouped); {
+		node := grouped[start].NodeIndex
+		end := start
+		for end < len(grouped) && grouped[end].NodeIndex == node {
+			end++
+		}
+		fmt.Fprintf(w, "node %d: %s\n", node, countOf(end-start, "artifact"))
+		for i, a := range grouped[start:end] {
+			io.WriteString(w, "  ")
+			writeArtifactLine(w, i, a, long)
+		}
+		start = end
+	}
+}
+
+// writeArtifactCommands writes, for each artifact, the cart command which
+// would download it from its build, for pasting.  An artifact of a node
+// other than 0, or whose path several nodes share, is given its -node.  The
+// token is left to the environment.
+func writeArtifactCommands(w io.Writer, artifacts []artifact, opts URLOptions) {
+	type buildPath struct {
+		buildNum int
+		path     string
+	}
+	key := func(a artifact) buildPath {
+		if a.build == nil {
+			return buildPath{0, a.Path}
+		}
+		return buildPath{a.build.BuildNum, a.Path}
+	}
+	nodes := map[buildPath]int{}
+	for _, a := range artifacts {
+		nodes[key(a)]++
+	}
+	for _, a := range artifacts {
+		args := []string{"cart", "-repo", opts.Project}
+		if vcs := opts.provider(); vcs != github {
+			args = append(args, "-vcs", vcs.VCSType())
+		}
+		if opts.Host != "" && opts.Host != defaultHost {
+			args = append(args, "-host", opts.Host)
+		}
+		if a.build != nil && a.build.BuildNum > 0 {
+			args = append(args, "-build", strconv.Itoa(a.build.BuildNum))
+		}
+		if a.NodeIndex != 0 || nodes[key(a)] > 1 {
+			args = append(args, "-node", strconv.Itoa(a.NodeIndex))
+		}
+		args = append(args, a.Path)
+		for i, arg := range args {
+			args[i] = shellQuote(arg)
+		}
+		fmt.Fprintln(w, strings.Join(args, " "))
+	}
+}
+
+// writeArtifactURLs is writeArtifactList for -urls-only: just the URLs, one
+// per line, as for xargs.
+func writeArtifactURLs(w io.Writer, artifacts []artifact, withToken bool) error {
+	for _, a := range artifacts {
+		u, err := artifactURL(a, withToken)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell, if it needs quoting.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=.,/:@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func validSortKey(key string) bool {
+	return key == "path" || key == "node" || key == "size"
+}
+
+// sortArtifacts orders artifacts by key, for -sort, keeping the API's order
+// among equals.  sizeOf is only called when sorting by size.
+func sortArtifacts(artifacts []artifact, key string, sizeOf func(artifact) int64) {
+	switch key {
+	case "path":
+		sort.SliceStable(artifacts, func(i, j int) bool { return artifacts[i].Path < artifacts[j].Path })
+	case "node":
+		sort.SliceStable(artifacts, func(i, j int) bool { return artifacts[i].NodeIndex < artifacts[j].NodeIndex })
+	case "size":
+		sizes := make(map[string]int64, len(artifacts))
+		for _, a := range artifacts {
+			sizes[a.URL] = sizeOf(a)
+		}
+		sort.SliceStable(artifacts, func(i, j int) bool { return sizes[artifacts[i].URL] < sizes[artifacts[j].URL] })
+	}
+}
+
+// artifactSize returns the size of a, as probed with -probe, or -1 if that
+// fails or takes longer than -head-timeout.
+func artifactSize(a artifact) int64 {
+	ctx := context.Background()
+	if headTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, headTimeout)
+		defer cancel()
+	}
+	p, err := probeArtifact(ctx, a)
+	if err != nil {
+		verboseln("Artifact size:", err)
+		return -1
+	}
+	return p.ContentLength
+}
+
+// fetchArtifacts retrieves the list of artifacts from the artifacts URL u.
+func fetchArtifacts(ctx context.Context, u string) ([]artifact, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var artifacts []artifact
+	if err := decodeJSON(res.Body, &artifacts); err == io.EOF {
+		return nil, emptyResponse(u)
+	} else if err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+// checkMinArtifacts guards against partial builds, which have produced fewer
+// artifacts than expected.
+func checkMinArtifacts(artifacts []artifact, min int) error {
+	if len(artifacts) < min {
+		return fmt.Errorf("build has %d matching artifacts, need at least %d", len(artifacts), min)
+	}
+	return nil
+}
+
+// matchArtifact reports whether a is the artifact name: its Path is name, or
+// its URL ends with name.  The URL often redirects to a storage URL which no
+// longer ends with the artifact's path, so the match is against the Path and
+// URL of the artifact list, which are from before any redirect: never
+// against a response's URL.
+func matchArtifact(a artifact, name string) bool {
+	return a.Path == name || strings.HasSuffix(a.URL, name)
+}
+
+// findArtifact returns the first artifact whose Path is name or whose URL
+// ends with it; an empty name matches any artifact.
+func findArtifact(artifacts []artifact, name string) (artifact, bool) {
+	for _, a := range artifacts {
+		if matchArtifact(a, name) {
+			return a, true
+		}
+	}
+	return artifact{}, false
 }
 
 func downloadArtifact(artifacts []artifact, name, outputPath string) (int64, error) {
 	for _, a := range artifacts {
 		verboseln("Artifact URL:", a.URL)
-		if !strings.HasSuffix(a.URL, name) {
+		if !matchArtifact(a, name) {
 			continue
 		}
-		u, err := url.Parse(a.URL)
-		if err != nil {
-			return 0, err
-		}
-		q := u.Query()
-		q.Add("circle-token", circleToken)
-		u.RawQuery = q.Encode()
 		verboseln("Artifact found:", name)
 		if dryRun {
-			fmt.Println("Dry run: skipped download")
+			fmt.Fprintln(diag, "Dry run: skipped download")
 			os.Exit(0)
 		}
-		fmt.Printf("Downloading %s...\n", name)
-		res, err := http.Get(u.String())
-		if err != nil {
-			return 0, err
+		return saveArtifact(a, name, outputPath)
+	}
+	return 0, fmt.Errorf("unable to find artifact: %s", name)
+}
+
+// saveArtifact downloads artifact a, known to the user as name, to outputPath.
+func saveArtifact(a artifact, name, outputPath string) (int64, error) {
+	fmt.Fprintf(diag, "Downloading %s...\n", name)
+	return fetchArtifact(a, name, func(size int64) (io.WriteCloser, error) {
+		return createChecked(outputPath, size)
+	})
+}
+
+// serverOutputPath returns the file name the server gives artifact name,
+// for -use-server-filename, or else fallback.
+func serverOutputPath(artifacts []artifact, name, fallback string) string {
+	a, ok := findArtifact(artifacts, name)
+	if !ok {
+		return fallback
+	}
+	p, err := probeArtifact(context.Background(), a)
+	if err != nil {
+		verboseln("Server filename:", err)
+		return fallback
+	}
+	if server, ok := serverFilename(p.ContentDisposition); ok {
+		verboseln("Server filename:", server)
+		return server
+	}
+	return fallback
+}
+
+// rejectEmpty fails the download of name to outputPath if it was empty,
+// removing the file, for -fail-on-empty: an empty artifact means a broken
+// build, for some.  Stdout, a FIFO or a device is left be.
+func rejectEmpty(name, outputPath string, n int64) error {
+	if n > 0 {
+		return nil
+	}
+	if fi, err := os.Stat(outputPath); err == nil && fi.Mode().IsRegular() {
+		if err := os.Remove(outputPath); err != nil {
+			return err
 		}
-		defer res.Body.Close()
-		if res.StatusCode != 200 {
-			return 0, fmt.Errorf("http: remote server responded %s (check http://status.circleci.com)", res.Status)
+		return fmt.Errorf("%s is empty (0 bytes); removed %s", name, outputPath)
+	}
+	return fmt.Errorf("%s is empty (0 bytes)", name)
+}
+
+// verifyArtifact downloads artifact a, known to the user as name, but only
+// to checksum it, for -verify: it returns the size and SHA-256 of its body.
+func verifyArtifact(a artifact, name string) (int64, string, error) {
+	fmt.Fprintf(diag, "Verifying %s...\n", name)
+	h := sha256.New()
+	n, err := fetchArtifact(a, name, func(int64) (io.WriteCloser, error) {
+		h.Reset()
+		return nopCloser{h}, nil
+	})
+	return n, hex.EncodeToString(h.Sum(nil)), err
+}
+
+// countOf gives n of thing, eg "1 artifact" or "2 artifacts".
+func countOf(n int, thing string) string {
+	if n == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// fetchArtifact downloads artifact a to the writer returned by create,
+// which is called anew for each attempt, with the size the server gives (or
+// -1).
+func fetchArtifact(a artifact, name string, create func(size int64) (io.WriteCloser, error)) (int64, error) {
+	u, err := artifactURL(a, false)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; ; i++ {
+		n, err := fetchArtifactOnce(u, name, create)
+		if !errors.Is(err, errStalled) || i >= maxRetries || !hostRetries.take(urlHost(u)) {
+			return n, err
 		}
-		f, err := os.Create(outputPath)
-		if err != nil {
-			return 0, err
+		verbosef("retry %d/%d: %s\n", i+1, maxRetries, err)
+		sleep(context.Background(), retryBackoff.delay(i))
+	}
+}
+
+// fetchArtifactOnce makes a single attempt at fetchArtifact, from URL u.
+func fetchArtifactOnce(u, name string, create func(size int64) (io.WriteCloser, error)) (int64, error) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if rawDownload {
+		// Asking for an encoding ourselves stops the transport from
+		// decoding one; a server may still send what it stored encoded.
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	res, err := doRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return 0, fmt.Errorf("%w (expired?): remote server responded %s", errMissing, res.Status)
+	}
+	if res.StatusCode != 200 {
+		return 0, fmt.Errorf("http: remote server responded %s (check http://status.circleci.com)", res.Status)
+	}
+	if res.Uncompressed {
+		log.Printf("warning: %s was served gzip-encoded and has been decoded; use -raw to keep the bytes as stored", name)
+	}
+	if err := checkMaxSize(name, res.ContentLength); err != nil {
+		return 0, err
+	}
+	f, err := create(res.ContentLength)
+	if err != nil {
+		return 0, err
+	}
+	var body io.Reader = res.Body
+	if stallTimeout > 0 {
+		sr := newStallReader(res.Body, stallTimeout, cancel)
+		defer sr.stop()
+		body = sr
+	}
+	if maxSize > 0 {
+		body = &maxSizeReader{r: body, name: name, max: maxSize}
+	}
+	if limitRate > 0 {
+		body = newRateLimitedReader(body, limitRate)
+	}
+	if showProgress {
+		p := newProgress(body, output.Progress, name, res.ContentLength, progressInterval, plainProgress)
+		defer p.stop()
+		body = p
+	}
+	if progressJSONOut != nil {
+		p := newJSONProgress(body, progressJSONOut, name, res.ContentLength, progressInterval)
+		defer p.stop()
+		body = p
+	}
+	start := time.Now()
+	n, err := copyBuffered(f, body, bufferSize)
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && res.ContentLength >= 0 && n != res.ContentLength {
+		err = fmt.Errorf("%s: got %d bytes, but the server said %d", name, n, res.ContentLength)
+	}
+	if err == nil {
+		elapsed := time.Since(start)
+		verbosef("downloaded %s (%d bytes) in %s (%s)\n", name, n, elapsed.Round(time.Millisecond), throughput(n, elapsed))
+	}
+	return n, err
+}
+
+func validPattern(pattern string) bool {
+	_, err := filepath.Match(pattern, "")
+	return err == nil
+}
+
+func urlHostname(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Hostname()
+	}
+	return s
+}
+
+// urlHost is urlHostname with the port, if any.
+func urlHost(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Host
+	}
+	return s
+}
+
+// artifactURL returns the URL from which to download a, with or without the
+// auth token, which is only ever added for a trusted host.
+func artifactURL(a artifact, withToken bool) (string, error) {
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return "", err
+	}
+	if withToken && trusted(u.Hostname()) {
+		q := u.Query()
+		q.Add("circle-token", circleToken)
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+// copyBuffered copies src to dst through a buffer of size bytes, so that
+// streams arriving in small reads don't cost a syscall per read.
+func copyBuffered(dst io.Writer, src io.Reader, size int) (int64, error) {
+	w := bufio.NewWriterSize(dst, size)
+	// Hide the bufio.Writer's ReadFrom from io.Copy, else it would pass
+	// through to an *os.File's ReadFrom, bypassing the buffer.
+	n, err := io.Copy(struct{ io.Writer }{w}, src)
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return n, err
+}
+
+// parseByteSize parses a size such as 512, 64KB, 2MB or 1GiB: the units are
+// powers of 1000 (as for throughput), or of 1024 with an "i".
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12}, {"B", 1},
+	}
+	num, mult := strings.TrimSpace(s), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(num), strings.ToUpper(u.suffix)) {
+			num, mult = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.mult
+			break
 		}
-		return io.Copy(f, res.Body)
 	}
-	return 0, fmt.Errorf("unable to find artifact: %s", name)
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 || f*float64(mult) > math.MaxInt64 {
+		return 0, fmt.Errorf("bad size %q: want bytes, eg 512, 64KB, 2MB or 1GiB", s)
+	}
+	return int64(f * float64(mult)), nil
 }
 
-var ghURL = regexp.MustCompile(`github\.com(?:/|:)(\w+/\w+)`)
+// throughput formats the rate of transferring n bytes in elapsed time.
+func throughput(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "-- MB/s"
+	}
+	return fmt.Sprintf("%.2f MB/s", float64(n)/elapsed.Seconds()/1e6)
+}
 
+// createOutput opens path for writing.  Regular files are created or
+// truncated, but special files such as a FIFO (for streaming into another
+// process) or a device must be opened as they are, without truncation.
+func createOutput(path string) (*os.File, error) {
+	if fi, err := os.Stat(path); err == nil && !fi.Mode().IsRegular() && !fi.IsDir() {
+		return os.OpenFile(path, os.O_WRONLY, 0)
+	}
+	return os.Create(path)
+}
+
+// gitTimeout bounds how long we wait for git, which can hang on a broken
+// repository or a stuck filesystem.
+var gitTimeout = 5 * time.Second
+
+// gitOutput runs git with args in the current directory, returning its
+// output, or an error after timeout, when what is a description of what we
+// wanted.
+func gitOutput(timeout time.Duration, what string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// Don't wait on any grandchildren holding stdout after git is killed.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("exec git: timed out after %s finding %s", timeout, what)
+	}
+	if err != nil {
+		return "", fmt.Errorf("exec git: %s", err)
+	}
+	return string(out), nil
+}
+
+// gitRemoteURL returns the URL of the origin remote of the git repository in
+// the current directory.
+func gitRemoteURL(timeout time.Duration) (string, error) {
+	return gitOutput(timeout, "the project; use -repo <username>/<repo>", "remote", "get-url", "origin")
+}
+
+var errNoBranch = errors.New("git: no branch checked out")
+
+// gitBranch returns the branch checked out in the current directory.  On a
+// detached HEAD, there is none, and it's an error.
+func gitBranch(timeout time.Duration) (string, error) {
+	out, err := gitOutput(timeout, "the branch; use -branch <name>", "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		// older gits, or a detached HEAD, which says HEAD
+		if out, err = gitOutput(timeout, "the branch; use -branch <name>", "rev-parse", "--abbrev-ref", "HEAD"); err != nil {
+			return "", err
+		}
+	}
+	branch := strings.TrimSpace(out)
+	if branch == "" || branch == "HEAD" {
+		return "", errNoBranch
+	}
+	return branch, nil
+}
+
+// gitProject returns the username/repo of a git remote URL at any provider.
 func gitProject(url string) string {
-	remote := ghURL.FindStringSubmatch(url)
-	if len(remote) > 1 {
-		return strings.Replace(remote[1], ".git", "", 1)
+	_, project := detectProvider(url)
+	return project
+}
+
+// compileRepoRegex compiles -repo-regex, for remotes which no Provider
+// recognize (eg, internal mirrors); a nil result means there's none.
+func compileRepoRegex(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad -repo-regex: %s", err)
+	}
+	if re.NumSubexp() != 1 {
+		return nil, fmt.Errorf("bad -repo-regex %q: need exactly one capture group, for username/repo, got %d", pattern, re.NumSubexp())
+	}
+	return re, nil
+}
+
+func gitProjectMatching(re *regexp.Regexp, url string) string {
+	if m := re.FindStringSubmatch(url); m != nil {
+		return strings.TrimSuffix(m[1], ".git")
 	}
 	return ""
 }
 
+// parseCircleURL extracts the project and build number from the URL of a
+// build, as found in notifications and the UI, in either of the shapes:
+//
+//	https://circleci.com/gh/<username>/<repo>/<build>
+//	https://app.circleci.com/pipelines/github/<username>/<repo>/<pipeline>/workflows/<id>/jobs/<build>
+//
+// (or the like for other providers).  The job number in the latter is the
+// build number of API v1.1.
+func parseCircleURL(s string) (project string, buildNum int, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", 0, err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	var num string
+	switch {
+	case len(parts) == 4 && providerNamed(parts[0]) != nil:
+		project, num = parts[1]+"/"+parts[2], parts[3]
+	case len(parts) >= 5 && parts[0] == "pipelines" && providerNamed(parts[1]) != nil:
+		// We'd need API v2 to resolve a pipeline or a workflow to a
+		// build, so insist upon the URL of a job.
+		if len(parts) != 9 || parts[5] != "workflows" || parts[7] != "jobs" {
+			return "", 0, fmt.Errorf("from-url: %q is not the URL of a job; follow the link to the job", s)
+		}
+		project, num = parts[2]+"/"+parts[3], parts[8]
+	default:
+		return "", 0, fmt.Errorf("from-url: unrecognized CircleCI build URL %q", s)
+	}
+	if buildNum, err = strconv.Atoi(num); err != nil || buildNum < 1 {
+		return "", 0, fmt.Errorf("from-url: bad build number %q in %q", num, s)
+	}
+	return project, buildNum, nil
+}
+
 // We want to be able to censor a string for printing, to avoid showing
-// credentials, to make it easier to copy/paste.
-func censorURL(original string) string { return mutateURL(original, true) }
+// credentials, to make it easier to copy/paste.  Some URLs come from the
+// server (eg those of artifacts), so may not parse; rather than risk showing
+// a credential in one, it's replaced whole.
+func censorURL(original string) string {
+	censored, err := mutateURL(original, true)
+	if err != nil {
+		return unparsableURL
+	}
+	return censored
+}
+
+const unparsableURL = "(unparsable URL, redacted)"
 
 // After my first look at the output and seeing the options returned, I
 // realized that they were being sorted and what we were logging was now
 // sufficiently far enough from what we were sending that it would cause debug
 // problems in future.  So, we also have a normalize approach, to keep the
 // two at least consistent.
-func normalizeURL(original string) string { return mutateURL(original, false) }
-
-func mutateURL(original string, mutate bool) string {
-	// We construct the URL from internal data, so any parse errors are coding
-	// bugs to be fixed.  This applies to original URL parse and query-string
-	// parse below.
+//
+// We construct the URL from internal data, so any parse errors are coding
+// bugs to be fixed.
+func normalizeURL(original string) string {
+	normal, err := mutateURL(original, false)
+	if err != nil {
+		panic(err)
+	}
+	return normal
+}
 
+func mutateURL(original string, mutate bool) (string, error) {
 	safe, err := url.Parse(original)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	if safe.User != nil {
@@ -473,14 +2808,21 @@ func mutateURL(original string, mutate bool) string {
 		}
 	}
 	if safe.RawQuery == "" {
-		return safe.String()
+		return safe.String(), nil
 	}
 
 	values, err := url.ParseQuery(safe.RawQuery)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	changed := false
+	// Drop empty parameters, so that optional template fields vanish.
+	for k, v := range values {
+		if len(v) == 1 && v[0] == "" {
+			values.Del(k)
+			changed = true
+		}
+	}
 	for _, censor := range censorURLfields {
 		if v := values.Get(censor); v != "" {
 			if mutate {
@@ -493,5 +2835,5 @@ func mutateURL(original string, mutate bool) string {
 		safe.RawQuery = values.Encode()
 	}
 
-	return safe.String()
+	return safe.String(), nil
 }
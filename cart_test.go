@@ -1,6 +1,26 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
 
 func Test_gitProject(t *testing.T) {
 	if userProject := gitProject("https://github.com/nbio/cart"); userProject != "nbio/cart" {
@@ -11,3 +31,1323 @@ func Test_gitProject(t *testing.T) {
 	}
 	// TODO: recognize other Git hosts
 }
+
+func Test_gitProjectMatching(t *testing.T) {
+	re, err := compileRepoRegex(`^ssh://git@mirror\.internal/scm/([^/]+/[^/]+?)(?:\.git)?$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gitProjectMatching(re, "ssh://git@mirror.internal/scm/nbio/cart.git"); got != "nbio/cart" {
+		t.Errorf("Expected %q, got %q", "nbio/cart", got)
+	}
+	if got := gitProjectMatching(re, "https://github.com/nbio/cart"); got != "" {
+		t.Errorf("Expected no match, got %q", got)
+	}
+
+	for _, pattern := range []string{`mirror/[^/]+/[^/]+`, `(\w+)/(\w+)`, `(unclosed`} {
+		if _, err := compileRepoRegex(pattern); err == nil {
+			t.Errorf("%s: Expected error", pattern)
+		}
+	}
+}
+
+func Test_filterArtifacts(t *testing.T) {
+	artifacts := []artifact{
+		{Path: "bin/linux/cart", NodeIndex: 0},
+		{Path: "bin/darwin/cart", NodeIndex: 0},
+		{Path: "bin/linux/cart", NodeIndex: 1},
+		{Path: "test/results.xml", NodeIndex: 1},
+	}
+	for _, tc := range []struct {
+		filter ArtifactFilter
+		want   []int
+	}{
+		{ArtifactFilter{}, []int{0, 1, 2, 3}},
+		{ArtifactFilter{nodes: nodeSet{1}}, []int{2, 3}},
+		{ArtifactFilter{pathPrefix: "bin/"}, []int{0, 1, 2}},
+		{ArtifactFilter{nodes: nodeSet{1}, pathPrefix: "bin/"}, []int{2}},
+		{ArtifactFilter{nodes: nodeSet{0}, pathPrefix: "bin/", pattern: "bin/darwin/*", patternFull: true}, []int{1}},
+		{ArtifactFilter{nodes: nodeSet{0}, pathPrefix: "test/"}, nil},
+	} {
+		got := filterArtifacts(artifacts, tc.filter)
+		if len(got) != len(tc.want) {
+			t.Errorf("%+v: Expected %d artifacts, got %d", tc.filter, len(tc.want), len(got))
+			continue
+		}
+		for i, j := range tc.want {
+			if got[i] != artifacts[j] {
+				t.Errorf("%+v: Expected [%d] %+v, got %+v", tc.filter, i, artifacts[j], got[i])
+			}
+		}
+	}
+}
+
+func Test_pickBuildIncludeRunning(t *testing.T) {
+	flow := func(job, id string) *workflow {
+		return &workflow{JobName: job, WorkflowName: "commit", WorkflowID: id}
+	}
+	builds := []build{
+		{BuildNum: 13, Outcome: "", Workflows: flow("deploy", "w2")},
+		{BuildNum: 12, Outcome: "running", Workflows: flow("build", "w2")},
+		{BuildNum: 11, Outcome: "success", Workflows: flow("build", "w1")},
+	}
+	filter := FilterSet{workflow: "commit", jobname: "build"}
+	has := map[int]bool{12: true}
+	hasArtifact := func(b build) (bool, error) { return has[b.BuildNum], nil }
+
+	if i, err := pickBuild(builds, filter, hasArtifact); err != nil || builds[i].BuildNum != 11 {
+		t.Errorf("without -include-running: Expected build 11, got %d (%v)", i, err)
+	}
+
+	filter.includeRunning = true
+	if i, err := pickBuild(builds, filter, hasArtifact); err != nil || builds[i].BuildNum != 12 {
+		t.Errorf("running build with artifact: Expected build 12, got %d (%v)", i, err)
+	}
+
+	has[12] = false
+	if i, err := pickBuild(builds, filter, hasArtifact); err != nil || builds[i].BuildNum != 11 {
+		t.Errorf("running build without artifact: Expected build 11, got %d (%v)", i, err)
+	}
+}
+
+func Test_pickBuildLatestOnly(t *testing.T) {
+	builds := []build{
+		{BuildNum: 15, Outcome: "success", Workflows: &workflow{JobName: "deploy", WorkflowName: "commit", WorkflowID: "w3"}},
+		{BuildNum: 14, Outcome: "failed", Workflows: &workflow{JobName: "build", WorkflowName: "commit", WorkflowID: "w3"}},
+		{BuildNum: 13, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "nightly", WorkflowID: "w2"}},
+		{BuildNum: 12, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "commit", WorkflowID: "w1"}},
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+
+	// Latched to the latest run of commit, w3, whose build failed.
+	if i, err := pickBuild(builds, FilterSet{workflow: "commit", jobname: "build"}, noArtifact); err == nil {
+		t.Errorf("latched: Expected no build, got %d", builds[i].BuildNum)
+	}
+	if i, err := pickBuild(builds, FilterSet{workflow: "commit", jobname: "build", anyFlowID: true}, noArtifact); err != nil || builds[i].BuildNum != 12 {
+		t.Errorf("-ignore-later-workflows: Expected build 12 of commit, got %d (%v)", i, err)
+	}
+	// -latest-only overrides the -workflow, and so the latching.
+	if i, err := pickBuild(builds, FilterSet{workflow: "commit", jobname: "build", latestOnly: true}, noArtifact); err != nil || builds[i].BuildNum != 13 {
+		t.Errorf("-latest-only: Expected build 13, of any workflow, got %d (%v)", i, err)
+	}
+}
+
+func Test_BuildListURL(t *testing.T) {
+	for _, tc := range []struct {
+		opts URLOptions
+		want string
+	}{
+		{
+			URLOptions{Project: "nbio/cart", Branch: "master", Limit: 10, Filter: "successful"},
+			"https://circleci.com/api/v1.1/project/github/nbio/cart/tree/master?filter=successful&limit=10",
+		},
+		{
+			URLOptions{Project: "nbio/cart", Branch: "feature1", Limit: 3},
+			"https://circleci.com/api/v1.1/project/github/nbio/cart/tree/feature1?limit=3",
+		},
+		{
+			URLOptions{Project: "nbio/cart", Limit: 30, Filter: "successful"},
+			"https://circleci.com/api/v1.1/project/github/nbio/cart?filter=successful&limit=30",
+		},
+		{
+			URLOptions{Host: "https://circle.example.com/", Project: "nbio/cart", Branch: "main", Limit: 10, Filter: "successful"},
+			"https://circle.example.com/api/v1.1/project/github/nbio/cart/tree/main?filter=successful&limit=10",
+		},
+		{
+			URLOptions{Project: "nbio/cart", Branch: "master", Limit: 100, Offset: 50, Filter: "failed"},
+			"https://circleci.com/api/v1.1/project/github/nbio/cart/tree/master?filter=failed&limit=100&offset=50",
+		},
+	} {
+		u, err := BuildListURL(tc.opts)
+		if err != nil {
+			t.Errorf("%+v: %s", tc.opts, err)
+			continue
+		}
+		if u.String() != tc.want {
+			t.Errorf("Expected %q, got %q", tc.want, u)
+		}
+	}
+
+	for _, opts := range []URLOptions{
+		{Project: "nbio/cart", Limit: 0},
+		{Project: "nbio/cart", Limit: 101},
+		{Project: "nbio/cart", Limit: 10, Offset: -1},
+		{Project: "nbio/cart", Limit: 10, Filter: "succesful"},
+	} {
+		if _, err := BuildListURL(opts); err == nil {
+			t.Errorf("%+v: Expected error", opts)
+		}
+	}
+}
+
+func Test_ArtifactsURL(t *testing.T) {
+	for _, tc := range []struct {
+		opts URLOptions
+		want string
+	}{
+		{
+			URLOptions{Project: "nbio/cart", BuildNum: 42},
+			"https://circleci.com/api/v1.1/project/github/nbio/cart/42/artifacts",
+		},
+		{
+			URLOptions{Host: "https://circle.example.com", Project: "nbio/cart", BuildNum: 7},
+			"https://circle.example.com/api/v1.1/project/github/nbio/cart/7/artifacts",
+		},
+	} {
+		u, err := ArtifactsURL(tc.opts)
+		if err != nil {
+			t.Errorf("%+v: %s", tc.opts, err)
+			continue
+		}
+		if u.String() != tc.want {
+			t.Errorf("Expected %q, got %q", tc.want, u)
+		}
+	}
+
+	if _, err := ArtifactsURL(URLOptions{Host: "circle.example.com", Project: "nbio/cart"}); err == nil {
+		t.Errorf("Expected error for host without scheme")
+	}
+}
+
+func Test_checkMinArtifacts(t *testing.T) {
+	artifacts := []artifact{{Path: "linux/cart"}, {Path: "darwin/cart"}}
+	if err := checkMinArtifacts(artifacts, 3); err == nil {
+		t.Errorf("Expected error for 2 artifacts with minimum 3")
+	}
+	if err := checkMinArtifacts(artifacts, 2); err != nil {
+		t.Errorf("Expected no error for 2 artifacts with minimum 2, got %s", err)
+	}
+	if err := checkMinArtifacts(nil, 0); err != nil {
+		t.Errorf("Expected no error without a minimum, got %s", err)
+	}
+}
+
+func Test_artifactCount(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"path": "bin/cart-linux", "node_index": 0}, {"path": "bin/cart-darwin", "node_index": 0},
+			{"path": "logs/test.log", "node_index": 1}]`)
+	}))
+	defer ts.Close()
+
+	defer func(o Output, d io.Writer, v int) { output, diag, verbosity = o, d, v }(output, diag, verbosity)
+	out, errs := new(bytes.Buffer), new(bytes.Buffer)
+	output.Out, diag, verbosity = out, errs, 3
+
+	artifacts, err := fetchBuildArtifacts(context.Background(), URLOptions{Host: ts.URL, Project: "nbio/cart", BuildNum: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		filter ArtifactFilter
+		want   string
+	}{
+		{ArtifactFilter{}, "3\n"},
+		{ArtifactFilter{pathPrefix: "bin/"}, "2\n"},
+		{ArtifactFilter{pattern: "*.apk"}, "0\n"},
+	} {
+		out.Reset()
+		if err := writeArtifactCount(output.Out, filterArtifacts(artifacts, tc.filter)); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tc.want {
+			t.Errorf("%+v: Expected just %q on stdout, got %q", tc.filter, tc.want, out)
+		}
+	}
+	if !strings.Contains(errs.String(), "Artifact list:") {
+		t.Errorf("Expected diagnostics on the other stream, got %q", errs)
+	}
+}
+
+func Test_sortArtifacts(t *testing.T) {
+	artifacts := []artifact{
+		{Path: "c.txt", NodeIndex: 1, URL: "u1"},
+		{Path: "a.txt", NodeIndex: 0, URL: "u2"},
+		{Path: "b.txt", NodeIndex: 1, URL: "u3"},
+		{Path: "a.txt", NodeIndex: 2, URL: "u4"},
+	}
+	sizes := map[string]int64{"u1": 30, "u2": 10, "u3": 20, "u4": 5}
+	sizeOf := func(a artifact) int64 { return sizes[a.URL] }
+	for _, tc := range []struct {
+		key  string
+		want []string
+	}{
+		{"path", []string{"u2", "u4", "u3", "u1"}},
+		{"node", []string{"u2", "u1", "u3", "u4"}},
+		{"size", []string{"u4", "u2", "u3", "u1"}},
+	} {
+		sorted := append([]artifact(nil), artifacts...)
+		sortArtifacts(sorted, tc.key, sizeOf)
+		var got []string
+		for _, a := range sorted {
+			got = append(got, a.URL)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: Expected %v, got %v", tc.key, tc.want, got)
+		}
+	}
+}
+
+func Test_writeArtifactListLong(t *testing.T) {
+	b := build{BuildNum: 42, Revision: "0123456789abcdef"}
+	artifacts := []artifact{
+		{Path: "bin/cart", URL: "https://example.com/bin/cart", build: &b},
+		{Path: "bin/other", URL: "https://example.com/bin/other"},
+	}
+
+	short := new(bytes.Buffer)
+	writeArtifactList(short, artifacts, false)
+	if want := "[0] node_index 0: path \"bin/cart\" URL \"https://example.com/bin/cart\"\n"; !strings.HasPrefix(short.String(), want) {
+		t.Errorf("Expected %q, got %q", want, short.String())
+	}
+
+	long := new(bytes.Buffer)
+	writeArtifactList(long, artifacts, true)
+	lines := strings.Split(strings.TrimSpace(long.String()), "\n")
+	if want := "42 0123456 [0] node_index 0: path \"bin/cart\""; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("Expected %q, got %q", want, lines[0])
+	}
+	if want := "- - [1] "; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("Expected %q, got %q", want, lines[1])
+	}
+}
+
+func Test_writeArtifactGroups(t *testing.T) {
+	artifacts := []artifact{
+		{Path: "junit/b.xml", URL: "https://example.com/1/junit/b.xml", NodeIndex: 1},
+		{Path: "junit/a.xml", URL: "https://example.com/0/junit/a.xml", NodeIndex: 0},
+		{Path: "junit/c.xml", URL: "https://example.com/1/junit/c.xml", NodeIndex: 1},
+	}
+	var buf bytes.Buffer
+	writeArtifactGroups(&buf, artifacts, false)
+	want := `node 0: 1 artifact
+  [0] node_index 0: path "junit/a.xml" URL "https://example.com/0/junit/a.xml"
+node 1: 2 artifacts
+  [0] node_index 1: path "junit/b.xml" URL "https://example.com/1/junit/b.xml"
+  [1] node_index 1: path "junit/c.xml" URL "https://example.com/1/junit/c.xml"
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if artifacts[0].NodeIndex != 1 {
+		t.Errorf("Expected the artifacts left in their order")
+	}
+}
+
+func Test_writeArtifactCommands(t *testing.T) {
+	circleToken = "secret-token"
+	defer func() { circleToken = "" }()
+	artifacts := []artifact{
+		{Path: "bin/cart", URL: "https://example.com/0/bin/cart", build: &build{BuildNum: 42}},
+		{Path: "docs/it's here.txt", URL: "https://example.com/0/docs/it's here.txt", build: &build{BuildNum: 43}},
+	}
+	var buf bytes.Buffer
+	writeArtifactCommands(&buf, artifacts, URLOptions{Project: "nbio/cart", Host: "https://circleci.example.com"})
+	want := `cart -repo nbio/cart -host https://circleci.example.com -build 42 bin/cart
+cart -repo nbio/cart -host https://circleci.example.com -build 43 'docs/it'\''s here.txt'
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if strings.Contains(buf.String(), circleToken) {
+		t.Errorf("Expected no token, got %q", buf.String())
+	}
+
+	buf.Reset()
+	writeArtifactCommands(&buf, artifacts[:1], URLOptions{Project: "nbio/cart", Host: defaultHost})
+	if got, want := buf.String(), "cart -repo nbio/cart -build 42 bin/cart\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// The same path on several nodes, or one on a node other than 0.
+	b := &build{BuildNum: 44}
+	artifacts = []artifact{
+		{Path: "test/results.xml", NodeIndex: 0, build: b},
+		{Path: "test/results.xml", NodeIndex: 1, build: b},
+		{Path: "coverage.out", NodeIndex: 1, build: b},
+	}
+	buf.Reset()
+	writeArtifactCommands(&buf, artifacts, URLOptions{Project: "nbio/cart", Host: defaultHost})
+	want = `cart -repo nbio/cart -build 44 -node 0 test/results.xml
+cart -repo nbio/cart -build 44 -node 1 test/results.xml
+cart -repo nbio/cart -build 44 -node 1 coverage.out
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func Test_writeArtifactURLs(t *testing.T) {
+	defer func(s string) { circleToken = s }(circleToken)
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+	circleToken = "secret-token"
+	trustedHosts = []string{"circle.example.com"}
+	artifacts := []artifact{
+		{Path: "bin/linux/cart", NodeIndex: 0, URL: "https://circle.example.com/0/bin/linux/cart"},
+		{Path: "bin/darwin/cart", NodeIndex: 1, URL: "https://circle.example.com/1/bin/darwin/cart"},
+		{Path: "test/results.xml", NodeIndex: 1, URL: "https://circle.example.com/1/test/results.xml"},
+	}
+	listed := filterArtifacts(artifacts, ArtifactFilter{nodes: nodeSet{1}, pathPrefix: "bin/"})
+
+	var buf bytes.Buffer
+	if err := writeArtifactURLs(&buf, listed, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "https://circle.example.com/1/bin/darwin/cart\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	buf.Reset()
+	if err := writeArtifactURLs(&buf, artifacts[:1], true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "https://circle.example.com/0/bin/linux/cart?circle-token=secret-token\n"; got != want {
+		t.Errorf("-with-token: Expected %q, got %q", want, got)
+	}
+}
+
+func Test_filterArtifactsPattern(t *testing.T) {
+	artifacts := []artifact{
+		{Path: "app/build/outputs/app-release.apk"},
+		{Path: "app/build/outputs/mapping.txt"},
+		{Path: "lib/build/outputs/lib-release.apk"},
+	}
+	for _, tc := range []struct {
+		filter ArtifactFilter
+		want   int
+	}{
+		{ArtifactFilter{pattern: "*.apk"}, 2},
+		{ArtifactFilter{pattern: "*.apk", patternFull: true}, 0},
+		{ArtifactFilter{pattern: "app/*/*/*.apk", patternFull: true}, 1},
+		{ArtifactFilter{pattern: "app/*/*/*.apk"}, 0},
+	} {
+		if got := filterArtifacts(artifacts, tc.filter); len(got) != tc.want {
+			t.Errorf("%+v: Expected %d artifacts, got %d", tc.filter, tc.want, len(got))
+		}
+	}
+}
+
+func Test_pickBuildSinceRev(t *testing.T) {
+	flow := func(job, id string) *workflow {
+		return &workflow{JobName: job, WorkflowName: "commit", WorkflowID: id}
+	}
+	builds := []build{
+		{BuildNum: 16, Outcome: "success", Revision: "eeeeeeeeee", Workflows: flow("build", "w5")},
+		{BuildNum: 15, Outcome: "failed", Revision: "dddddddddd", Workflows: flow("build", "w4")},
+		{BuildNum: 14, Outcome: "success", Revision: "cccccccccc", Workflows: flow("deploy", "w3")},
+		{BuildNum: 13, Outcome: "success", Revision: "cccccccccc", Workflows: flow("build", "w3")},
+		{BuildNum: 12, Outcome: "success", Revision: "bbbbbbbbbb", Workflows: flow("build", "w2")},
+		{BuildNum: 11, Outcome: "success", Revision: "aaaaaaaaaa", Workflows: flow("build", "w1")},
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+
+	for _, tc := range []struct {
+		rev  string
+		want int
+	}{
+		{"bbbbbbb", 13},
+		{"aaaaaaa", 12},
+		{"ccccccc", 16},
+	} {
+		filter := FilterSet{workflow: "commit", jobname: "build", sinceRev: tc.rev}
+		if i, err := pickBuild(builds, filter, noArtifact); err != nil || builds[i].BuildNum != tc.want {
+			t.Errorf("since %s: Expected build %d, got %d (%v)", tc.rev, tc.want, i, err)
+		}
+	}
+
+	filter := FilterSet{workflow: "commit", jobname: "build", sinceRev: "eeeeeee"}
+	if i, err := pickBuild(builds, filter, noArtifact); err == nil {
+		t.Errorf("since newest: Expected error, got build %d", builds[i].BuildNum)
+	}
+	filter.sinceRev = "fffffff"
+	if i, err := pickBuild(builds, filter, noArtifact); err == nil {
+		t.Errorf("since unknown revision: Expected error, got build %d", builds[i].BuildNum)
+	}
+}
+
+func Test_requireArtifact(t *testing.T) {
+	defer func(f ArtifactFilter) { artFilter = f }(artFilter)
+	artFilter = ArtifactFilter{}
+	var lists []string
+	unauthorized := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1.1/project/github/nbio/cart/tree/master":
+			io.WriteString(w, `[{"build_num": 44, "vcs_revision": "2222222222222222", "outcome": "success"},
+				{"build_num": 43, "vcs_revision": "1111111111111111", "outcome": "failed"},
+				{"build_num": 42, "vcs_revision": "0123456789abcdef", "outcome": "success"},
+				{"build_num": 41, "vcs_revision": "0000000000000000", "outcome": "success"}]`)
+		case "/api/v1.1/project/github/nbio/cart/44/artifacts":
+			lists = append(lists, "44")
+			if unauthorized {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			io.WriteString(w, `[{"path": "docs/index.html", "url": "https://example.com/0/docs/index.html"}]`)
+		case "/api/v1.1/project/github/nbio/cart/42/artifacts":
+			lists = append(lists, "42")
+			io.WriteString(w, `[{"path": "bin/cart", "url": "https://example.com/0/bin/cart"}]`)
+		case "/api/v1.1/project/github/nbio/cart/41/artifacts":
+			io.WriteString(w, `[]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10}
+	found, _, err := circleFindBuild(opts, FilterSet{branch: "master"}, "bin/cart")
+	if err != nil || found.BuildNum != 44 {
+		t.Errorf("Expected the latest green build, 44, without -require-artifact, got %d (%v)", found.BuildNum, err)
+	}
+	if len(lists) != 0 {
+		t.Errorf("Expected no artifact lists fetched, got %v", lists)
+	}
+	found, _, err = circleFindBuild(opts, FilterSet{branch: "master", requireArtifact: true}, "bin/cart")
+	if err != nil || found.BuildNum != 42 {
+		t.Errorf("Expected build 42, the latest with the artifact, got %d (%v)", found.BuildNum, err)
+	}
+	if strings.Join(lists, ",") != "44,42" {
+		t.Errorf("Expected the lists of 44 and 42 fetched, not the failed 43 nor 41, got %v", lists)
+	}
+	if _, _, err = circleFindBuild(opts, FilterSet{branch: "master", requireArtifact: true}, "bin/other"); err == nil {
+		t.Errorf("Expected no build with an artifact which none has")
+	}
+
+	// Failing to list the latest build's artifacts ends the search, rather
+	// than settling for an older build.
+	unauthorized = true
+	found, _, err = circleFindBuild(opts, FilterSet{branch: "master", requireArtifact: true}, "bin/cart")
+	if err == nil || !strings.Contains(err.Error(), "build 44") {
+		t.Errorf("Expected the failed artifact list of build 44 to fail, got build %d (%v)", found.BuildNum, err)
+	}
+}
+
+func Test_plainHTTPHost(t *testing.T) {
+	const payload = "#!/bin/sh\n"
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1.1/project/github/nbio/cart/tree/master":
+			io.WriteString(w, `[{"build_num": 42, "vcs_revision": "0123456789abcdef", "outcome": "success"}]`)
+		case "/api/v1.1/project/github/nbio/cart/42/artifacts":
+			fmt.Fprintf(w, `[{"path": "bin/cart", "url": "%s/artifacts/0/bin/cart"}]`, ts.URL)
+		case "/artifacts/0/bin/cart":
+			io.WriteString(w, payload)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10, Filter: "successful"}
+	found, _, err := circleFindBuild(opts, FilterSet{branch: "master"}, "bin/cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.BuildNum = found.BuildNum; opts.BuildNum != 42 {
+		t.Fatalf("Expected build 42, got %d", opts.BuildNum)
+	}
+	u, err := ArtifactsURL(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifacts, err := fetchArtifacts(context.Background(), u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "cart")
+	if n, err := downloadArtifact(artifacts, "bin/cart", out); err != nil || n != int64(len(payload)) {
+		t.Fatalf("Expected %d bytes, got %d (%v)", len(payload), n, err)
+	}
+	if b, err := os.ReadFile(out); err != nil || string(b) != payload {
+		t.Errorf("Expected %q, got %q (%v)", payload, b, err)
+	}
+
+	if err := checkHost("ftp://127.0.0.1"); err == nil {
+		t.Errorf("Expected error for ftp scheme")
+	}
+}
+
+func Test_downloadArtifactThroughput(t *testing.T) {
+	payload := strings.Repeat("x", 64<<10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, payload)
+	}))
+	defer ts.Close()
+
+	defer func(v int, w io.Writer) { verbosity, diag = v, w }(verbosity, diag)
+	out := new(bytes.Buffer)
+	verbosity, diag = 1, out
+
+	artifacts := []artifact{{URL: ts.URL + "/blob.bin", Path: "blob.bin"}}
+	if _, err := downloadArtifact(artifacts, "blob.bin", filepath.Join(t.TempDir(), "blob.bin")); err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(`downloaded blob\.bin \(65536 bytes\) in \S+ \([0-9.-]+ MB/s\)`)
+	if !want.MatchString(out.String()) {
+		t.Errorf("Expected throughput line, got %q", out.String())
+	}
+
+	out.Reset()
+	verbosity = 0
+	if _, err := downloadArtifact(artifacts, "blob.bin", filepath.Join(t.TempDir(), "blob.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "downloaded") {
+		t.Errorf("Expected no throughput line without -v, got %q", out.String())
+	}
+}
+
+func Test_downloadArtifactRedirected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0/bin/cart" {
+			// as to a storage bucket, by key, not by the artifact's path
+			http.Redirect(w, r, "/storage/7f3a9c?sig=abc", http.StatusFound)
+			return
+		}
+		io.WriteString(w, "binary")
+	}))
+	defer ts.Close()
+
+	defer func(w io.Writer) { diag = w }(diag)
+	diag = io.Discard
+	artifacts := []artifact{
+		{URL: ts.URL + "/0/bin/cart.sig", Path: "bin/cart.sig"},
+		{URL: ts.URL + "/0/bin/cart", Path: "bin/cart"},
+	}
+	out := filepath.Join(t.TempDir(), "cart")
+	n, err := downloadArtifact(artifacts, "bin/cart", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(out); n != 6 || string(b) != "binary" {
+		t.Errorf("Expected the redirected download, got %d bytes %q", n, b)
+	}
+	if a, ok := findArtifact(artifacts, "bin/cart"); !ok || a.Path != "bin/cart" {
+		t.Errorf("Expected bin/cart found by its listed path, got %+v", a)
+	}
+}
+
+func Test_rejectEmpty(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0/full.txt" {
+			io.WriteString(w, "full")
+		}
+	}))
+	defer ts.Close()
+
+	defer func(w io.Writer) { diag = w }(diag)
+	diag = io.Discard
+	artifacts := []artifact{
+		{URL: ts.URL + "/0/empty.txt", Path: "empty.txt"},
+		{URL: ts.URL + "/0/full.txt", Path: "full.txt"},
+	}
+	dir := t.TempDir()
+
+	out := filepath.Join(dir, "empty.txt")
+	n, err := downloadArtifact(artifacts, "empty.txt", out)
+	if err != nil || n != 0 {
+		t.Fatalf("Expected an empty download, got %d bytes (%v)", n, err)
+	}
+	if err := rejectEmpty("empty.txt", out, n); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("Expected the empty artifact to fail, got %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("Expected the empty file removed, got %v", err)
+	}
+	if err := rejectEmpty("empty.txt", os.DevNull, 0); err == nil || strings.Contains(err.Error(), "removed") {
+		t.Errorf("Expected the empty artifact to fail without removing %s, got %v", os.DevNull, err)
+	}
+	if _, err := os.Stat(os.DevNull); err != nil {
+		t.Errorf("Expected %s kept, got %v", os.DevNull, err)
+	}
+
+	out = filepath.Join(dir, "full.txt")
+	n, err = downloadArtifact(artifacts, "full.txt", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rejectEmpty("full.txt", out, n); err != nil {
+		t.Errorf("Expected a non-empty artifact to pass, got %v", err)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("Expected the file kept, got %v", err)
+	}
+}
+
+func Test_saveArtifactGzip(t *testing.T) {
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	io.WriteString(zw, "plain text, stored gzipped")
+	zw.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	}))
+	defer ts.Close()
+
+	defer func(w io.Writer) { log.SetOutput(w) }(log.Writer())
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer func() { rawDownload = false }()
+
+	a := artifact{URL: ts.URL + "/notes.txt", Path: "notes.txt"}
+	for _, tc := range []struct {
+		raw  bool
+		want []byte
+		warn bool
+	}{
+		{false, []byte("plain text, stored gzipped"), true},
+		{true, gz.Bytes(), false},
+	} {
+		rawDownload = tc.raw
+		logs.Reset()
+		out := filepath.Join(t.TempDir(), "notes.txt")
+		if _, err := saveArtifact(a, "notes.txt", out); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(out); !bytes.Equal(got, tc.want) {
+			t.Errorf("raw %v: Expected %q, got %q", tc.raw, tc.want, got)
+		}
+		if warned := strings.Contains(logs.String(), "use -raw"); warned != tc.warn {
+			t.Errorf("raw %v: Expected warning %v, got %q", tc.raw, tc.warn, logs)
+		}
+	}
+}
+
+func Test_verifyArtifact(t *testing.T) {
+	defer func(o Output, w io.Writer) { output, diag = o, w }(output, diag)
+	var stdout, stderr bytes.Buffer
+	output.Out, diag = &stdout, &stderr
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bin/cart" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "cart binary")
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	n, sum, err := verifyArtifact(artifact{URL: ts.URL + "/bin/cart"}, "bin/cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256([]byte("cart binary"))
+	if n != 11 || sum != hex.EncodeToString(want[:]) {
+		t.Errorf("Expected 11 bytes with sha256 %x, got %d bytes with %s", want, n, sum)
+	}
+	if stdout.Len() != 0 || !strings.Contains(stderr.String(), "Verifying bin/cart") {
+		t.Errorf("Expected progress on the diagnostic writer only, got %q and %q", stdout.String(), stderr.String())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected nothing written, got %v", entries)
+	}
+
+	if _, _, err := verifyArtifact(artifact{URL: ts.URL + "/bin/gone"}, "bin/gone"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected a 404 error, got %v", err)
+	}
+}
+
+func Test_parseCircleURL(t *testing.T) {
+	for _, tc := range []struct {
+		url      string
+		project  string
+		buildNum int
+	}{
+		{"https://circleci.com/gh/nbio/cart/123", "nbio/cart", 123},
+		{"https://circleci.com/gh/nbio/cart/123/", "nbio/cart", 123},
+		{"https://app.circleci.com/pipelines/github/nbio/cart/45/workflows/0f1e2d3c-aaaa-bbbb-cccc-0123456789ab/jobs/789", "nbio/cart", 789},
+	} {
+		project, buildNum, err := parseCircleURL(tc.url)
+		if err != nil || project != tc.project || buildNum != tc.buildNum {
+			t.Errorf("%s: Expected %q %d, got %q %d (%v)", tc.url, tc.project, tc.buildNum, project, buildNum, err)
+		}
+	}
+	for _, bad := range []string{
+		"https://app.circleci.com/pipelines/github/nbio/cart/45",
+		"https://app.circleci.com/pipelines/github/nbio/cart/45/workflows/0f1e2d3c-aaaa-bbbb-cccc-0123456789ab",
+		"https://circleci.com/gh/nbio/cart/latest",
+		"https://github.com/nbio/cart",
+	} {
+		if _, _, err := parseCircleURL(bad); err == nil {
+			t.Errorf("%s: Expected error", bad)
+		}
+	}
+}
+
+func Test_pickBuildNoMatch(t *testing.T) {
+	noArtifact := func(build) (bool, error) { return false, nil }
+	filter := FilterSet{branch: "master", workflow: "commit", jobname: "build"}
+
+	_, err := pickBuild(nil, filter, noArtifact)
+	if err == nil || !strings.Contains(err.Error(), "no builds found") {
+		t.Errorf("empty list: Expected no builds found, got %v", err)
+	}
+
+	builds := []build{
+		{BuildNum: 2, Outcome: "failed", Workflows: &workflow{JobName: "build", WorkflowName: "commit"}},
+		{BuildNum: 1, Outcome: "success", Workflows: &workflow{JobName: "lint", WorkflowName: "commit"}},
+	}
+	_, err = pickBuild(builds, filter, noArtifact)
+	if err == nil || strings.Contains(err.Error(), "no builds found") || !strings.Contains(err.Error(), "-search-depth") {
+		t.Errorf("filtered list: Expected none matching with advice, got %v", err)
+	}
+}
+
+func Test_writeBuildsJSON(t *testing.T) {
+	builds := []build{
+		{BuildNum: 2, Revision: "0123456789", Outcome: "success", Subject: "Fix it",
+			Workflows: &workflow{JobName: "build", WorkflowName: "commit", WorkflowID: "w1"}},
+		{BuildNum: 1, Revision: "9876543210", Outcome: "failed"},
+	}
+	path := filepath.Join(t.TempDir(), "builds.json")
+	circleToken = "secret-token"
+	defer func() { circleToken = "" }()
+	if err := writeBuildsJSON(path, builds); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte(circleToken)) {
+		t.Errorf("Expected no token in dump, got %s", b)
+	}
+	var got struct {
+		jsonHeader
+		Builds []build `json:"builds"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.SchemaVersion != jsonSchemaVersion || got.Version == "" {
+		t.Errorf("Expected schema_version %d and a version, got %+v", jsonSchemaVersion, got.jsonHeader)
+	}
+	if !reflect.DeepEqual(got.Builds, builds) {
+		t.Errorf("Expected %+v, got %+v", builds, got.Builds)
+	}
+}
+
+func Test_fetchWorkflowArtifacts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1.1/project/github/nbio/cart/12/artifacts":
+			io.WriteString(w, `[{"path": "linux/cart", "url": "https://example.com/12/linux/cart"}]`)
+		case "/api/v1.1/project/github/nbio/cart/11/artifacts":
+			io.WriteString(w, `[{"path": "darwin/cart", "url": "https://example.com/11/darwin/cart"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	builds := []build{
+		{BuildNum: 13, Outcome: "success", Workflows: &workflow{JobName: "deploy", WorkflowID: "w2"}},
+		{BuildNum: 12, Outcome: "success", Workflows: &workflow{JobName: "build-linux", WorkflowID: "w1"}},
+		{BuildNum: 11, Outcome: "success", Workflows: &workflow{JobName: "build-darwin", WorkflowID: "w1"}},
+		{BuildNum: 10, Outcome: "failed", Workflows: &workflow{JobName: "build-windows", WorkflowID: "w1"}},
+	}
+	members := sameWorkflow(builds, "w1", FilterSet{})
+	if len(members) != 2 || members[0].BuildNum != 12 || members[1].BuildNum != 11 {
+		t.Fatalf("Expected builds 12 and 11, got %+v", members)
+	}
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart"}
+	artifacts, err := fetchWorkflowArtifacts(context.Background(), opts, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 2 || artifacts[0].Path != "linux/cart" || artifacts[1].Path != "darwin/cart" {
+		t.Errorf("Expected artifacts of both builds, got %+v", artifacts)
+	}
+}
+
+func Test_pickBuildWorkflowMatch(t *testing.T) {
+	builds := []build{
+		{BuildNum: 3, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "build-and-deploy", WorkflowID: "w3"}},
+		{BuildNum: 2, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "build", WorkflowID: "w2"}},
+		{BuildNum: 1, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "nightly", WorkflowID: "w1"}},
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+
+	for _, tc := range []struct {
+		match    string
+		workflow string
+		want     int
+	}{
+		{"exact", "build", 2},
+		{"", "build", 2},
+		{"prefix", "build", 3},
+		{"regex", "^night", 1},
+		{"regex", "deploy$", 3},
+	} {
+		filter := FilterSet{workflow: tc.workflow, workflowMatch: tc.match}
+		if err := filter.compileWorkflowMatch(); err != nil {
+			t.Fatal(err)
+		}
+		if i, err := pickBuild(builds, filter, noArtifact); err != nil || builds[i].BuildNum != tc.want {
+			t.Errorf("%s %q: Expected build %d, got %d (%v)", tc.match, tc.workflow, tc.want, i, err)
+		}
+
+		filter.strictWorkflow = true
+		_, err := pickBuild(builds, filter, noArtifact)
+		if multi := tc.match == "prefix"; (err != nil) != multi {
+			t.Errorf("%s %q strict: Expected error %t, got %v", tc.match, tc.workflow, multi, err)
+		}
+	}
+
+	if err := (&FilterSet{workflowMatch: "glob"}).compileWorkflowMatch(); err == nil {
+		t.Errorf("Expected error for unknown match mode")
+	}
+}
+
+func Test_circleFindBuildTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		io.WriteString(w, `[]`)
+	}))
+	defer ts.Close()
+
+	defer func(d time.Duration) { resolveTimeout = d }(resolveTimeout)
+	resolveTimeout = 20 * time.Millisecond
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10}
+	_, _, err := circleFindBuild(opts, FilterSet{branch: "master"}, "bin/cart")
+	if err == nil || !strings.Contains(err.Error(), "timed out after 20ms") {
+		t.Errorf("Expected resolution timeout, got %v", err)
+	}
+}
+
+func Test_artifactURL(t *testing.T) {
+	circleToken = "secret-token"
+	defer func() { circleToken = "" }()
+	a := artifact{URL: "https://output.circle-artifacts.com/output/job/abc/artifacts/0/bin/cart"}
+
+	if u, err := artifactURL(a, false); err != nil || u != a.URL {
+		t.Errorf("Expected %q, got %q (%v)", a.URL, u, err)
+	}
+	want := a.URL + "?circle-token=secret-token"
+	if u, err := artifactURL(a, true); err != nil || u != want {
+		t.Errorf("Expected %q, got %q (%v)", want, u, err)
+	}
+}
+
+func Test_pickBuildFailOnMultiple(t *testing.T) {
+	builds := []build{
+		{BuildNum: 3, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "release", WorkflowID: "w2"}},
+		{BuildNum: 2, Outcome: "success", Workflows: &workflow{JobName: "test", WorkflowName: "commit", WorkflowID: "w1"}},
+		{BuildNum: 1, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "commit", WorkflowID: "w1"}},
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+
+	filter := FilterSet{jobname: "build", failOnMultiple: true}
+	if _, err := pickBuild(builds, filter, noArtifact); err == nil || !strings.Contains(err.Error(), "3, 1") {
+		t.Errorf("two qualifying: Expected error naming builds 3 and 1, got %v", err)
+	}
+	filter.workflow = "commit"
+	if i, err := pickBuild(builds, filter, noArtifact); err != nil || builds[i].BuildNum != 1 {
+		t.Errorf("one qualifying: Expected build 1, got %d (%v)", i, err)
+	}
+}
+
+func Test_pickBuildTriggeredBy(t *testing.T) {
+	var builds []build
+	if err := json.Unmarshal([]byte(`[
+		{"build_num": 3, "outcome": "success", "user": {"login": "someone"}, "why": "github"},
+		{"build_num": 2, "outcome": "success", "user": {"login": "release-bot"}, "why": "api"},
+		{"build_num": 1, "outcome": "success", "why": "scheduled_workflow"}
+	]`), &builds); err != nil {
+		t.Fatal(err)
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+
+	for _, tc := range []struct {
+		login string
+		want  int
+	}{
+		{"", 3},
+		{"release-bot", 2},
+		{"Release-Bot", 2},
+	} {
+		filter := FilterSet{triggeredBy: tc.login}
+		if i, err := pickBuild(builds, filter, noArtifact); err != nil || builds[i].BuildNum != tc.want {
+			t.Errorf("%q: Expected build %d, got %d (%v)", tc.login, tc.want, i, err)
+		}
+	}
+	if _, err := pickBuild(builds, FilterSet{triggeredBy: "mallory"}, noArtifact); err == nil {
+		t.Errorf("Expected no build triggered by mallory")
+	}
+}
+
+func Test_writeOutcomes(t *testing.T) {
+	builds := []build{
+		{Outcome: ""}, {Outcome: "success"}, {Outcome: "failed"}, {Outcome: "success"},
+		{Outcome: "success"}, {Outcome: "canceled"}, {Outcome: "success"},
+	}
+	out := new(bytes.Buffer)
+	if err := writeOutcomes(out, "master", builds, false); err != nil {
+		t.Fatal(err)
+	}
+	want := "outcomes: branch \"master\", last 7 builds: 4 success, 1 canceled, 1 failed, 1 running\n"
+	if out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+
+	out.Reset()
+	if err := writeOutcomes(out, "master", builds, true); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		jsonHeader
+		Builds   int            `json:"builds"`
+		Outcomes map[string]int `json:"outcomes"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.SchemaVersion != jsonSchemaVersion || got.Version == "" {
+		t.Errorf("Expected schema_version %d and a version, got %+v", jsonSchemaVersion, got.jsonHeader)
+	}
+	wantTally := map[string]int{"success": 4, "failed": 1, "canceled": 1, "running": 1}
+	if got.Builds != 7 || !reflect.DeepEqual(got.Outcomes, wantTally) {
+		t.Errorf("Expected %v, got %+v", wantTally, got)
+	}
+}
+
+func Test_buildDuration(t *testing.T) {
+	b := build{BuildNum: 42, Outcome: "success", StartTime: "2024-03-01T10:00:00.250Z", StopTime: "2024-03-01T10:04:12.750Z"}
+	if d, ok := b.duration(); !ok || d != 4*time.Minute+12*time.Second+500*time.Millisecond {
+		t.Errorf("Expected 4m12.5s, got %s (%v)", d, ok)
+	}
+	for _, b := range []build{
+		{StopTime: "2024-03-01T10:04:12Z"},
+		{StartTime: "2024-03-01T10:00:00Z"}, // running
+		{StartTime: "0001-01-01T00:00:00Z", StopTime: "2024-03-01T10:04:12Z"},
+		{StartTime: "2024-03-01T10:04:12Z", StopTime: "2024-03-01T10:00:00Z"},
+		{StartTime: "yesterday", StopTime: "today"},
+	} {
+		if d, ok := b.duration(); ok {
+			t.Errorf("%+v: Expected no duration, got %s", b, d)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if err := writeOutcomes(out, "master", []build{b, {BuildNum: 43}}, true); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Durations []struct {
+			BuildNum   int    `json:"build_num"`
+			DurationMS *int64 `json:"duration_ms"`
+		} `json:"durations"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Durations) != 2 || got.Durations[0].DurationMS == nil || *got.Durations[0].DurationMS != 252500 || got.Durations[1].DurationMS != nil {
+		t.Errorf("Expected 252500ms for build 42 and none for 43, got %s", out)
+	}
+}
+
+func Test_pickBuildTag(t *testing.T) {
+	builds := []build{
+		{BuildNum: 4, Outcome: "success", Revision: "dddddddddd"},
+		{BuildNum: 3, Outcome: "success", Revision: "cccccccccc", Tag: "v1.1.0"},
+		{BuildNum: 2, Outcome: "failed", Revision: "bbbbbbbbbb", Tag: "v1.0.1"},
+		{BuildNum: 1, Outcome: "success", Revision: "aaaaaaaaaa", Tag: "v1.0.0"},
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+
+	if i, err := pickBuild(builds, FilterSet{tag: "v1.0.0"}, noArtifact); err != nil || builds[i].BuildNum != 1 {
+		t.Errorf("Expected build 1, got %d (%v)", i, err)
+	}
+	if _, err := pickBuild(builds, FilterSet{tag: "v1.0.1"}, noArtifact); err == nil || !strings.Contains(err.Error(), "tag") {
+		t.Errorf("failed tag build: Expected error naming the tag, got %v", err)
+	}
+}
+
+func Test_pickBuildBranchGlob(t *testing.T) {
+	builds := []build{
+		{BuildNum: 5, Outcome: "success", Revision: "eeeeeeeeee", Branch: "master"},
+		{BuildNum: 4, Outcome: "failed", Revision: "dddddddddd", Branch: "pr-1235"},
+		{BuildNum: 3, Outcome: "success", Revision: "cccccccccc", Branch: "feature/pr-1"},
+		{BuildNum: 2, Outcome: "success", Revision: "bbbbbbbbbb", Branch: "pr-1234"},
+		{BuildNum: 1, Outcome: "success", Revision: "aaaaaaaaaa", Branch: "pr-1233"},
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+
+	for _, tc := range []struct {
+		glob string
+		want int
+	}{
+		{"pr-*", 2},
+		{"pr-1233", 1},
+		{"feature/*", 3},
+		{"*", 5},
+	} {
+		if i, err := pickBuild(builds, FilterSet{branchGlob: tc.glob}, noArtifact); err != nil || builds[i].BuildNum != tc.want {
+			t.Errorf("%s: Expected build %d, got %d (%v)", tc.glob, tc.want, i, err)
+		}
+	}
+	if _, err := pickBuild(builds, FilterSet{branchGlob: "release-*"}, noArtifact); err == nil || !strings.Contains(err.Error(), "release-*") {
+		t.Errorf("Expected error naming the glob, got %v", err)
+	}
+}
+
+func Test_gitRemoteURLTimeout(t *testing.T) {
+	fakeGit(t, "exec sleep 10\n")
+
+	start := time.Now()
+	_, err := gitRemoteURL(50 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") || !strings.Contains(err.Error(), "-repo") {
+		t.Errorf("Expected timeout suggesting -repo, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the timeout to fire promptly, took %s", elapsed)
+	}
+}
+
+func Test_emptyResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10, Filter: "successful"}
+	_, _, err := circleFindBuild(opts, FilterSet{branch: "master"}, "bin/cart")
+	if err == nil || !strings.Contains(err.Error(), "empty response from "+ts.URL) {
+		t.Errorf("builds: Expected an empty response error, got %v", err)
+	}
+	_, err = fetchArtifacts(context.Background(), ts.URL+"/api/v1.1/project/github/nbio/cart/42/artifacts")
+	if err == nil || !strings.Contains(err.Error(), "empty response from "+ts.URL) || !strings.Contains(err.Error(), "proxy/auth") {
+		t.Errorf("artifacts: Expected an empty response error, got %v", err)
+	}
+}
+
+// fakeGit puts a git on $PATH which runs script, for the rest of the test.
+func fakeGit(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func Test_gitBranch(t *testing.T) {
+	fakeGit(t, `[ "$1" = symbolic-ref ] && echo main`)
+	if got, err := gitBranch(time.Second); err != nil || got != "main" {
+		t.Errorf("Expected main, got %q, %v", got, err)
+	}
+
+	// no symbolic-ref
+	fakeGit(t, `[ "$1" = rev-parse ] && echo trunk || exit 1`)
+	if got, err := gitBranch(time.Second); err != nil || got != "trunk" {
+		t.Errorf("Expected trunk from rev-parse, got %q, %v", got, err)
+	}
+
+	// detached HEAD
+	fakeGit(t, `[ "$1" = rev-parse ] && echo HEAD || exit 128`)
+	if got, err := gitBranch(time.Second); err == nil {
+		t.Errorf("Expected an error on a detached HEAD, got %q", got)
+	}
+
+	fakeGit(t, "exit 128")
+	if _, err := gitBranch(time.Second); err == nil {
+		t.Errorf("Expected an error outside a checkout")
+	}
+}
+
+// errWriter fails every write, to check that flush errors surface.
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, io.ErrShortWrite }
+
+func Test_copyBuffered(t *testing.T) {
+	var out bytes.Buffer
+	payload := strings.Repeat("0123456789", 1000)
+	if n, err := copyBuffered(&out, strings.NewReader(payload), 4096); err != nil || n != int64(len(payload)) || out.String() != payload {
+		t.Errorf("Expected %d bytes copied, got %d (%v)", len(payload), n, err)
+	}
+	// Everything fits in the buffer, so only Flush can see the error.
+	if _, err := copyBuffered(errWriter{}, strings.NewReader("small"), 4096); err == nil {
+		t.Errorf("Expected the flush error to be surfaced")
+	}
+}
+
+// smallReads returns its payload a few bytes at a time, as some servers do.
+type smallReads struct{ r io.Reader }
+
+func (s smallReads) Read(p []byte) (int, error) {
+	if len(p) > 512 {
+		p = p[:512]
+	}
+	return s.r.Read(p)
+}
+
+func benchmarkCopy(b *testing.B, size int) {
+	payload := bytes.Repeat([]byte("x"), 256<<10)
+	f, err := os.Create(filepath.Join(b.TempDir(), "out"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		src := smallReads{bytes.NewReader(payload)}
+		if size > 0 {
+			_, err = copyBuffered(f, src, size)
+		} else {
+			_, err = io.Copy(struct{ io.Writer }{f}, src)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyUnbuffered(b *testing.B) { benchmarkCopy(b, 0) }
+func BenchmarkCopyBuffered(b *testing.B)   { benchmarkCopy(b, defaultBufferSize) }
+
+func Test_resolveOnlyStdout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"build_num": 42, "vcs_revision": "0123456789abcdef", "outcome": "success",
+			"workflows": {"job_name": "build", "workflow_name": "commit", "workflow_id": "w1"}}]`)
+	}))
+	defer ts.Close()
+
+	defer func(o Output, d io.Writer, v int) { output, diag, verbosity = o, d, v }(output, diag, verbosity)
+	out, errs := new(bytes.Buffer), new(bytes.Buffer)
+	output.Out, diag, verbosity = out, errs, 3
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10}
+	found, _, err := circleFindBuild(opts, FilterSet{branch: "master", workflow: "commit"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeResolved(output.Out, found.BuildNum); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "42\n" {
+		t.Errorf("Expected only the build number on stdout, got %q", out)
+	}
+	if !strings.Contains(errs.String(), "build: 42") {
+		t.Errorf("Expected diagnostics on the other stream, got %q", errs)
+	}
+}
+
+func Test_pickBuildWorkflowPreference(t *testing.T) {
+	builds := []build{
+		{BuildNum: 4, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "pr", WorkflowID: "w3"}},
+		{BuildNum: 3, Outcome: "failed", Workflows: &workflow{JobName: "build", WorkflowName: "main", WorkflowID: "w2"}},
+		{BuildNum: 2, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "pr", WorkflowID: "w1"}},
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+	defer func(d *decisionLog) { decisions = d }(decisions)
+	decisions = &decisionLog{}
+
+	filter := FilterSet{workflow: "main, pr", jobname: "build"}
+	i, err := pickBuild(builds, filter, noArtifact)
+	if err != nil || builds[i].BuildNum != 4 {
+		t.Errorf("Expected build 4 of workflow pr, got %d (%v)", i, err)
+	}
+	if decisions.Workflow != "pr" {
+		t.Errorf("Expected workflow %q reported, got %q", "pr", decisions.Workflow)
+	}
+	if len(decisions.Considered) != 1 || decisions.Considered[0].BuildNum != 4 {
+		t.Errorf("Expected only the pr search considered, got %+v", decisions.Considered)
+	}
+
+	builds[1].Outcome = "success"
+	if i, err := pickBuild(builds, filter, noArtifact); err != nil || builds[i].BuildNum != 3 {
+		t.Errorf("Expected build 3 of workflow main, got %d (%v)", i, err)
+	}
+
+	filter.workflow = "nightly,release"
+	if _, err := pickBuild(builds, filter, noArtifact); err == nil || !strings.Contains(err.Error(), "none of the workflows") {
+		t.Errorf("Expected no workflow to qualify, got %v", err)
+	}
+}
+
+func Test_rawBuild(t *testing.T) {
+	circleToken = "secret-token"
+	defer func() { circleToken = "" }()
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+
+	const raw = `{"build_num":42,"unknown_field":{"nested":[1,2]},"build_url":"https://circleci.com/gh/nbio/cart/42?circle-token=secret-token"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1.1/project/github/nbio/cart/42" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, raw)
+	}))
+	defer ts.Close()
+	trustedHosts = defaultTrustedHosts(ts.URL)
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", BuildNum: 42}
+	body, err := fetchRawBuild(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writeRawBuild(&out, body); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.ReplaceAll(raw, "secret-token", redacted) + "\n"; out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+
+	opts.BuildNum = 43
+	if _, err := fetchRawBuild(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected 404 for a missing build, got %v", err)
+	}
+}
+
+func Test_pickBuildWorkflowLess(t *testing.T) {
+	defer func(w io.Writer) { diag = w }(diag)
+	out := new(bytes.Buffer)
+	diag = out
+
+	// The first build has a workflow but failed; the second has no
+	// "workflows" key at all.
+	var builds []build
+	if err := json.Unmarshal([]byte(`[
+		{"build_num": 3, "outcome": "failed", "workflows": {"job_name": "build", "workflow_name": "commit", "workflow_id": "w2"}},
+		{"build_num": 2, "outcome": "success"},
+		{"build_num": 1, "outcome": "success", "workflows": {"job_name": "build", "workflow_name": "commit", "workflow_id": "w1"}}
+	]`), &builds); err != nil {
+		t.Fatal(err)
+	}
+	noArtifact := func(build) (bool, error) { return false, nil }
+
+	i, err := pickBuild(builds, FilterSet{}, noArtifact)
+	if err != nil || builds[i].BuildNum != 2 {
+		t.Fatalf("no filters: Expected build 2, got %d (%v)", i, err)
+	}
+	if want := "workflow-less on branch \"\" found build 2 at offset 1\n"; !strings.HasSuffix(out.String(), want) {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+	for _, filter := range []FilterSet{{workflow: "commit"}, {jobname: "build"}} {
+		if i, err := pickBuild(builds, filter, noArtifact); err != nil || builds[i].BuildNum != 1 {
+			t.Errorf("%+v: Expected build 1, got %d (%v)", filter, i, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With -cas-dir, the artifact is stored by content, at
+// <cas-dir>/<first 2 hex digits>/<sha256>, rather than at an output path, so
+// that identical artifacts of several builds are kept once.  Which artifact
+// of which build has which hash is appended to <cas-dir>/index.jsonl.
+
+var casDir string
+
+type casEntry struct {
+	SHA256   string    `json:"sha256"`
+	Build    int       `json:"build_num"`
+	Artifact string    `json:"artifact"`
+	Size     int64     `json:"size"`
+	Stored   time.Time `json:"stored"`
+}
+
+// casObjectPath returns where within dir the content with hash is kept.
+func casObjectPath(dir, hash string) string {
+	return filepath.Join(dir, hash[:2], hash)
+}
+
+// saveArtifactCAS downloads artifact a (of build buildNum, known to the user
+// as name) into the store at dir.  It returns the entry recorded, and
+// whether the content was new to the store.
+func saveArtifactCAS(dir string, a artifact, name string, buildNum int) (casEntry, bool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return casEntry{}, false, err
+	}
+	tmp, err := os.CreateTemp(dir, ".cart-*")
+	if err != nil {
+		return casEntry{}, false, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	fmt.Fprintf(diag, "Downloading %s...\n", name)
+	h := sha256.New()
+	n, err := fetchArtifact(a, name, func(size int64) (io.WriteCloser, error) {
+		h.Reset()
+		if err := checkDiskFree(dir, size); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(tmpPath)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Writer
+			io.Closer
+		}{io.MultiWriter(f, h), f}, nil
+	})
+	if err != nil {
+		return casEntry{}, false, err
+	}
+
+	e := casEntry{hex.EncodeToString(h.Sum(nil)), buildNum, name, n, time.Now().UTC()}
+	object := casObjectPath(dir, e.SHA256)
+	stored := false
+	if _, err := os.Stat(object); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			return e, false, err
+		}
+		if err := os.Chmod(tmpPath, 0444); err != nil {
+			return e, false, err
+		}
+		if err := os.Rename(tmpPath, object); err != nil {
+			return e, false, err
+		}
+		stored = true
+	}
+	return e, stored, appendCASIndex(dir, e)
+}
+
+func appendCASIndex(dir string, e casEntry) error {
+	f, err := os.OpenFile(filepath.Join(dir, "index.jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(e); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_saveArtifactCAS(t *testing.T) {
+	defer func(o Output, w io.Writer) { output, diag = o, w }(output, diag)
+	var stdout bytes.Buffer
+	output.Out, diag = &stdout, io.Discard
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "same bytes, every build")
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	sum := sha256.Sum256([]byte("same bytes, every build"))
+	hash := hex.EncodeToString(sum[:])
+
+	for _, tc := range []struct {
+		build  int
+		stored bool
+	}{
+		{11, true},
+		{12, false},
+	} {
+		a := artifact{URL: fmt.Sprintf("%s/%d/cart.txt", ts.URL, tc.build), Path: "cart.txt"}
+		e, stored, err := saveArtifactCAS(dir, a, "cart.txt", tc.build)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.SHA256 != hash || stored != tc.stored {
+			t.Errorf("build %d: Expected %s stored %v, got %s stored %v", tc.build, hash, tc.stored, e.SHA256, stored)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("build %d: Expected nothing on stdout, got %q", tc.build, stdout.String())
+		}
+	}
+
+	object := filepath.Join(dir, hash[:2], hash)
+	if b, err := os.ReadFile(object); err != nil || string(b) != "same bytes, every build" {
+		t.Errorf("Expected content at %s, got %q (%v)", object, b, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("Expected just %s/ and index.jsonl, got %v", hash[:2], entries)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "index.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var builds []int
+	for s := bufio.NewScanner(f); s.Scan(); {
+		var e casEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.SHA256 != hash || e.Artifact != "cart.txt" {
+			t.Errorf("Unexpected index entry %+v", e)
+		}
+		builds = append(builds, e.Build)
+	}
+	if len(builds) != 2 || builds[0] != 11 || builds[1] != 12 {
+		t.Errorf("Expected index entries for builds 11 and 12, got %v", builds)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// With -output-if-changed, an existing output file is only replaced if the
+// artifact differs from it, so that an unchanged file keeps its mtime and
+// doesn't trigger rebuilds downstream (eg, by make).  The artifact is
+// downloaded next to the output, compared by checksum, and then either
+// renamed over the output (atomically) or discarded.
+
+var outputIfChanged bool
+
+// With -keep-temp, for debugging, the download is left in its temporary file
+// and not renamed to the output, even when it succeeds.
+var keepTemp bool
+
+// saveArtifactTemp downloads a to a new temporary file beside outputPath,
+// returning the file's path, which is removed on failure (unless keepTemp).
+// The caller renames or removes it, and then calls untrackTemp.
+func saveArtifactTemp(a artifact, name, outputPath string) (string, int64, error) {
+	tmp, err := createTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".cart-")
+	if err != nil {
+		return "", 0, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	fmt.Fprintf(diag, "Downloading %s...\n", name)
+	n, err := fetchArtifact(a, name, func(size int64) (io.WriteCloser, error) {
+		if err := checkDiskFree(filepath.Dir(tmpPath), size); err != nil {
+			return nil, err
+		}
+		return os.Create(tmpPath)
+	})
+	if err != nil {
+		if keepTemp {
+			untrackTemp(tmpPath)
+			return tmpPath, n, fmt.Errorf("%w (kept what was downloaded in %s)", err, tmpPath)
+		}
+		os.Remove(tmpPath)
+		untrackTemp(tmpPath)
+		return "", n, err
+	}
+	return tmpPath, n, nil
+}
+
+// saveArtifactKeepTemp is saveArtifact for -keep-temp, reporting to w where
+// the download was kept.
+func saveArtifactKeepTemp(w io.Writer, a artifact, name, outputPath string) error {
+	tmpPath, n, err := saveArtifactTemp(a, name, outputPath)
+	if err != nil {
+		return err
+	}
+	untrackTemp(tmpPath)
+	_, err = fmt.Fprintf(w, "Kept %s (%d bytes) in %s, not renamed to %s\n", name, n, tmpPath, outputPath)
+	return err
+}
+
+// saveArtifactIfChanged is saveArtifact for -output-if-changed, which also
+// reports whether outputPath was replaced.  A special file (eg a FIFO) has
+// nothing to compare, and mustn't be renamed over, so it's written to as
+// saveArtifact would.
+func saveArtifactIfChanged(a artifact, name, outputPath string) (int64, bool, error) {
+	if fi, err := os.Stat(outputPath); err == nil && !fi.Mode().IsRegular() && !fi.IsDir() {
+		n, err := saveArtifact(a, name, outputPath)
+		return n, true, err
+	}
+	tmpPath, n, err := saveArtifactTemp(a, name, outputPath)
+	if err != nil {
+		return n, false, err
+	}
+	defer func() {
+		os.Remove(tmpPath) // once renamed, there's nothing to remove
+		untrackTemp(tmpPath)
+	}()
+
+	if _, err := os.Stat(outputPath); err == nil {
+		same, err := sameContents(tmpPath, outputPath)
+		if err != nil {
+			return n, false, err
+		}
+		if same {
+			return n, false, nil
+		}
+	}
+	if err := keepMode(tmpPath, outputPath); err != nil {
+		return n, false, err
+	}
+	return n, true, os.Rename(tmpPath, outputPath)
+}
+
+func sameContents(a, b string) (bool, error) {
+	sumA, err := fileSHA256(a)
+	if err != nil {
+		return false, err
+	}
+	sumB, err := fileSHA256(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sumA, sumB), nil
+}
+
+func fileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_saveArtifactIfChanged(t *testing.T) {
+	body := "v1"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "cart.txt")
+	if err := os.WriteFile(out, []byte("v1"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(out, old, old); err != nil {
+		t.Fatal(err)
+	}
+	a := artifact{URL: ts.URL + "/cart.txt", Path: "cart.txt"}
+
+	_, changed, err := saveArtifactIfChanged(a, "cart.txt", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(out); changed || !fi.ModTime().Equal(old) {
+		t.Errorf("identical: Expected unchanged with mtime %s, got changed %v, mtime %s", old, changed, fi.ModTime())
+	}
+
+	body = "v2"
+	_, changed, err = saveArtifactIfChanged(a, "cart.txt", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(out)
+	if fi, _ := os.Stat(out); !changed || string(got) != "v2" || fi.Mode().Perm() != 0640 {
+		t.Errorf("differing: Expected v2 with mode 0640, got changed %v, %q, mode %s", changed, got, fi.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no temporary files left, got %v", entries)
+	}
+}
+
+func Test_saveArtifactKeepTemp(t *testing.T) {
+	defer func() { keepTemp = false }()
+	keepTemp = true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "v1")
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "cart.txt")
+	var report bytes.Buffer
+	if err := saveArtifactKeepTemp(&report, artifact{URL: ts.URL + "/cart.txt"}, "cart.txt", out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("Expected no rename to %s, got %v", out, err)
+	}
+	temps, _ := filepath.Glob(filepath.Join(dir, ".cart.txt.cart-*"))
+	if len(temps) != 1 {
+		t.Fatalf("Expected one temp file, got %v", temps)
+	}
+	if b, _ := os.ReadFile(temps[0]); string(b) != "v1" {
+		t.Errorf("Expected the download kept, got %q", b)
+	}
+	if !strings.Contains(report.String(), temps[0]) {
+		t.Errorf("Expected %s reported, got %q", temps[0], report.String())
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -compare A:B shows how the artifacts of build B differ from those of
+// build A, for auditing a release: what was added, what removed and, with
+// -sizes, which changed size, as probed for each artifact both have.  An
+// artifact is known by its path and node, so that the same path from two
+// nodes is two artifacts, as in the list.
+
+// parseCompare parses -compare's A:B.
+func parseCompare(s string) (a, b int, err error) {
+	as, bs, ok := strings.Cut(s, ":")
+	if ok {
+		a, err = strconv.Atoi(as)
+	}
+	if ok && err == nil {
+		b, err = strconv.Atoi(bs)
+	}
+	if !ok || err != nil || a <= 0 || b <= 0 {
+		return 0, 0, fmt.Errorf("bad -compare %q: want <build>:<build>, eg 41:42", s)
+	}
+	return a, b, nil
+}
+
+type artifactKey struct {
+	node int
+	path string
+}
+
+func (k artifactKey) String() string {
+	if k.node > 0 {
+		return fmt.Sprintf("%s (node %d)", k.path, k.node)
+	}
+	return k.path
+}
+
+type artifactChange struct {
+	key   artifactKey
+	op    byte // '+' added, '-' removed, '~' changed size
+	sizeA int64
+	sizeB int64
+}
+
+// compareArtifacts returns the changes from artifacts a to b, by path, with
+// changes of size too if sizeOf isn't nil.  Unknown sizes (-1) don't count
+// as changes.
+func compareArtifacts(a, b []artifact, sizeOf func(artifact) int64) []artifactChange {
+	key := func(x artifact) artifactKey { return artifactKey{x.NodeIndex, x.Path} }
+	inA := make(map[artifactKey]artifact, len(a))
+	for _, x := range a {
+		inA[key(x)] = x
+	}
+	inB := make(map[artifactKey]artifact, len(b))
+	for _, x := range b {
+		inB[key(x)] = x
+	}
+
+	var changes []artifactChange
+	var both [][2]artifact
+	for k := range inA {
+		if _, ok := inB[k]; !ok {
+			changes = append(changes, artifactChange{key: k, op: '-'})
+		}
+	}
+	for k, x := range inB {
+		if y, ok := inA[k]; !ok {
+			changes = append(changes, artifactChange{key: k, op: '+'})
+		} else {
+			both = append(both, [2]artifact{y, x})
+		}
+	}
+	if sizeOf != nil && len(both) > 0 {
+		pairs := make([]artifact, 0, 2*len(both))
+		for _, p := range both {
+			pairs = append(pairs, p[0], p[1])
+		}
+		sizes := probeEach(pairs, sizeOf, probeConcurrency)
+		for i, p := range both {
+			sa, sb := sizes[2*i], sizes[2*i+1]
+			if sa >= 0 && sb >= 0 && sa != sb {
+				changes = append(changes, artifactChange{key: key(p[1]), op: '~', sizeA: sa, sizeB: sb})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].key.path != changes[j].key.path {
+			return changes[i].key.path < changes[j].key.path
+		}
+		return changes[i].key.node < changes[j].key.node
+	})
+	return changes
+}
+
+func writeChanges(w io.Writer, changes []artifactChange) error {
+	for _, c := range changes {
+		var err error
+		if c.op == '~' {
+			_, err = fmt.Fprintf(w, "~ %s (%d -> %d bytes)\n", c.key, c.sizeA, c.sizeB)
+		} else {
+			_, err = fmt.Fprintf(w, "%c %s\n", c.op, c.key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareBuilds fetches the artifacts of builds a and b, narrowed by f, and
+// returns the changes between them.
+func compareBuilds(ctx context.Context, opts URLOptions, a, b int, f ArtifactFilter, sizeOf func(artifact) int64) ([]artifactChange, error) {
+	var lists [2][]artifact
+	for i, n := range []int{a, b} {
+		opts.BuildNum = n
+		artifacts, err := fetchBuildArtifacts(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("build %d: %s", n, err)
+		}
+		lists[i] = filterArtifacts(artifacts, f)
+	}
+	return compareArtifacts(lists[0], lists[1], sizeOf), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_compareArtifacts(t *testing.T) {
+	a := []artifact{
+		{Path: "bin/cart-linux", URL: "a/bin/cart-linux"},
+		{Path: "bin/cart-darwin", URL: "a/bin/cart-darwin"},
+		{Path: "bin/cart-windows.exe", URL: "a/bin/cart-windows.exe"},
+		{Path: "test/results.xml", NodeIndex: 1, URL: "a/1/test/results.xml"},
+		{Path: "docs/cart.1", URL: "a/docs/cart.1"},
+	}
+	b := []artifact{
+		{Path: "bin/cart-linux", URL: "b/bin/cart-linux"},
+		{Path: "bin/cart-darwin", URL: "b/bin/cart-darwin"},
+		{Path: "bin/cart-linux-arm64", URL: "b/bin/cart-linux-arm64"},
+		{Path: "test/results.xml", NodeIndex: 2, URL: "b/2/test/results.xml"},
+		{Path: "docs/cart.1", URL: "b/docs/cart.1"},
+	}
+	sizes := map[string]int64{
+		"a/bin/cart-linux": 100, "b/bin/cart-linux": 120,
+		"a/bin/cart-darwin": 100, "b/bin/cart-darwin": 100,
+		"a/docs/cart.1": -1, "b/docs/cart.1": 50,
+	}
+	sizeOf := func(x artifact) int64 { return sizes[x.URL] }
+
+	var out bytes.Buffer
+	if err := writeChanges(&out, compareArtifacts(a, b, nil)); err != nil {
+		t.Fatal(err)
+	}
+	want := "+ bin/cart-linux-arm64\n- bin/cart-windows.exe\n- test/results.xml (node 1)\n+ test/results.xml (node 2)\n"
+	if out.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, out.String())
+	}
+
+	out.Reset()
+	if err := writeChanges(&out, compareArtifacts(a, b, sizeOf)); err != nil {
+		t.Fatal(err)
+	}
+	want = "~ bin/cart-linux (100 -> 120 bytes)\n+ bin/cart-linux-arm64\n- bin/cart-windows.exe\n- test/results.xml (node 1)\n+ test/results.xml (node 2)\n"
+	if out.String() != want {
+		t.Errorf("sizes: Expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func Test_compareBuilds(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1.1/project/github/nbio/cart/41/artifacts":
+			fmt.Fprintf(w, `[{"path": "bin/cart", "url": "%[1]s/41/bin/cart"}, {"path": "bin/cart.sig", "url": "%[1]s/41/bin/cart.sig"}]`, ts.URL)
+		case "/api/v1.1/project/github/nbio/cart/42/artifacts":
+			fmt.Fprintf(w, `[{"path": "bin/cart", "url": "%[1]s/42/bin/cart"}]`, ts.URL)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart"}
+	changes, err := compareBuilds(context.Background(), opts, 41, 42, ArtifactFilter{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].op != '-' || changes[0].key.path != "bin/cart.sig" {
+		t.Errorf("Expected build 42 to have dropped bin/cart.sig, got %+v", changes)
+	}
+
+	for _, bad := range []string{"41", "41:", ":42", "a:b", "0:42"} {
+		if _, _, err := parseCompare(bad); err == nil {
+			t.Errorf("%q: Expected an error", bad)
+		}
+	}
+	if a, b, err := parseCompare("41:42"); err != nil || a != 41 || b != 42 {
+		t.Errorf("Expected 41 and 42, got %d %d %v", a, b, err)
+	}
+}
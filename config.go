@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cart's settings come from flags, the environment and the git remote, some
+// overriding others (eg, -tag clears -branch, -from-url sets -repo and
+// -build).  -show-config prints what came of it all, and whence each came,
+// for debugging precedence surprises.
+
+// setting is one resolved setting, with its source: the flag which set it,
+// an environment variable, "git remote", or "default".
+type setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+const redacted = "(redacted)"
+
+// redact hides a secret, while still showing whether there is one.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// flagSource names the first of names which was set on the command line of
+// fs, or else "default".
+func flagSource(fs *flag.FlagSet, names ...string) string {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, name := range names {
+		if set[name] {
+			return "-" + name
+		}
+	}
+	return "default"
+}
+
+// tokenSource tells where loadToken(flagValue) gets the token from.
+func tokenSource(flagValue string) string {
+	switch {
+	case flagValue != "":
+		return "-token"
+	case os.Getenv("CIRCLE_TOKEN") != "":
+		return "$CIRCLE_TOKEN"
+	}
+	return ""
+}
+
+// headerNames lists the names of h, but not the values, which may be secret.
+func headerNames(h map[string][]string) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// configState is what main resolved from flags, the environment and the git
+// remote, with the sources which flagSource can't tell.
+type configState struct {
+	project       string
+	projectSource string
+	vcsSource     string
+	opts          URLOptions
+	filter        FilterSet
+	listFilter    string // as given, before "none" or -include-running clear it
+	fromURL       string
+	branchFromGit bool
+	verbose       bool
+	tokenFrom     string
+	artifactName  string
+	outputPath    string
+}
+
+// configSettings lists the settings of c, and whence each came, given fs,
+// the flags parsed.
+func configSettings(fs *flag.FlagSet, c configState) []setting {
+	buildSource := flagSource(fs, "build")
+	if c.fromURL != "" {
+		buildSource = "-from-url"
+	}
+	listFilterSource := flagSource(fs, "list-filter")
+	if c.opts.Filter == "" && c.listFilter != "none" {
+		listFilterSource = "-include-running"
+	}
+	extraHeadersSource := "default"
+	if len(extraHeaders) > 0 {
+		extraHeadersSource = "$" + extraHeadersEnv
+	}
+	verbositySource := "default"
+	if c.verbose {
+		verbositySource = "-v"
+		if os.Getenv("VERBOSITY") != "" {
+			verbositySource = "$VERBOSITY"
+		}
+	}
+	branchSource := flagSource(fs, "branch")
+	if c.branchFromGit {
+		branchSource = "git HEAD"
+	}
+	if c.filter.branch == "" {
+		// cleared by -tag or -branch-glob
+		branchSource = flagSource(fs, "tag", "branch-glob")
+	}
+	return []setting{
+		{"repo", c.project, c.projectSource},
+		{"vcs", c.opts.provider().VCSType(), c.vcsSource},
+		{"branch", c.filter.branch, branchSource},
+		{"tag", c.filter.tag, flagSource(fs, "tag")},
+		{"branch-glob", c.filter.branchGlob, flagSource(fs, "branch-glob")},
+		{"build", strconv.Itoa(c.opts.BuildNum), buildSource},
+		{"workflow", c.filter.workflow, flagSource(fs, "workflow", "w")},
+		{"workflow-match", c.filter.workflowMatch, flagSource(fs, "workflow-match")},
+		{"job", c.filter.jobname, flagSource(fs, "job", "j")},
+		{"host", c.opts.Host, flagSource(fs, "host")},
+		{"search-depth", strconv.Itoa(c.opts.Limit), flagSource(fs, "search-depth", "list-limit")},
+		{"list-offset", strconv.Itoa(c.opts.Offset), flagSource(fs, "list-offset")},
+		{"list-filter", c.opts.Filter, listFilterSource},
+		{"auth-scheme", string(authSchemeFor(urlHostname(c.opts.Host))), flagSource(fs, "auth-scheme")},
+		{"token", redact(circleToken), c.tokenFrom},
+		{"trusted-hosts", strings.Join(trustedHosts, ","), flagSource(fs, "host", "trusted-host")},
+		{"extra-headers", headerNames(extraHeaders), extraHeadersSource},
+		{"artifact", c.artifactName, "argument"},
+		{"output", c.outputPath, flagSource(fs, "o")},
+		{"cache-dir", cacheDir(), flagSource(fs, "cache-dir")},
+		{"verbosity", strconv.Itoa(verbosity), verbositySource},
+	}
+}
+
+func writeConfig(w io.Writer, settings []setting, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(struct {
+			jsonHeader
+			Settings []setting `json:"settings"`
+		}{newJSONHeader(), settings})
+	}
+	for _, s := range settings {
+		if _, err := fmt.Fprintf(w, "%-14s %-30q %s\n", s.Name, s.Value, s.Source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func Test_showConfigLayered(t *testing.T) {
+	const secret = "s3cret-token"
+	t.Setenv("CIRCLE_TOKEN", secret)
+	defer func(s string) { circleToken = s }(circleToken)
+
+	fs := flag.NewFlagSet("cart", flag.ContinueOnError)
+	var branch, tag, repo string
+	var depth int
+	fs.StringVar(&branch, "branch", "master", "")
+	fs.StringVar(&tag, "tag", "", "")
+	fs.StringVar(&repo, "repo", "", "")
+	fs.IntVar(&depth, "search-depth", defaultRetrieveCount, "")
+	fs.IntVar(&depth, "list-limit", defaultRetrieveCount, "")
+	if err := fs.Parse([]string{"-list-limit", "50"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// As main does: no -repo, so the project and branch come from git.
+	from := tokenSource("")
+	circleToken = loadToken("")
+	if got := tokenSource("x"); got != "-token" {
+		t.Errorf("Expected token from %q, got %q", "-token", got)
+	}
+	state := configState{
+		project:       "nbio/cart",
+		projectSource: "git remote",
+		vcsSource:     "default",
+		opts:          URLOptions{Host: defaultHost, Limit: depth},
+		filter:        FilterSet{branch: "retry"},
+		branchFromGit: true,
+		tokenFrom:     from,
+	}
+	settings := configSettings(fs, state)
+	want := map[string]setting{
+		"repo":         {"repo", "nbio/cart", "git remote"},
+		"branch":       {"branch", "retry", "git HEAD"},
+		"tag":          {"tag", "", "default"},
+		"search-depth": {"search-depth", "50", "-list-limit"},
+		"token":        {"token", redacted, "$CIRCLE_TOKEN"},
+	}
+	checkSettings := func(settings []setting, want map[string]setting) {
+		t.Helper()
+		seen := 0
+		for _, s := range settings {
+			if w, ok := want[s.Name]; ok {
+				seen++
+				if s != w {
+					t.Errorf("Expected %+v, got %+v", w, s)
+				}
+			}
+		}
+		if seen != len(want) {
+			t.Errorf("Expected settings %v, got %+v", want, settings)
+		}
+	}
+	checkSettings(settings, want)
+
+	// -tag clears the branch, whether it came from git or not.
+	if err := fs.Parse([]string{"-tag", "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	state.filter = FilterSet{tag: tag}
+	checkSettings(configSettings(fs, state), map[string]setting{
+		"branch": {"branch", "", "-tag"},
+		"tag":    {"tag", "v1", "-tag"},
+	})
+
+	var text, js bytes.Buffer
+	if err := writeConfig(&text, settings, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeConfig(&js, settings, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range []string{text.String(), js.String()} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Expected the token redacted, got %q", out)
+		}
+		if !strings.Contains(out, redacted) || !strings.Contains(out, "nbio/cart") {
+			t.Errorf("Expected the settings, got %q", out)
+		}
+	}
+	var doc struct {
+		SchemaVersion int       `json:"schema_version"`
+		Settings      []setting `json:"settings"`
+	}
+	if err := json.Unmarshal(js.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.SchemaVersion != jsonSchemaVersion || len(doc.Settings) != len(settings) {
+		t.Errorf("Expected %d settings, got %+v", len(settings), doc)
+	}
+	if redact("") != "" {
+		t.Errorf("Expected no token to show as empty, got %q", redact(""))
+	}
+}
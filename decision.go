@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// With -json, how the build was picked is also written out, for tools which
+// explain CI state: each build considered, with why it was skipped, and the
+// build selected.
+
+type skipReason string
+
+const (
+	skipNoWorkflow        skipReason = "no-workflow"
+	skipOutcome           skipReason = "wrong-outcome"
+	skipTag               skipReason = "wrong-tag"
+	skipBranch            skipReason = "wrong-branch"
+	skipTriggeredBy       skipReason = "wrong-triggered-by"
+	skipTriggerType       skipReason = "wrong-trigger-type"
+	skipWorkflowID        skipReason = "wrong-workflow-id"
+	skipWorkflowName      skipReason = "wrong-workflow-name"
+	skipRunningNoArtifact skipReason = "running-without-artifact"
+	skipNoArtifact        skipReason = "without-artifact"
+	skipJobName           skipReason = "wrong-jobname"
+)
+
+type consideredBuild struct {
+	BuildNum   int        `json:"build_num"`
+	SkipReason skipReason `json:"skip_reason,omitempty"` // empty if it qualified
+}
+
+type decisionLog struct {
+	Considered []consideredBuild `json:"considered"`
+	Selected   []int             `json:"selected"`
+	Workflow   string            `json:"workflow,omitempty"` // that preferred, of several
+}
+
+// decisions records pickBuild's reasoning, when not nil.
+var decisions *decisionLog
+
+func (d *decisionLog) skip(b build, reason skipReason) {
+	if d != nil {
+		d.Considered = append(d.Considered, consideredBuild{b.BuildNum, reason})
+	}
+}
+
+func (d *decisionLog) qualify(b build) {
+	if d != nil {
+		d.Considered = append(d.Considered, consideredBuild{BuildNum: b.BuildNum})
+	}
+}
+
+// retry forgets what was considered, before a search with other filters.
+func (d *decisionLog) retry() {
+	if d != nil {
+		d.Considered = nil
+	}
+}
+
+func (d *decisionLog) selectBuilds(builds []build, picked []int) {
+	if d != nil {
+		for _, k := range picked {
+			d.Selected = append(d.Selected, builds[k].BuildNum)
+		}
+	}
+}
+
+func writeDecision(w io.Writer, d *decisionLog) error {
+	return json.NewEncoder(w).Encode(struct {
+		jsonHeader
+		Decision *decisionLog `json:"decision"`
+	}{newJSONHeader(), d})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func Test_pickBuildDecision(t *testing.T) {
+	builds := []build{
+		{BuildNum: 16, Outcome: "success"},
+		{BuildNum: 15, Outcome: "failed", Workflows: &workflow{JobName: "build", WorkflowName: "commit", WorkflowID: "w3"}},
+		{BuildNum: 14, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "nightly", WorkflowID: "w2"}},
+		{BuildNum: 13, Outcome: "success", Workflows: &workflow{JobName: "test", WorkflowName: "commit", WorkflowID: "w1"}},
+		{BuildNum: 12, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "commit", WorkflowID: "w0"}},
+		{BuildNum: 11, Outcome: "success", Workflows: &workflow{JobName: "build", WorkflowName: "commit", WorkflowID: "w1"}},
+	}
+	defer func() { decisions = nil }()
+	decisions = &decisionLog{}
+
+	noArtifact := func(build) (bool, error) { return false, nil }
+	filter := FilterSet{workflow: "commit", jobname: "build"}
+	if i, err := pickBuild(builds, filter, noArtifact); err != nil || builds[i].BuildNum != 11 {
+		t.Fatalf("Expected build 11, got %d, %v", i, err)
+	}
+	want := &decisionLog{
+		Considered: []consideredBuild{
+			{16, skipNoWorkflow},
+			{15, skipOutcome},
+			{14, skipWorkflowName},
+			{13, skipJobName},
+			{12, skipWorkflowID},
+			{11, ""},
+		},
+		Selected: []int{11},
+	}
+	if !reflect.DeepEqual(decisions, want) {
+		t.Errorf("Expected %+v, got %+v", want, decisions)
+	}
+
+	out := new(bytes.Buffer)
+	if err := writeDecision(out, decisions); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		jsonHeader
+		Decision struct {
+			Considered []map[string]interface{} `json:"considered"`
+			Selected   []int                    `json:"selected"`
+		} `json:"decision"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.SchemaVersion != jsonSchemaVersion || got.Decision.Considered[4]["skip_reason"] != "wrong-workflow-id" ||
+		!reflect.DeepEqual(got.Decision.Selected, []int{11}) {
+		t.Errorf("Unexpected JSON %s", out)
+	}
+}
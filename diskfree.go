@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A download which fills the disk fails late, with a confusing ENOSPC, and
+// leaves a partial file behind.  With -min-disk-free, the filesystem is
+// checked before writing: it must have room for the artifact (when the
+// server says how big it is) and still have -min-disk-free to spare.
+// Where the free space can't be found (see diskfree_*.go), there's no check.
+
+var minDiskFree int64
+
+var errFreeSpaceUnknown = errors.New("free space unknown on this platform")
+
+// freeSpace returns the bytes free to us on the filesystem holding dir.
+// Tests may replace it.
+var freeSpace = diskFree
+
+// checkDiskFree checks the filesystem holding dir has room for size bytes
+// (or -1 if unknown) and minDiskFree more.
+func checkDiskFree(dir string, size int64) error {
+	if minDiskFree <= 0 {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		verboseln("-min-disk-free:", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if size < 0 {
+		size = 0
+	}
+	need := minDiskFree + size
+	if free < need {
+		return fmt.Errorf("%s has %d bytes free, but needs %d (%d for the artifact, and -min-disk-free %d)",
+			dir, free, need, size, minDiskFree)
+	}
+	return nil
+}
+
+// createChecked is createOutput, after checkDiskFree, unless path is a
+// special file (eg, a FIFO), which takes no space.
+func createChecked(path string, size int64) (*os.File, error) {
+	if fi, err := os.Stat(path); err != nil || fi.Mode().IsRegular() {
+		if err := checkDiskFree(filepath.Dir(path), size); err != nil {
+			return nil, err
+		}
+	}
+	return createOutput(path)
+}
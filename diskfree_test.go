@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_minDiskFree(t *testing.T) {
+	defer func(m int64, f func(string) (int64, error)) { minDiskFree, freeSpace = m, f }(minDiskFree, freeSpace)
+	defer func(w io.Writer) { diag = w }(diag)
+	diag = io.Discard
+
+	payload := strings.Repeat("x", 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, payload) // with a Content-Length
+	}))
+	defer ts.Close()
+	a := artifact{URL: ts.URL + "/0/big.bin", Path: "big.bin"}
+
+	var free int64
+	var asked string
+	freeSpace = func(dir string) (int64, error) {
+		asked = dir
+		return free, nil
+	}
+	minDiskFree = 50
+	dir := t.TempDir()
+	out := filepath.Join(dir, "big.bin")
+
+	free = 120 // room for the artifact, but not the margin too
+	if _, err := saveArtifact(a, "big.bin", out); err == nil || !strings.Contains(err.Error(), "needs 150") {
+		t.Errorf("Expected the guard to refuse, got %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing written, got %v", err)
+	}
+	if asked != dir {
+		t.Errorf("Expected free space of %s checked, got %s", dir, asked)
+	}
+
+	free = 150
+	if n, err := saveArtifact(a, "big.bin", out); err != nil || n != 100 {
+		t.Errorf("Expected the download, got %d (%v)", n, err)
+	}
+
+	freeSpace = func(string) (int64, error) { return 0, errFreeSpaceUnknown }
+	if err := checkDiskFree(dir, 1<<40); err != nil {
+		t.Errorf("Expected no check where free space is unknown, got %v", err)
+	}
+}
+
+func Test_parseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int64
+	}{
+		{"512", 512},
+		{"64KB", 64000},
+		{"2MB", 2000000},
+		{"1.5 GB", 1500000000},
+		{"1GiB", 1 << 30},
+		{"10mib", 10 << 20},
+		{"3B", 3},
+	} {
+		if got, err := parseByteSize(tc.s); err != nil || got != tc.want {
+			t.Errorf("%q: Expected %d, got %d (%v)", tc.s, tc.want, got, err)
+		}
+	}
+	for _, bad := range []string{"", "MB", "-1MB", "2XB"} {
+		if _, err := parseByteSize(bad); err == nil {
+			t.Errorf("%q: Expected error", bad)
+		}
+	}
+}
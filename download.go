@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With -all, every artifact which passes the filters is downloaded into
+// -output-dir, each at its path within the build's artifacts or, with
+// -flatten, at just its file name.  Two artifacts landing on the same output
+// path (eg, the same path from several nodes) is an error, rather than have
+// one silently replace the other, unless -dedupe, when the later is written
+// with a number added to its name, eg cart-2.tar.gz.
+//
+// Each artifact is downloaded to a temporary file beside its output path,
+// and renamed into place only once complete, so that a failure, whether the
+// batch stops there or keeps going, leaves no partial files: only those
+// completed, by their names.  So does an interrupt (see tempfile.go).  A new
+// file gets the mode of any other (0666 less the umask), and a file replaced
+// keeps its own.
+//
+// Artifacts expire, so one listed may be gone (404) by the time it's
+// downloaded.  That's a failure like any other, unless -allow-missing, when
+// it's reported as missing and skipped, and the rest carry on.
+
+var (
+	allowMissing bool
+	dedupe       bool
+)
+
+// errMissing is that of an artifact the server doesn't have.
+var errMissing = errors.New("artifact missing")
+
+// missed tells whether err is a miss which -allow-missing lets pass.
+func missed(err error) bool {
+	return allowMissing && errors.Is(err, errMissing)
+}
+
+type plannedDownload struct {
+	artifact artifact
+	path     string
+}
+
+// artifactOutputPath returns where within dir to write a.  The artifact path
+// comes from the server, so it's cleaned such that it cannot escape dir.
+func artifactOutputPath(a artifact, dir string, flatten bool) string {
+	p := path.Clean("/" + filepath.ToSlash(a.Path))[1:]
+	if flatten {
+		p = path.Base(p)
+	}
+	return filepath.Join(dir, filepath.FromSlash(p))
+}
+
+func planDownloads(artifacts []artifact, dir string, flatten bool) ([]plannedDownload, error) {
+	plan := make([]plannedDownload, 0, len(artifacts))
+	seen := map[string]artifact{}
+	// The paths artifacts would have, so that a deduped name doesn't take
+	// that of an artifact later in the list.
+	natural := map[string]bool{}
+	for _, a := range artifacts {
+		natural[artifactOutputPath(a, dir, flatten)] = true
+	}
+	for _, a := range artifacts {
+		p := artifactOutputPath(a, dir, flatten)
+		if p == filepath.Clean(dir) {
+			return nil, fmt.Errorf("artifact %q (node %d) has no file name", a.Path, a.NodeIndex)
+		}
+		if prev, ok := seen[p]; ok {
+			if !dedupe {
+				return nil, fmt.Errorf("artifacts %q (node %d) and %q (node %d) would both be written to %s (use -dedupe to number the later)",
+					prev.Path, prev.NodeIndex, a.Path, a.NodeIndex, p)
+			}
+			p = dedupePath(p, func(q string) bool { _, ok := seen[q]; return ok || natural[q] })
+		}
+		seen[p] = a
+		plan = append(plan, plannedDownload{artifact: a, path: p})
+	}
+	return plan, nil
+}
+
+// dedupePath returns p with a number added to its name, before its
+// extension: the first from 2 for which taken reports false.
+func dedupePath(p string, taken func(string) bool) string {
+	ext := artifactExt(filepath.ToSlash(p))
+	if ext == noExt {
+		ext = ""
+	}
+	base := strings.TrimSuffix(p, ext)
+	for i := 2; ; i++ {
+		if q := fmt.Sprintf("%s-%d%s", base, i, ext); !taken(q) {
+			return q
+		}
+	}
+}
+
+// keepMode gives tmpPath the mode of the file at outputPath, if any, which
+// it's to replace.
+func keepMode(tmpPath, outputPath string) error {
+	fi, err := os.Stat(outputPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return os.Chmod(tmpPath, fi.Mode().Perm())
+}
+
+func downloadAll(plan []plannedDownload) error {
+	b := newBatch(false)
+	for _, d := range plan {
+		start := time.Now()
+		if dryRun {
+			fmt.Fprintf(diag, "Dry run: skipped download of %s to %s\n", d.artifact.Path, d.path)
+			results.record(d.artifact, d.artifact.Path, d.path, 0, start, 0, false, nil)
+			continue
+		}
+		if verifyOnly {
+			n, sum, err := verifyArtifact(d.artifact, d.artifact.Path)
+			if err != nil {
+				fmt.Fprintf(output.Out, "Failed %s: %s\n", d.artifact.Path, err)
+			} else {
+				fmt.Fprintf(output.Out, "Verified %s (%d bytes, sha256 %s)\n", d.artifact.Path, n, sum)
+			}
+			if !b.done(err) {
+				break
+			}
+			continue
+		}
+		n, changed, err := saveDownload(d)
+		if missed(err) {
+			fmt.Fprintf(diag, "Missing %s: %s\n", d.artifact.Path, err)
+			results.record(d.artifact, d.artifact.Path, d.path, 0, start, 0, false, err)
+			b.done(nil)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(diag, "Failed %s: %s\n", d.artifact.Path, err)
+		} else if !changed {
+			fmt.Fprintf(diag, "Unchanged %s (%d bytes) at %s\n", d.artifact.Path, n, d.path)
+		} else {
+			fmt.Fprintf(diag, "Wrote %s (%d bytes) to %s\n", d.artifact.Path, n, d.path)
+		}
+		results.record(d.artifact, d.artifact.Path, d.path, 0, start, n, changed, err)
+		if !b.done(err) {
+			break
+		}
+	}
+	return b.err()
+}
+
+// saveDownload saves d, reporting whether its output was changed, which it
+// always is unless -output-if-changed.
+func saveDownload(d plannedDownload) (n int64, changed bool, err error) {
+	if err := os.MkdirAll(filepath.Dir(d.path), 0755); err != nil {
+		return 0, false, err
+	}
+	if outputIfChanged {
+		return saveArtifactIfChanged(d.artifact, d.artifact.Path, d.path)
+	}
+	n, err = saveArtifactAtomic(d.artifact, d.artifact.Path, d.path)
+	return n, true, err
+}
+
+// saveArtifactAtomic is saveArtifact by way of a temporary file, renamed to
+// outputPath once complete.  A file replaced keeps its mode.
+func saveArtifactAtomic(a artifact, name, outputPath string) (int64, error) {
+	tmpPath, n, err := saveArtifactTemp(a, name, outputPath)
+	if err != nil {
+		return n, err
+	}
+	defer untrackTemp(tmpPath)
+	if err := keepMode(tmpPath, outputPath); err != nil {
+		os.Remove(tmpPath)
+		return n, err
+	}
+	if err := os.Rename(tmpPath, outputPath); err != nil {
+		os.Remove(tmpPath)
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_planDownloads(t *testing.T) {
+	artifacts := []artifact{
+		{Path: "bin/linux/cart", NodeIndex: 0},
+		{Path: "docs/cart.1", NodeIndex: 0},
+		{Path: "../../etc/passwd", NodeIndex: 0},
+	}
+	plan, err := planDownloads(artifacts, "out", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"out/bin/linux/cart", "out/docs/cart.1", "out/etc/passwd"} {
+		if plan[i].path != filepath.FromSlash(want) {
+			t.Errorf("Expected %s, got %s", want, plan[i].path)
+		}
+	}
+
+	plan, err = planDownloads(artifacts, "out", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"out/cart", "out/cart.1", "out/passwd"} {
+		if plan[i].path != filepath.FromSlash(want) {
+			t.Errorf("flatten: Expected %s, got %s", want, plan[i].path)
+		}
+	}
+
+	collide := append(artifacts, artifact{Path: "bin/darwin/cart", NodeIndex: 0})
+	if _, err := planDownloads(collide, "out", false); err != nil {
+		t.Errorf("Expected no collision keeping paths, got %s", err)
+	}
+	if _, err := planDownloads(collide, "out", true); err == nil {
+		t.Errorf("flatten: Expected collision between bin/linux/cart and bin/darwin/cart")
+	}
+
+	defer func(d bool) { dedupe = d }(dedupe)
+	dedupe = true
+	collide = []artifact{
+		{Path: "linux/cart.tar.gz"},
+		{Path: "darwin/cart.tar.gz"},
+		{Path: "windows/cart.tar.gz"},
+		{Path: "cart-2.tar.gz"}, // would be taken by the first deduped
+		{Path: "linux/cart", NodeIndex: 0},
+		{Path: "linux/cart", NodeIndex: 1},
+	}
+	plan, err = planDownloads(collide, "out", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"out/cart.tar.gz", "out/cart-3.tar.gz", "out/cart-4.tar.gz", "out/cart-2.tar.gz", "out/cart", "out/cart-2"} {
+		if plan[i].path != filepath.FromSlash(want) {
+			t.Errorf("dedupe: Expected %s, got %s", want, plan[i].path)
+		}
+	}
+}
+
+func Test_downloadAllFlatten(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	artifacts := []artifact{
+		{Path: "bin/linux/cart-linux", URL: ts.URL + "/0/bin/linux/cart-linux"},
+		{Path: "bin/darwin/cart-darwin", URL: ts.URL + "/0/bin/darwin/cart-darwin"},
+	}
+	plan, err := planDownloads(artifacts, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := downloadAll(plan); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cart-linux", "cart-darwin"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s flattened into output dir: %s", name, err)
+		}
+	}
+}
+
+func Test_downloadAllNoPartials(t *testing.T) {
+	defer func(p errorPolicy) { batchPolicy = p }(batchPolicy)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0/b.bin" {
+			// Promise more than is sent, so the download fails midway.
+			w.Header().Set("Content-Length", "1000")
+			io.WriteString(w, "partial")
+			return
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	artifacts := []artifact{
+		{Path: "a.bin", URL: ts.URL + "/0/a.bin"},
+		{Path: "b.bin", URL: ts.URL + "/0/b.bin"},
+		{Path: "c.bin", URL: ts.URL + "/0/c.bin"},
+	}
+	for _, tc := range []struct {
+		policy errorPolicy
+		want   []string
+	}{
+		{policyDefault, []string{"a.bin"}},
+		{policyKeepGoing, []string{"a.bin", "c.bin"}},
+	} {
+		batchPolicy = tc.policy
+		dir := t.TempDir()
+		plan, err := planDownloads(artifacts, dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := downloadAll(plan); err == nil {
+			t.Errorf("%v: Expected the failure of b.bin", tc.policy)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%v: Expected only %v in the output dir, got %v", tc.policy, tc.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%v: Expected only %v in the output dir, got %v", tc.policy, tc.want, got)
+				break
+			}
+		}
+	}
+}
+
+func Test_saveArtifactAtomicMode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+
+	// A new file gets the mode any other would, under the umask.
+	ref, err := os.Create(filepath.Join(dir, "ref"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Close()
+	refInfo, err := os.Stat(ref.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "new.bin")
+	if _, err := saveArtifactAtomic(artifact{URL: ts.URL + "/new.bin"}, "new.bin", out); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != refInfo.Mode().Perm() {
+		t.Errorf("Expected new.bin to be %v, like any new file, got %v (%v)", refInfo.Mode().Perm(), fi.Mode().Perm(), err)
+	}
+
+	// A file replaced keeps its mode.
+	out = filepath.Join(dir, "old.bin")
+	if err := os.WriteFile(out, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveArtifactAtomic(artifact{URL: ts.URL + "/old.bin"}, "old.bin", out); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected old.bin to stay 0600, got %v (%v)", fi.Mode().Perm(), err)
+	}
+}
+
+func Test_removeTemps(t *testing.T) {
+	dir := t.TempDir()
+	f, err := createTemp(dir, ".out.cart-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	kept, err := createTemp(dir, ".kept.cart-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept.Close()
+	untrackTemp(kept.Name())
+
+	removeTemps()
+	if _, err := os.Stat(f.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected %s removed, got %v", f.Name(), err)
+	}
+	if _, err := os.Stat(kept.Name()); err != nil {
+		t.Errorf("Expected the untracked %s kept, got %v", kept.Name(), err)
+	}
+}
+
+func Test_downloadAllAllowMissing(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/expired.txt":
+			http.NotFound(w, r)
+		case "/broken.txt":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer ts.Close()
+	defer func(b bool) { allowMissing = b }(allowMissing)
+	defer func(l *resultLog) { results = l }(results)
+	defer func(n int) { maxRetries = n }(maxRetries)
+	maxRetries = 0
+
+	plan := func(dir string, names ...string) []plannedDownload {
+		var plan []plannedDownload
+		for _, name := range names {
+			plan = append(plan, plannedDownload{artifact{URL: ts.URL + "/" + name, Path: name}, filepath.Join(dir, name)})
+		}
+		return plan
+	}
+
+	allowMissing = true
+	results = &resultLog{}
+	dir := t.TempDir()
+	if err := downloadAll(plan(dir, "first.txt", "expired.txt", "last.txt")); err != nil {
+		t.Fatalf("Expected the missing artifact skipped, got %s", err)
+	}
+	for _, name := range []string{"first.txt", "last.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s written, got %v", name, err)
+		}
+	}
+	if got := results.results[1]; got.Status != statusMissing || got.Error == "" {
+		t.Errorf("Expected expired.txt reported missing, got %+v", got)
+	}
+
+	// Other failures still fail.
+	if err := downloadAll(plan(t.TempDir(), "first.txt", "broken.txt")); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Expected the 500 to fail, got %v", err)
+	}
+
+	allowMissing = false
+	if err := downloadAll(plan(t.TempDir(), "expired.txt")); !errors.Is(err, errMissing) {
+		t.Errorf("Expected a missing artifact to fail without -allow-missing, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "sort"
+
+// -download-order sets the order in which -all and -pick download, which
+// matters when, say, a manifest should land before what it lists, or the
+// small artifacts should land before a large one which might fail.  By
+// default (as-listed), that's the order picked with -pick, or else the API's.
+
+const (
+	orderAPI      = "api"
+	orderName     = "name"
+	orderSize     = "size"
+	orderAsListed = "as-listed"
+)
+
+var downloadOrder = orderAsListed
+
+func validDownloadOrder(order string) bool {
+	return order == orderAPI || order == orderName || order == orderSize || order == orderAsListed
+}
+
+// orderDownloads orders artifacts, a selection of all in the API's order, by
+// order.  Sizes are probed with sizeOf, smallest first, and unknown sizes
+// (-1) come first of all; otherwise ties keep their order.
+func orderDownloads(artifacts, all []artifact, order string, sizeOf func(artifact) int64) {
+	switch order {
+	case orderAPI:
+		index := make(map[string]int, len(all))
+		for i, a := range all {
+			index[a.URL] = i
+		}
+		sort.SliceStable(artifacts, func(i, j int) bool { return index[artifacts[i].URL] < index[artifacts[j].URL] })
+	case orderName:
+		sortArtifacts(artifacts, "path", sizeOf)
+	case orderSize:
+		sortArtifacts(artifacts, "size", sizeOf)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_downloadOrder(t *testing.T) {
+	bodies := map[string]string{
+		"/manifest.json": "{}",
+		"/big.tar":       strings.Repeat("x", 100),
+		"/a.txt":         "abc",
+	}
+	var mu sync.Mutex
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer ts.Close()
+
+	all := []artifact{
+		{Path: "manifest.json", URL: ts.URL + "/manifest.json"},
+		{Path: "big.tar", URL: ts.URL + "/big.tar"},
+		{Path: "a.txt", URL: ts.URL + "/a.txt"},
+	}
+	sizeOf := func(a artifact) int64 { return int64(len(bodies[strings.TrimPrefix(a.URL, ts.URL)])) }
+	for _, tc := range []struct {
+		order  string
+		picked []int
+		want   []string
+	}{
+		{orderName, []int{0, 1, 2}, []string{"/a.txt", "/big.tar", "/manifest.json"}},
+		{orderSize, []int{0, 1, 2}, []string{"/manifest.json", "/a.txt", "/big.tar"}},
+		{orderAsListed, []int{2, 0}, []string{"/a.txt", "/manifest.json"}},
+		{orderAPI, []int{2, 0}, []string{"/manifest.json", "/a.txt"}},
+	} {
+		var artifacts []artifact
+		for _, i := range tc.picked {
+			artifacts = append(artifacts, all[i])
+		}
+		orderDownloads(artifacts, all, tc.order, sizeOf)
+		plan, err := planDownloads(artifacts, t.TempDir(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		if err := downloadAll(plan); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("%s: Expected %v, got %v", tc.order, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Under -json, scripts parse stdout, and a failure reported only on stderr
+// as text leaves them with nothing to parse.  So main fails by fatal (and
+// fatalf, fatalCode), which under -json also writes the error, as a last
+// JSON object, to stdout, before exiting with its code.
+
+var jsonFatal bool
+
+// exit is os.Exit, but for tests.
+var exit = os.Exit
+
+type fatalEvent struct {
+	jsonHeader
+	Event string `json:"event"`
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+func writeFatal(w io.Writer, msg string, code int) error {
+	return json.NewEncoder(w).Encode(fatalEvent{newJSONHeader(), "fatal", msg, code})
+}
+
+// fatalCode logs msg, and under -json writes it to stdout too, and exits
+// with code.
+func fatalCode(code int, msg string) {
+	log.Output(3, msg)
+	if jsonFatal {
+		if err := writeFatal(output.Out, msg, code); err != nil {
+			log.Print(err)
+		}
+	}
+	exit(code)
+}
+
+// fatal is log.Fatal, by way of fatalCode.
+func fatal(v ...interface{}) {
+	fatalCode(1, fmt.Sprint(v...))
+}
+
+// fatalf is log.Fatalf, by way of fatalCode.
+func fatalf(format string, v ...interface{}) {
+	fatalCode(1, fmt.Sprintf(format, v...))
+}
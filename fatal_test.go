@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func Test_fatalJSON(t *testing.T) {
+	defer func(f func(int)) { exit = f }(exit)
+	defer func(b bool) { jsonFatal = b }(jsonFatal)
+	defer SetOutput(output)
+	var out bytes.Buffer
+	SetOutput(Output{Out: &out, Err: io.Discard, Progress: io.Discard})
+	code := -1
+	exit = func(c int) { code = c }
+
+	jsonFatal = true
+	fatalCode(exitTooFewArtifacts, "found 1 artifact, want at least 2")
+	jsonFatal = false
+	fatal("not under -json")
+
+	if code != 1 {
+		t.Errorf("Expected the last exit code 1, got %d", code)
+	}
+	dec := json.NewDecoder(bytes.NewReader(out.Bytes()))
+	var ev struct {
+		SchemaVersion int    `json:"schema_version"`
+		Event         string `json:"event"`
+		Error         string `json:"error"`
+		Code          int    `json:"code"`
+	}
+	if err := dec.Decode(&ev); err != nil {
+		t.Fatalf("Expected a JSON object, got %q: %s", out.String(), err)
+	}
+	if ev.Event != "fatal" || ev.Error != "found 1 artifact, want at least 2" || ev.Code != exitTooFewArtifacts || ev.SchemaVersion != jsonSchemaVersion {
+		t.Errorf("Expected the fatal event, got %+v", ev)
+	}
+	if dec.More() {
+		t.Errorf("Expected nothing on stdout but under -json, got %q", out.String())
+	}
+}
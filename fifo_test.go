@@ -0,0 +1,87 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func Test_downloadArtifactFIFO(t *testing.T) {
+	const payload = "streamed artifact"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, payload)
+	}))
+	defer ts.Close()
+
+	fifo := filepath.Join(t.TempDir(), "out")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skipf("mkfifo: %s", err)
+	}
+	got := make(chan string)
+	go func() {
+		f, err := os.Open(fifo)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		got <- string(b)
+	}()
+
+	artifacts := []artifact{{URL: ts.URL + "/archive.tar", Path: "archive.tar"}}
+	if _, err := downloadArtifact(artifacts, "archive.tar", fifo); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != payload {
+		t.Errorf("Expected %q, got %q", payload, s)
+	}
+	if fi, err := os.Stat(fifo); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("Expected %s to still be a FIFO (%v)", fifo, err)
+	}
+}
+
+func Test_saveArtifactIfChangedFIFO(t *testing.T) {
+	const payload = "streamed artifact"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, payload)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "out")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skipf("mkfifo: %s", err)
+	}
+	got := make(chan string)
+	go func() {
+		f, err := os.Open(fifo)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		got <- string(b)
+	}()
+
+	a := artifact{URL: ts.URL + "/archive.tar", Path: "archive.tar"}
+	if _, changed, err := saveArtifactIfChanged(a, "archive.tar", fifo); err != nil || !changed {
+		t.Fatalf("Expected the FIFO written, got changed %v (%v)", changed, err)
+	}
+	if s := <-got; s != payload {
+		t.Errorf("Expected %q, got %q", payload, s)
+	}
+	if fi, err := os.Stat(fifo); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("Expected %s to still be a FIFO, not renamed over (%v)", fifo, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no temporary files, got %v", entries)
+	}
+}
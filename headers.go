@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Some corporate proxies want a header of their own (eg, X-Proxy-Auth) on
+// every request.  Rather than a long command line, these can be given in the
+// environment, as CART_EXTRA_HEADERS="Key: Value" pairs separated by newlines
+// or commas, and doRequest adds them to everything it sends.
+
+const extraHeadersEnv = "CART_EXTRA_HEADERS"
+
+var extraHeaders http.Header
+
+// parseExtraHeaders parses s, the value of CART_EXTRA_HEADERS.  Headers which
+// carry the token are refused, so that they can't silently replace it.
+func parseExtraHeaders(s string) (http.Header, error) {
+	h := http.Header{}
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		key = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key))
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s: bad header %q: want Key: Value", extraHeadersEnv, line)
+		}
+		switch key {
+		case "Authorization", "Circle-Token":
+			return nil, fmt.Errorf("%s: %s would override the token; see -auth-scheme", extraHeadersEnv, key)
+		}
+		h.Add(key, strings.TrimSpace(value))
+	}
+	return h, nil
+}
+
+func addExtraHeaders(req *http.Request) {
+	for key, values := range extraHeaders {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func Test_extraHeaders(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer ts.Close()
+
+	t.Setenv(extraHeadersEnv, "X-Proxy-Auth: s3cret\nx-team: cart, X-Trace: on")
+	defer func() { extraHeaders = nil }()
+	var err error
+	if extraHeaders, err = parseExtraHeaders(os.Getenv(extraHeadersEnv)); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := doRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	for key, want := range map[string]string{"X-Proxy-Auth": "s3cret", "X-Team": "cart", "X-Trace": "on"} {
+		if got.Get(key) != want {
+			t.Errorf("%s: Expected %q, got %q", key, want, got.Get(key))
+		}
+	}
+
+	for _, bad := range []string{"Authorization: Bearer other", "circle-token: other", "no colon"} {
+		if _, err := parseExtraHeaders(bad); err == nil {
+			t.Errorf("%q: Expected error", bad)
+		}
+	}
+}
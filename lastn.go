@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -last-n, the same artifact is collected from each of the last n
+// builds which match the filters (eg, benchmark results, for a trend), each
+// to the output path with {build} replaced by its build number.  Unless
+// -fail-fast, a build which lacks the artifact doesn't stop the others from
+// being collected.
+
+const buildPlaceholder = "{build}"
+
+// lastNOutputTemplate returns the template for the output paths: that
+// given, which must tell the builds apart, or else the artifact's file name
+// prefixed with the build number.
+func lastNOutputTemplate(outputPath, name string) (string, error) {
+	if outputPath == "" {
+		return buildPlaceholder + "-" + filepath.Base(name), nil
+	}
+	if !strings.Contains(outputPath, buildPlaceholder) {
+		return "", fmt.Errorf("-last-n needs %s in -o, to write each build's artifact to its own file", buildPlaceholder)
+	}
+	return outputPath, nil
+}
+
+// downloadLastN downloads artifact name from each of builds, reporting as it
+// goes, and returns an error if any failed.
+func downloadLastN(opts URLOptions, builds []build, name, tmpl string) error {
+	b := newBatch(true)
+	for _, build := range builds {
+		outputPath := strings.ReplaceAll(tmpl, buildPlaceholder, strconv.Itoa(build.BuildNum))
+		start := time.Now()
+		a, n, err := downloadBuildArtifact(opts, build.BuildNum, name, outputPath)
+		switch {
+		case err != nil:
+			fmt.Fprintf(diag, "build %d: failed: %s\n", build.BuildNum, err)
+		case dryRun:
+			fmt.Fprintf(diag, "build %d: Dry run: skipped download of %s to %s\n", build.BuildNum, name, outputPath)
+		default:
+			fmt.Fprintf(diag, "build %d: Wrote %s (%d bytes) to %s\n", build.BuildNum, name, n, outputPath)
+		}
+		results.record(a, name, outputPath, build.BuildNum, start, n, !dryRun, err)
+		if !b.done(err) {
+			break
+		}
+	}
+	return b.err()
+}
+
+func downloadBuildArtifact(opts URLOptions, buildNum int, name, outputPath string) (artifact, int64, error) {
+	opts.BuildNum = buildNum
+	artifacts, err := fetchBuildArtifacts(context.Background(), opts)
+	if err != nil {
+		return artifact{}, 0, err
+	}
+	a, ok := findArtifact(filterArtifacts(artifacts, artFilter), name)
+	if !ok {
+		return artifact{}, 0, fmt.Errorf("unable to find artifact: %s", name)
+	}
+	if dryRun {
+		return a, 0, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return a, 0, err
+	}
+	n, err := saveArtifact(a, name, outputPath)
+	return a, n, err
+}
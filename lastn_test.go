@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_downloadLastN(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var num int
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/dl/"):
+			fmt.Fprintf(w, "bench of %s", strings.Split(r.URL.Path, "/")[2])
+		case strings.HasSuffix(r.URL.Path, "/artifacts"):
+			fmt.Sscanf(r.URL.Path, "/api/v1.1/project/github/nbio/cart/%d/artifacts", &num)
+			fmt.Fprintf(w, `[{"path": "bench.json", "url": "http://%s/dl/%d/bench.json"}]`, r.Host, num)
+		default:
+			io.WriteString(w, `[
+				{"build_num": 14, "vcs_revision": "4444444444", "outcome": "success"},
+				{"build_num": 13, "vcs_revision": "3333333333", "outcome": "failed"},
+				{"build_num": 12, "vcs_revision": "2222222222", "outcome": "success"},
+				{"build_num": 11, "vcs_revision": "", "outcome": "success"},
+				{"build_num": 10, "vcs_revision": "0000000000", "outcome": "success"}]`)
+		}
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10}
+	picked, _, err := circleFindBuilds(opts, FilterSet{branch: "master", lastN: 3}, "bench.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(picked) != 3 || picked[0].BuildNum != 14 || picked[2].BuildNum != 11 {
+		t.Fatalf("Expected builds 14, 12 and 11, got %+v", picked)
+	}
+
+	dir := t.TempDir()
+	tmpl, err := lastNOutputTemplate(filepath.Join(dir, "{build}", "bench.json"), "bench.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := downloadLastN(opts, picked, "bench.json", tmpl); err != nil {
+		t.Fatal(err)
+	}
+	for _, num := range []string{"14", "12", "11"} {
+		b, err := os.ReadFile(filepath.Join(dir, num, "bench.json"))
+		if err != nil {
+			t.Error(err)
+		} else if want := "bench of " + num; string(b) != want {
+			t.Errorf("Expected %q, got %q", want, b)
+		}
+	}
+
+	if _, err := lastNOutputTemplate("bench.json", "bench.json"); err == nil {
+		t.Errorf("Expected error for -o without {build}")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// -lock serializes cart runs downloading to the same file, eg from parallel
+// CI steps sharing a workspace, which would otherwise interleave their
+// writes.  The download truncates and rewrites the output in place, so the
+// lock is what keeps one run from writing while another does.  It's a flock
+// on a sibling <output>.lock, as the output may not exist yet, and it's only
+// advisory: a reader which doesn't take it may still see a partial file, or
+// one half rewritten.  The .lock file is left behind: removing it would let
+// a waiter lock the unlinked file while a newcomer locks a new one.  The
+// lock is dropped when cart exits, however it exits.
+
+const (
+	defaultLockTimeout = time.Minute
+	lockPollInterval   = 50 * time.Millisecond
+)
+
+var (
+	lockOutput  bool
+	lockTimeout = defaultLockTimeout
+)
+
+var errLockUnsupported = errors.New("file locking unsupported on this platform")
+
+func lockPath(outputPath string) string {
+	return outputPath + ".lock"
+}
+
+// acquireLock locks lockPath(outputPath), waiting up to timeout (or forever,
+// if 0) for another holder to let go.  release unlocks it.
+func acquireLock(outputPath string, timeout time.Duration) (release func(), err error) {
+	path := lockPath(outputPath)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+		}
+		if ok {
+			return func() {
+				unlock(f)
+				f.Close()
+			}, nil
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out after %s waiting for lock %s", timeout, path)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os"
+
+func tryLock(f *os.File) (bool, error) {
+	return false, errLockUnsupported
+}
+
+func unlock(f *os.File) {}
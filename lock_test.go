@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_lockContended(t *testing.T) {
+	defer func(w io.Writer) { diag = w }(diag)
+	diag = io.Discard
+
+	payload := strings.Repeat("x", 1000)
+	var active, most atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		if n > most.Load() {
+			most.Store(n)
+		}
+		time.Sleep(100 * time.Millisecond) // long enough to overlap, unlocked
+		io.WriteString(w, payload)
+	}))
+	defer ts.Close()
+	artifacts := []artifact{{URL: ts.URL + "/0/big.bin", Path: "big.bin"}}
+	out := filepath.Join(t.TempDir(), "big.bin")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			release, err := acquireLock(out, 5*time.Second)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer release()
+			_, errs[i] = downloadArtifact(artifacts, "big.bin", out)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if most.Load() != 1 {
+		t.Errorf("Expected the downloads serialized, got %d at once", most.Load())
+	}
+	if b, err := os.ReadFile(out); err != nil || string(b) != payload {
+		t.Errorf("Expected the payload intact, got %d bytes, %v", len(b), err)
+	}
+
+	release, err := acquireLock(out, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := acquireLock(out, 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected a timeout while the lock is held, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A job polling for new builds, eg from cron, wants to download only when
+// there is something new.  -since-marker (or -marker, for short) names a
+// file recording the build last downloaded; if the build found is no newer,
+// cart says so and stops.  With -marker-on build, newer means a higher build
+// number; with -marker-on rev, a different revision, so that re-runs of the
+// same code are not new.
+
+const defaultMarkerOn = "build"
+
+var (
+	markerPath string
+	markerOn   = defaultMarkerOn
+)
+
+type marker struct {
+	BuildNum int    `json:"build_num"`
+	Revision string `json:"vcs_revision"`
+}
+
+func validMarkerOn(on string) bool {
+	return on == "build" || on == "rev"
+}
+
+// readMarker reads the marker at path, reporting false if there is none yet.
+func readMarker(path string) (marker, bool, error) {
+	var m marker
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, false, fmt.Errorf("-since-marker %s: %w", path, err)
+	}
+	return m, true, nil
+}
+
+// isNew tells whether b is new since m, comparing on "build" or "rev".
+func (m marker) isNew(b build, on string) bool {
+	if on == "rev" {
+		return b.Revision != m.Revision
+	}
+	return b.BuildNum > m.BuildNum
+}
+
+// writeMarker records b at path, by rename so that an interrupted write
+// leaves the old marker.
+func writeMarker(path string, b build) error {
+	data, err := json.Marshal(marker{b.BuildNum, b.Revision})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".cart-marker-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// markDone records b at path once the run is done, unless a batch which kept
+// going failed: the next run should retry what this one didn't finish.
+func markDone(path string, b build) error {
+	if batchFailed {
+		verboseln("Marker not written: the batch failed")
+		return nil
+	}
+	return writeMarker(path, b)
+}
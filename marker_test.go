@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func Test_markerOnBuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "marker.json")
+	if _, ok, err := readMarker(path); err != nil || ok {
+		t.Fatalf("Expected no marker yet, got %v, %v", ok, err)
+	}
+	if err := writeMarker(path, build{BuildNum: 10, Revision: "abc1234"}); err != nil {
+		t.Fatal(err)
+	}
+	m, ok, err := readMarker(path)
+	if err != nil || !ok {
+		t.Fatalf("Expected the marker, got %v, %v", ok, err)
+	}
+	for _, tc := range []struct {
+		b    build
+		want bool
+	}{
+		{build{BuildNum: 11, Revision: "abc1234"}, true}, // a re-run is new by number
+		{build{BuildNum: 10, Revision: "abc1234"}, false},
+		{build{BuildNum: 9, Revision: "def5678"}, false},
+	} {
+		if got := m.isNew(tc.b, "build"); got != tc.want {
+			t.Errorf("Expected %+v new: %v, got %v", tc.b, tc.want, got)
+		}
+	}
+}
+
+func Test_markerOnRev(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "marker.json")
+	if err := writeMarker(path, build{BuildNum: 10, Revision: "abc1234"}); err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := readMarker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		b    build
+		want bool
+	}{
+		{build{BuildNum: 11, Revision: "abc1234"}, false}, // a re-run of the same code
+		{build{BuildNum: 10, Revision: "abc1234"}, false},
+		{build{BuildNum: 12, Revision: "def5678"}, true},
+	} {
+		if got := m.isNew(tc.b, "rev"); got != tc.want {
+			t.Errorf("Expected %+v new: %v, got %v", tc.b, tc.want, got)
+		}
+	}
+}
+
+func Test_markDoneBatchFailed(t *testing.T) {
+	defer func(f bool) { batchFailed = f }(batchFailed)
+	path := filepath.Join(t.TempDir(), "marker.json")
+
+	batchFailed = true
+	if err := markDone(path, build{BuildNum: 10, Revision: "abc1234"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := readMarker(path); err != nil || ok {
+		t.Errorf("Expected no marker after a failed batch, got %v, %v", ok, err)
+	}
+
+	batchFailed = false
+	if err := markDone(path, build{BuildNum: 10, Revision: "abc1234"}); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok, err := readMarker(path); err != nil || !ok || m.BuildNum != 10 {
+		t.Errorf("Expected the marker after success, got %+v, %v, %v", m, ok, err)
+	}
+}
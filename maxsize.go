@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// -max-size refuses artifacts larger than expected, eg a debug build
+// uploaded by mistake.  When the server gives the size, a larger artifact is
+// refused before anything is written.  Some storage backends send the body
+// chunked, with no size, so the limit is enforced again while reading: the
+// download is abandoned as soon as it exceeds the limit, leaving what was
+// written so far.  Without a size there is also no check that the whole
+// body arrived, and -progress shows a running count, without a percentage.
+
+var (
+	maxSize int64 // or 0 for no limit
+
+	errTooLarge = errors.New("larger than -max-size")
+)
+
+// checkMaxSize refuses a size given by the server over maxSize.
+func checkMaxSize(name string, size int64) error {
+	if maxSize > 0 && size > maxSize {
+		return fmt.Errorf("%s: %w: the server says %d bytes, over %d", name, errTooLarge, size, maxSize)
+	}
+	return nil
+}
+
+// maxSizeReader reads from r until more than max bytes have been read, when
+// it fails.
+type maxSizeReader struct {
+	r    io.Reader
+	name string
+	max  int64
+	n    int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if room := m.max - m.n + 1; int64(len(p)) > room {
+		p = p[:room] // one over is enough to know
+	}
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if m.n > m.max {
+		return n, fmt.Errorf("%s: %w: got over %d bytes", m.name, errTooLarge, m.max)
+	}
+	return n, err
+}
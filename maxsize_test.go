@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_maxSizeChunked(t *testing.T) {
+	defer func(n int64) { maxSize = n }(maxSize)
+	body := strings.Repeat("x", 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sized" {
+			io.WriteString(w, body)
+			return
+		}
+		// Flushed before done, so sent chunked, with no Content-Length.
+		for i := 0; i < 10; i++ {
+			io.WriteString(w, body[:100])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	chunked := artifact{Path: "chunked", URL: ts.URL + "/chunked"}
+
+	n, err := saveArtifact(chunked, "chunked", filepath.Join(dir, "a"))
+	if err != nil || n != 1000 {
+		t.Errorf("no -max-size: Expected 1000 bytes, got %d (%v)", n, err)
+	}
+
+	maxSize = 1000
+	if n, err := saveArtifact(chunked, "chunked", filepath.Join(dir, "b")); err != nil || n != 1000 {
+		t.Errorf("at -max-size: Expected 1000 bytes, got %d (%v)", n, err)
+	}
+
+	maxSize = 250
+	n, err = saveArtifact(chunked, "chunked", filepath.Join(dir, "c"))
+	if !errors.Is(err, errTooLarge) {
+		t.Errorf("over -max-size: Expected %v, got %v", errTooLarge, err)
+	}
+	if n > maxSize+1 {
+		t.Errorf("Expected the download abandoned at the limit, got %d bytes", n)
+	}
+
+	sized := artifact{Path: "sized", URL: ts.URL + "/sized"}
+	n, err = saveArtifact(sized, "sized", filepath.Join(dir, "d"))
+	if !errors.Is(err, errTooLarge) || n != 0 {
+		t.Errorf("sized: Expected %v before writing, got %d bytes (%v)", errTooLarge, n, err)
+	}
+}
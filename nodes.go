@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -node narrows artifacts to those of some nodes of a parallel build: one
+// (-node 2), a range (-node 2-5), or a list of either (-node 0,2,4-6).  With
+// several nodes and an <artifact>, the artifact is downloaded from each of
+// them, to the output path with {node} replaced by the node index.
+
+const nodePlaceholder = "{node}"
+
+// maxNodeIndex is the highest node index -node takes, well beyond any
+// build's parallelism, so that a range can't run away with memory.
+const maxNodeIndex = 999
+
+// nodeSet is a sorted set of node indexes; nil for any node.
+type nodeSet []int
+
+func parseNodeSet(s string) (nodeSet, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n < 0 {
+		return nil, nil // negative for any, as ever
+	}
+	seen := map[int]bool{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		lo, hi, isRange := strings.Cut(field, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("bad -node %q: want node indexes, eg 2, 2-5 or 0,2,4", field)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("bad -node range %q: want low-high, eg 2-5", field)
+			}
+		}
+		if last > maxNodeIndex {
+			return nil, fmt.Errorf("bad -node %q: node indexes go up to %d", field, maxNodeIndex)
+		}
+		for i := first; i <= last; i++ {
+			seen[i] = true
+		}
+	}
+	nodes := make(nodeSet, 0, len(seen))
+	for i := range seen {
+		nodes = append(nodes, i)
+	}
+	sort.Ints(nodes)
+	return nodes, nil
+}
+
+func (s nodeSet) has(node int) bool {
+	i := sort.SearchInts(s, node)
+	return i < len(s) && s[i] == node
+}
+
+func (s nodeSet) String() string {
+	if s == nil {
+		return ""
+	}
+	parts := make([]string, len(s))
+	for i, n := range s {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+// missingNodes returns those of nodes from which none of the build's
+// artifacts came: likely beyond its parallelism.
+func missingNodes(artifacts []artifact, nodes nodeSet) []int {
+	have := map[int]bool{}
+	for _, a := range artifacts {
+		have[a.NodeIndex] = true
+	}
+	var missing []int
+	for _, n := range nodes {
+		if !have[n] {
+			missing = append(missing, n)
+		}
+	}
+	return missing
+}
+
+// nodeOutputTemplate returns the template for the output paths: that given,
+// which must tell the nodes apart, or else the artifact's file name prefixed
+// with the node index.
+func nodeOutputTemplate(outputPath, name string) (string, error) {
+	if outputPath == "" {
+		return nodePlaceholder + "-" + filepath.Base(name), nil
+	}
+	if !strings.Contains(outputPath, nodePlaceholder) {
+		return "", fmt.Errorf("-node with several nodes needs %s in -o, to write each node's artifact to its own file", nodePlaceholder)
+	}
+	return outputPath, nil
+}
+
+// downloadNodes downloads artifact name from each node among artifacts,
+// reporting as it goes, and returns an error if any failed.
+func downloadNodes(artifacts []artifact, name, tmpl string) error {
+	b := newBatch(true)
+	found := false
+	for _, a := range artifacts {
+		if !matchArtifact(a, name) {
+			continue
+		}
+		found = true
+		outputPath := strings.ReplaceAll(tmpl, nodePlaceholder, strconv.Itoa(a.NodeIndex))
+		start := time.Now()
+		if dryRun {
+			fmt.Fprintf(diag, "node %d: Dry run: skipped download of %s to %s\n", a.NodeIndex, name, outputPath)
+			results.record(a, name, outputPath, 0, start, 0, false, nil)
+			continue
+		}
+		n, err := saveArtifact(a, name, outputPath)
+		if err != nil {
+			fmt.Fprintf(diag, "node %d: failed: %s\n", a.NodeIndex, err)
+		} else {
+			fmt.Fprintf(diag, "node %d: Wrote %s (%d bytes) to %s\n", a.NodeIndex, name, n, outputPath)
+		}
+		results.record(a, name, outputPath, 0, start, n, true, err)
+		if !b.done(err) {
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("unable to find artifact: %s", name)
+	}
+	return b.err()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_parseNodeSet(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want nodeSet
+	}{
+		{"", nil},
+		{"-1", nil},
+		{"3", nodeSet{3}},
+		{"2-5", nodeSet{2, 3, 4, 5}},
+		{"0,2,4", nodeSet{0, 2, 4}},
+		{"4, 0-1,1", nodeSet{0, 1, 4}},
+	} {
+		got, err := parseNodeSet(tc.s)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: Expected %v, got %v (%v)", tc.s, tc.want, got, err)
+		}
+	}
+	for _, s := range []string{"5-2", "1,-2", "a", "2-", "1,,2", "1000", "0-99999999999", "0-9223372036854775807"} {
+		if _, err := parseNodeSet(s); err == nil {
+			t.Errorf("%q: Expected error", s)
+		}
+	}
+
+	if got, err := parseNodeSet("0-999"); err != nil || len(got) != maxNodeIndex+1 {
+		t.Errorf("Expected all %d node indexes, got %d (%v)", maxNodeIndex+1, len(got), err)
+	}
+
+	artifacts := []artifact{{NodeIndex: 0}, {NodeIndex: 1}, {NodeIndex: 2}, {NodeIndex: 3}}
+	nodes, _ := parseNodeSet("2-5")
+	if got := filterArtifacts(artifacts, ArtifactFilter{nodes: nodes}); len(got) != 2 || got[0].NodeIndex != 2 || got[1].NodeIndex != 3 {
+		t.Errorf("Expected the artifacts of nodes 2 and 3, got %+v", got)
+	}
+	if got := missingNodes(artifacts, nodes); !reflect.DeepEqual(got, []int{4, 5}) {
+		t.Errorf("Expected nodes 4 and 5 out of range, got %v", got)
+	}
+}
+
+func Test_downloadNodes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer ts.Close()
+	defer func(w io.Writer) { diag = w }(diag)
+	diag = io.Discard
+
+	all := []artifact{
+		{Path: "results.xml", NodeIndex: 0, URL: ts.URL + "/0/results.xml"},
+		{Path: "results.xml", NodeIndex: 2, URL: ts.URL + "/2/results.xml"},
+		{Path: "other.txt", NodeIndex: 2, URL: ts.URL + "/2/other.txt"},
+		{Path: "results.xml", NodeIndex: 4, URL: ts.URL + "/4/results.xml"},
+	}
+	nodes, _ := parseNodeSet("0,4")
+	dir := t.TempDir()
+	tmpl, err := nodeOutputTemplate(filepath.Join(dir, "{node}.xml"), "results.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := downloadNodes(filterArtifacts(all, ArtifactFilter{nodes: nodes}), "results.xml", tmpl); err != nil {
+		t.Fatal(err)
+	}
+	for node, want := range map[string]string{"0": "/0/results.xml", "4": "/4/results.xml"} {
+		if b, err := os.ReadFile(filepath.Join(dir, node+".xml")); err != nil || string(b) != want {
+			t.Errorf("node %s: Expected %q, got %q (%v)", node, want, b, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2.xml")); err == nil {
+		t.Errorf("Expected nothing from node 2")
+	}
+
+	if _, err := nodeOutputTemplate("out.xml", "results.xml"); err == nil {
+		t.Errorf("Expected -o without %s to be refused", nodePlaceholder)
+	}
+	if got, _ := nodeOutputTemplate("", "reports/results.xml"); got != "{node}-results.xml" {
+		t.Errorf("Expected the default template {node}-results.xml, got %q", got)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// Everything cart writes goes to the writers of output rather than straight
+// to os.Stdout and os.Stderr, so that code embedding cart can capture it,
+// eg into its own logging, with SetOutput.
+
+// Output is where cart writes: Out for what was asked for (lists, JSON,
+// and messages unless those go to Err), Err for warnings, errors and the
+// like, and Progress for -progress.
+type Output struct {
+	Out      io.Writer
+	Err      io.Writer
+	Progress io.Writer
+}
+
+var output = Output{Out: os.Stdout, Err: os.Stderr, Progress: os.Stderr}
+
+// SetOutput directs cart's output, including that of the log package, to o.
+func SetOutput(o Output) {
+	output = o
+	diag = o.Out
+	log.SetOutput(o.Err)
+}
+
+// progressTerminal tells whether -progress goes to a terminal, on which each
+// report can overwrite the last.
+func progressTerminal() bool {
+	f, ok := output.Progress.(*os.File)
+	return ok && isTerminal(f)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_SetOutput(t *testing.T) {
+	defer SetOutput(output)
+	defer func(f int) { log.SetFlags(f) }(log.Flags())
+	defer func(s bool) { showProgress = s }(showProgress)
+	var out, errs, prog bytes.Buffer
+	SetOutput(Output{Out: &out, Err: &errs, Progress: &prog})
+	log.SetFlags(0)
+	showProgress = true
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+	a := artifact{Path: "a.txt", URL: ts.URL + "/0/a.txt"}
+	if _, err := downloadArtifact([]artifact{a}, "a.txt", filepath.Join(t.TempDir(), "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(diag, "a message")
+	log.Print("a warning")
+	writeArtifactList(output.Out, []artifact{a}, false)
+
+	if !strings.Contains(prog.String(), "a.txt: 5 of 5 bytes") {
+		t.Errorf("Expected the progress captured, got %q", prog.String())
+	}
+	if !strings.Contains(out.String(), "a message") || !strings.Contains(out.String(), `path "a.txt"`) {
+		t.Errorf("Expected the messages and list captured, got %q", out.String())
+	}
+	if errs.String() != "a warning\n" {
+		t.Errorf("Expected the warning captured, got %q", errs.String())
+	}
+}
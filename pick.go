@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// -pick lists the artifacts on stderr and reads the ones to download from
+// stdin, for choosing interactively, eg with: cart -l | fzf | cart -pick
+// Each line picked may be a line of -list-artifacts (with or without -long),
+// or just an artifact's path.  Closed or empty stdin picks nothing.
+
+var listedPath = regexp.MustCompile(`path ("(?:[^"\\]|\\.)*")`)
+
+// pickedPath returns the artifact path of a line picked.
+func pickedPath(line string) string {
+	if m := listedPath.FindStringSubmatch(line); m != nil {
+		if p, err := strconv.Unquote(m[1]); err == nil {
+			return p
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+// readPicks returns those of artifacts picked by the lines of r, in the
+// order picked.
+func readPicks(r io.Reader, artifacts []artifact) ([]artifact, error) {
+	var picked []artifact
+	seen := map[string]bool{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		p := pickedPath(s.Text())
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		found := false
+		for _, a := range artifacts {
+			if a.Path == p {
+				picked = append(picked, a)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("-pick: no artifact %q", p)
+		}
+	}
+	return picked, s.Err()
+}
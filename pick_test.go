@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_readPicks(t *testing.T) {
+	artifacts := []artifact{
+		{Path: "bin/cart", URL: "https://example.com/0/bin/cart", NodeIndex: 0},
+		{Path: "bin/cart.exe", URL: "https://example.com/0/bin/cart.exe", NodeIndex: 0},
+		{Path: `docs/"quoted".txt`, URL: "https://example.com/1/docs/quoted.txt", NodeIndex: 1},
+	}
+	var list bytes.Buffer
+	writeArtifactList(&list, artifacts, false)
+	lines := strings.SplitAfter(list.String(), "\n")
+
+	// a list line, as fzf would pass on, and a bare path
+	picked, err := readPicks(strings.NewReader(lines[2]+"bin/cart\n"), artifacts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(picked) != 2 || picked[0].Path != artifacts[2].Path || picked[1].Path != "bin/cart" {
+		t.Errorf("Expected %q and %q, got %+v", artifacts[2].Path, "bin/cart", picked)
+	}
+
+	for _, empty := range []string{"", "\n\n"} {
+		if picked, err := readPicks(strings.NewReader(empty), artifacts); err != nil || len(picked) != 0 {
+			t.Errorf("%q: Expected nothing picked, got %+v (%v)", empty, picked, err)
+		}
+	}
+	if _, err := readPicks(strings.NewReader("bin/gone\n"), artifacts); err == nil {
+		t.Errorf("Expected error for an unknown artifact")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A run of cart with -all, -last-n or -workflow-artifacts can make a lot of
+// requests, and CircleCI rate-limits its API.  Under -dry-run, cart reports
+// beforehand how many it plans to make, by the kinds which apiCalls counts,
+// before retries.  How many artifacts a build has isn't known until its list
+// is fetched, so requests made for each artifact are counted separately, as
+// are those made only if need be, eg looking into running builds.
+
+// planOptions are the settings which decide the requests of a run.
+type planOptions struct {
+	preflight         bool // check the token first
+	pinned            bool // -build, -from-url or -workflow-url: no search
+	workflowURL       bool // the build is found among a workflow's jobs
+	superseded        bool // -warn-if-superseded or -fail-if-superseded
+	searchDepth       int
+	includeRunning    bool
+	requireArtifact   bool
+	triggerTypes      bool // -trigger-type: a pipeline looked up per workflow run
+	lastN             int
+	all               bool // -all or -pick
+	workflowArtifacts bool
+	probeEach         bool // eg -download-order size
+	probeOne          bool // eg -use-server-filename
+	nodes             int  // -node, with <artifact>: downloads from each
+}
+
+// requestPlan counts requests by kind: certain ones, ones for each
+// artifact, and ones made at most so many times, if need be.
+type requestPlan struct {
+	fixed, perArtifact, upTo map[string]int
+}
+
+func planRequests(o planOptions) requestPlan {
+	p := requestPlan{map[string]int{}, map[string]int{}, map[string]int{}}
+	if o.preflight {
+		p.fixed[callMe]++
+	}
+	if o.workflowURL {
+		p.fixed[callWorkflowJobs]++
+	}
+	if o.superseded {
+		p.fixed[callBuild]++
+		p.fixed[callBuildList]++
+	}
+	if !o.pinned {
+		p.fixed[callBuildList]++
+		if o.includeRunning || o.requireArtifact {
+			p.upTo[callArtifactList] += o.searchDepth
+		}
+		if o.triggerTypes {
+			p.upTo[callWorkflow] += o.searchDepth
+			p.upTo[callPipeline] += o.searchDepth
+		}
+	}
+	switch {
+	case o.lastN > 0:
+		p.fixed[callArtifactList] += o.lastN
+		p.fixed[callDownload] += o.lastN
+	case o.workflowArtifacts:
+		// A list for each build of the workflow, among those searched.
+		p.upTo[callArtifactList] += o.searchDepth
+		p.perArtifact[callDownload]++
+	case o.all:
+		p.fixed[callArtifactList]++
+		p.perArtifact[callDownload]++
+	case o.nodes > 1:
+		p.fixed[callArtifactList]++
+		p.fixed[callDownload] += o.nodes
+	default:
+		p.fixed[callArtifactList]++
+		p.fixed[callDownload]++
+	}
+	if o.probeEach {
+		p.perArtifact[callProbe]++
+	}
+	if o.probeOne {
+		p.fixed[callProbe]++
+	}
+	return p
+}
+
+// String summarizes p, eg "3 requests: build-list 1, download 2, and for
+// each artifact: probe 1".
+func (p requestPlan) String() string {
+	total := 0
+	for _, n := range p.fixed {
+		total += n
+	}
+	s := fmt.Sprintf("%d requests: %s", total, callCounts(p.fixed))
+	if len(p.perArtifact) > 0 {
+		s += ", and for each artifact: " + callCounts(p.perArtifact)
+	}
+	if len(p.upTo) > 0 {
+		s += ", and if need be up to: " + callCounts(p.upTo)
+	}
+	return s
+}
+
+// callCounts lists counts by kind, eg "build-list 1, download 2".
+func callCounts(counts map[string]int) string {
+	kinds := make([]string, 0, len(counts))
+	for kind, n := range counts {
+		kinds = append(kinds, fmt.Sprintf("%s %d", kind, n))
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, ", ")
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func Test_planRequests(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    planOptions
+		want string
+	}{
+		{"one artifact", planOptions{searchDepth: 30},
+			"3 requests: artifact-list 1, build-list 1, download 1"},
+		{"pinned", planOptions{pinned: true, nodes: 3},
+			"4 requests: artifact-list 1, download 3"},
+		{"last-n", planOptions{preflight: true, searchDepth: 100, lastN: 5},
+			"12 requests: artifact-list 5, build-list 1, download 5, me 1"},
+		{"all by size", planOptions{preflight: true, searchDepth: 30, all: true, probeEach: true},
+			"3 requests: artifact-list 1, build-list 1, me 1, and for each artifact: download 1, probe 1"},
+		{"workflow", planOptions{searchDepth: 50, includeRunning: true, workflowArtifacts: true},
+			"1 requests: build-list 1, and for each artifact: download 1, and if need be up to: artifact-list 100"},
+		{"workflow url", planOptions{pinned: true, workflowURL: true, superseded: true, probeOne: true},
+			"6 requests: artifact-list 1, build 1, build-list 1, download 1, probe 1, workflow-jobs 1"},
+		{"trigger type", planOptions{searchDepth: 30, triggerTypes: true},
+			"3 requests: artifact-list 1, build-list 1, download 1, and if need be up to: pipeline 30, workflow 30"},
+	} {
+		if got := planRequests(tc.o).String(); got != tc.want {
+			t.Errorf("%s: Expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
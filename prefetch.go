@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+)
+
+// With -prefetch, once the list of recent builds arrives we guess which
+// build will be picked (the most recent success) and start fetching its
+// artifact list while pickBuild confirms the filters, which may itself mean
+// more requests for running builds.  If the guess was right, that's a round
+// trip saved; if not, the prefetch is cancelled and discarded.
+
+var (
+	prefetch   bool
+	prefetched *artifactPrefetch
+)
+
+type artifactPrefetch struct {
+	buildNum  int
+	cancel    context.CancelFunc
+	done      chan struct{}
+	artifacts []artifact
+	err       error
+}
+
+func startPrefetch(opts URLOptions, buildNum int) *artifactPrefetch {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &artifactPrefetch{buildNum: buildNum, cancel: cancel, done: make(chan struct{})}
+	opts.BuildNum = buildNum
+	go func() {
+		defer close(p.done)
+		p.artifacts, p.err = fetchBuildArtifacts(ctx, opts)
+	}()
+	return p
+}
+
+// prefetchCandidate returns the build number which pickBuild is most likely
+// to choose, or 0 if there's no good guess.
+func prefetchCandidate(builds []build) int {
+	for _, b := range builds {
+		if b.Outcome == "success" {
+			return b.BuildNum
+		}
+	}
+	return 0
+}
+
+// take returns the prefetched artifacts if they are those of buildNum, and
+// were fetched without error.  Otherwise the prefetch is abandoned, and the
+// caller should fetch the list itself.
+func (p *artifactPrefetch) take(buildNum int) ([]artifact, bool) {
+	if p == nil {
+		return nil, false
+	}
+	if p.buildNum != buildNum {
+		verbosef("prefetch: guessed build %d, but found %d\n", p.buildNum, buildNum)
+		p.cancel()
+		return nil, false
+	}
+	<-p.done
+	p.cancel()
+	if p.err != nil {
+		verboseln("prefetch:", p.err)
+		return nil, false
+	}
+	return p.artifacts, true
+}
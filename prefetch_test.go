@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_prefetchWrongCandidate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/12/artifacts"):
+			io.WriteString(w, `[{"path": "nightly/cart", "url": "https://example.com/12/nightly/cart"}]`)
+		case strings.HasSuffix(r.URL.Path, "/11/artifacts"):
+			io.WriteString(w, `[{"path": "bin/cart", "url": "https://example.com/11/bin/cart"}]`)
+		default:
+			// 12 is the most recent success, but of the wrong workflow.
+			io.WriteString(w, `[
+				{"build_num": 12, "vcs_revision": "0123456789abcdef", "outcome": "success",
+					"workflows": {"job_name": "build", "workflow_name": "nightly", "workflow_id": "w2"}},
+				{"build_num": 11, "vcs_revision": "0123456789abcdef", "outcome": "success",
+					"workflows": {"job_name": "build", "workflow_name": "commit", "workflow_id": "w1"}}]`)
+		}
+	}))
+	defer ts.Close()
+
+	defer func() { prefetch, prefetched = false, nil }()
+	prefetch = true
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10}
+	found, _, err := circleFindBuild(opts, FilterSet{branch: "master", workflow: "commit"}, "bin/cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.BuildNum != 11 {
+		t.Fatalf("Expected build 11, got %d", found.BuildNum)
+	}
+	if prefetched == nil || prefetched.buildNum != 12 {
+		t.Fatalf("Expected a prefetch of build 12, got %+v", prefetched)
+	}
+	if artifacts, ok := prefetched.take(found.BuildNum); ok {
+		t.Errorf("Expected the prefetch of build 12 to be discarded, got %+v", artifacts)
+	}
+
+	found, _, err = circleFindBuild(opts, FilterSet{branch: "master", workflow: "nightly"}, "nightly/cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifacts, ok := prefetched.take(found.BuildNum)
+	if !ok || len(artifacts) != 1 || artifacts[0].Path != "nightly/cart" {
+		t.Errorf("Expected the prefetched artifacts of build 12, got %+v", artifacts)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -probe checks that an artifact exists, and what it is, without
+// downloading it: a HEAD request, or for servers which reject HEAD, a GET of
+// its first byte, whose Content-Range gives the full size.
+
+type probeResult struct {
+	Status        string
+	ContentLength int64 // -1 if unknown
+	ContentType   string
+	LastModified  string
+
+	ContentDisposition string // for -use-server-filename
+}
+
+// headTimeout bounds each probe for an artifact's size, for -probe-all and
+// the like, so that a few slow responses from storage don't stall them all;
+// a probe which times out leaves that size unknown.
+var headTimeout = defaultHeadTimeout
+
+const defaultHeadTimeout = 5 * time.Second
+
+func probeArtifact(ctx context.Context, a artifact) (probeResult, error) {
+	u, err := artifactURL(a, false)
+	if err != nil {
+		return probeResult{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u, nil)
+	if err != nil {
+		return probeResult{}, err
+	}
+	res, err := doRequest(req)
+	if err != nil {
+		return probeResult{}, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed && res.StatusCode != http.StatusNotImplemented {
+		return newProbeResult(res), nil
+	}
+
+	verbosef("probe: HEAD responded %s, trying a ranged GET\n", res.Status)
+	if req, err = http.NewRequestWithContext(ctx, "GET", u, nil); err != nil {
+		return probeResult{}, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	if res, err = doRequest(req); err != nil {
+		return probeResult{}, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1))
+	p := newProbeResult(res)
+	if res.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-0/12345
+		p.Status = "200 OK"
+		p.ContentLength = -1
+		if _, total, ok := strings.Cut(res.Header.Get("Content-Range"), "/"); ok {
+			if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+				p.ContentLength = n
+			}
+		}
+	}
+	return p, nil
+}
+
+func newProbeResult(res *http.Response) probeResult {
+	return probeResult{
+		Status:        res.Status,
+		ContentLength: res.ContentLength,
+		ContentType:   res.Header.Get("Content-Type"),
+		LastModified:  res.Header.Get("Last-Modified"),
+
+		ContentDisposition: res.Header.Get("Content-Disposition"),
+	}
+}
+
+func writeProbe(w io.Writer, p probeResult) {
+	fmt.Fprintf(w, "Status: %s\n", p.Status)
+	if p.ContentLength >= 0 {
+		fmt.Fprintf(w, "Content-Length: %d\n", p.ContentLength)
+	} else {
+		fmt.Fprintln(w, "Content-Length: unknown")
+	}
+	fmt.Fprintf(w, "Content-Type: %s\n", p.ContentType)
+	fmt.Fprintf(w, "Last-Modified: %s\n", p.LastModified)
+}
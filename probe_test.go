@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_probeArtifact(t *testing.T) {
+	const payload = "0123456789"
+	for _, headOK := range []bool{true, false} {
+		var ranged bool
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" && !headOK {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			ranged = ranged || r.Header.Get("Range") != ""
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			http.ServeContent(w, r, "cart.txt", time.Time{}, strings.NewReader(payload))
+		}))
+
+		p, err := probeArtifact(context.Background(), artifact{URL: ts.URL + "/cart.txt"})
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != "200 OK" || p.ContentLength != int64(len(payload)) || !strings.HasPrefix(p.ContentType, "text/plain") {
+			t.Errorf("HEAD ok %v: Expected 200 OK of %d text/plain bytes, got %+v", headOK, len(payload), p)
+		}
+		if ranged == headOK {
+			t.Errorf("HEAD ok %v: Expected ranged GET %v, got %v", headOK, !headOK, ranged)
+		}
+
+		out := new(bytes.Buffer)
+		writeProbe(out, p)
+		if want := "Content-Length: 10\nContent-Type: text/plain; charset=utf-8\nLast-Modified: Mon, 02 Jan 2006 15:04:05 GMT\n"; !strings.HasSuffix(out.String(), want) {
+			t.Errorf("Expected %q in %q", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// -probe-all tells how much an -all download would fetch, without fetching
+// it: the size of each artifact which passes the filters is probed (as for
+// -probe), a few at a time, and the total printed.  Artifacts whose size
+// the server doesn't give are counted apart, rather than as 0 bytes.
+
+const probeConcurrency = 4
+
+type sizeSummary struct {
+	Files        int   `json:"files"`
+	Bytes        int64 `json:"bytes"`         // of the files of known size
+	UnknownFiles int   `json:"unknown_files"` // not in Bytes
+}
+
+// probeSizes sums the sizes of artifacts, as given by sizeOf (-1 for
+// unknown), calling it for at most concurrency artifacts at once.
+func probeSizes(artifacts []artifact, sizeOf func(artifact) int64, concurrency int) sizeSummary {
+	sizes := probeEach(artifacts, sizeOf, concurrency)
+	s := sizeSummary{Files: len(artifacts)}
+	for _, n := range sizes {
+		if n < 0 {
+			s.UnknownFiles++
+			continue
+		}
+		s.Bytes += n
+	}
+	return s
+}
+
+// probeEach returns the size of each of artifacts, as given by sizeOf,
+// calling it for at most concurrency artifacts at once.
+func probeEach(artifacts []artifact, sizeOf func(artifact) int64, concurrency int) []int64 {
+	sizes := make([]int64, len(artifacts))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, a := range artifacts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, a artifact) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			sizes[i] = sizeOf(a)
+		}(i, a)
+	}
+	wg.Wait()
+	return sizes
+}
+
+func writeSizeSummary(w io.Writer, s sizeSummary, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(struct {
+			jsonHeader
+			Sizes sizeSummary `json:"sizes"`
+		}{newJSONHeader(), s})
+	}
+	_, err := fmt.Fprintf(w, "artifacts: %d files, %d bytes", s.Files, s.Bytes)
+	if err == nil && s.UnknownFiles > 0 {
+		_, err = fmt.Fprintf(w, ", and %d of unknown size", s.UnknownFiles)
+	}
+	if err == nil {
+		_, err = fmt.Fprintln(w)
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_probeSizes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".log") {
+			// Streamed, with no size.
+			w.(http.Flusher).Flush()
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(r.URL.Path)*100))
+	}))
+	defer ts.Close()
+
+	var artifacts []artifact
+	for _, p := range []string{"/0/a.bin", "/0/bb.bin", "/1/ccc.bin", "/1/test.log"} {
+		artifacts = append(artifacts, artifact{Path: p[3:], URL: ts.URL + p})
+	}
+	s := probeSizes(artifacts, artifactSize, probeConcurrency)
+	want := sizeSummary{Files: 4, Bytes: 800 + 900 + 1000, UnknownFiles: 1}
+	if s != want {
+		t.Errorf("Expected %+v, got %+v", want, s)
+	}
+	var out bytes.Buffer
+	if err := writeSizeSummary(&out, s, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "artifacts: 4 files, 2700 bytes, and 1 of unknown size\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func Test_probeSizesBounded(t *testing.T) {
+	var mu sync.Mutex
+	running, most := 0, 0
+	sizeOf := func(artifact) int64 {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return 10
+	}
+	s := probeSizes(make([]artifact, 20), sizeOf, 3)
+	if s.Files != 20 || s.Bytes != 200 {
+		t.Errorf("Expected 20 files of 200 bytes, got %+v", s)
+	}
+	if most > 3 {
+		t.Errorf("Expected at most 3 probes at once, got %d", most)
+	}
+}
+
+func Test_probeSizesHeadTimeout(t *testing.T) {
+	defer func(d time.Duration) { headTimeout = d }(headTimeout)
+	headTimeout = 50 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "slow") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("Content-Length", "100")
+	}))
+	defer ts.Close()
+
+	var artifacts []artifact
+	for _, p := range []string{"a", "slow-b", "c", "slow-d", "e", "f"} {
+		artifacts = append(artifacts, artifact{Path: p, URL: ts.URL + "/0/" + p})
+	}
+	start := time.Now()
+	s := probeSizes(artifacts, artifactSize, 2)
+	if want := (sizeSummary{Files: 6, Bytes: 400, UnknownFiles: 2}); s != want {
+		t.Errorf("Expected %+v, got %+v", want, s)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the slow probes given up promptly, took %s", elapsed)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -progress shows how far along a download is, on stderr.  Reads of a large
+// artifact come thousands of times a second, so rather than report on each,
+// reads only count bytes, and a ticker reports at most every
+// -progress-interval.
+//
+// On a terminal, each report overwrites the last.  In a CI log, where a
+// carriage return doesn't, that would be a mess, so by default (-progress
+// auto) there is no progress shown in CI or other than to a terminal;
+// -progress always shows plain lines there instead.
+//
+// -progress-json is for front-ends drawing their own: each report is an
+// NDJSON event, with the byte rate so far, to stdout, stderr or a file (eg a
+// FIFO), whether or not there's a terminal, on the same -progress-interval.
+
+const (
+	defaultProgressInterval = 500 * time.Millisecond
+
+	progressAlways = "always"
+	progressAuto   = "auto"
+	progressNever  = "never"
+)
+
+var (
+	progressMode     = progressAuto
+	showProgress     bool
+	plainProgress    bool // a line per report, not overwriting
+	progressInterval = defaultProgressInterval
+	progressJSON     string         // stdout, stderr or a file, for -progress-json
+	progressJSONOut  io.WriteCloser // where progressJSON leads
+)
+
+// progressEvent is a -progress-json report.  Total is omitted if unknown.
+// Each event has the header, as it's the whole of a line of the output.
+type progressEvent struct {
+	jsonHeader
+	Artifact string `json:"artifact"`
+	Bytes    int64  `json:"bytes"`
+	Total    *int64 `json:"total,omitempty"`
+	Rate     int64  `json:"rate"` // bytes a second, so far
+}
+
+// openProgressJSON opens the -progress-json stream named.  Closing it
+// closes a file, but not stdout or stderr.
+func openProgressJSON(name string) (io.WriteCloser, error) {
+	switch name {
+	case "stdout":
+		return nopCloser{output.Out}, nil
+	case "stderr":
+		return nopCloser{output.Err}, nil
+	}
+	return os.Create(name)
+}
+
+func validProgressMode(mode string) bool {
+	return mode == progressAlways || mode == progressAuto || mode == progressNever
+}
+
+// progressStyle decides whether to show progress, and if so whether as
+// plain lines, for -progress mode, given whether the output is a terminal
+// and whether we're running in CI.
+func progressStyle(mode string, terminal, ci bool) (show, plain bool) {
+	switch mode {
+	case progressAlways:
+		return true, !terminal || ci
+	case progressAuto:
+		return terminal && !ci, false
+	}
+	return false, false
+}
+
+// ciEnvVars are set by CI providers; $CI by most, the others by some which
+// don't, or didn't always.
+var ciEnvVars = []string{
+	"CI", "CIRCLECI", "GITHUB_ACTIONS", "GITLAB_CI", "BUILDKITE", "TRAVIS",
+	"JENKINS_URL", "TF_BUILD", "TEAMCITY_VERSION",
+}
+
+// inCI tells whether getenv shows us to be running in CI.
+func inCI(getenv func(string) string) bool {
+	for _, name := range ciEnvVars {
+		if v := getenv(name); v != "" && v != "false" && v != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progress counts the bytes read through it, reporting the count to w on
+// every tick, and once more when stopped.
+type progress struct {
+	r     io.Reader
+	w     io.Writer
+	name  string
+	total int64 // or -1, if unknown
+	plain bool
+	json  bool // NDJSON events, for -progress-json
+	start time.Time
+	n     atomic.Int64
+
+	ticker *time.Ticker
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newProgress(r io.Reader, w io.Writer, name string, total int64, interval time.Duration, plain bool) *progress {
+	p := &progress{r: r, w: w, name: name, total: total, plain: plain}
+	p.run(interval)
+	return p
+}
+
+// newJSONProgress is newProgress reporting progressEvents, for -progress-json.
+func newJSONProgress(r io.Reader, w io.Writer, name string, total int64, interval time.Duration) *progress {
+	p := &progress{r: r, w: w, name: name, total: total, json: true}
+	p.run(interval)
+	return p
+}
+
+// run starts the ticker reporting progress.
+func (p *progress) run(interval time.Duration) {
+	p.start = time.Now()
+	p.ticker = time.NewTicker(interval)
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			select {
+			case <-p.ticker.C:
+				p.report()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n.Add(int64(n))
+	return n, err
+}
+
+func (p *progress) report() {
+	if p.json {
+		p.reportJSON()
+		return
+	}
+	start, end := "\r", ""
+	if p.plain {
+		start, end = "", "\n"
+	}
+	n := p.n.Load()
+	if p.total > 0 {
+		fmt.Fprintf(p.w, "%s%s: %d of %d bytes (%d%%)%s", start, p.name, n, p.total, n*100/p.total, end)
+		return
+	}
+	fmt.Fprintf(p.w, "%s%s: %d bytes%s", start, p.name, n, end)
+}
+
+func (p *progress) reportJSON() {
+	e := progressEvent{jsonHeader: newJSONHeader(), Artifact: p.name, Bytes: p.n.Load()}
+	if p.total >= 0 {
+		e.Total = &p.total
+	}
+	if d := time.Since(p.start); d > 0 {
+		e.Rate = int64(float64(e.Bytes) / d.Seconds())
+	}
+	json.NewEncoder(p.w).Encode(e)
+}
+
+// stop stops the ticker, and reports the final count, ending the line.
+func (p *progress) stop() {
+	p.ticker.Stop()
+	close(p.done)
+	p.wg.Wait()
+	p.report()
+	if !p.plain && !p.json {
+		fmt.Fprintln(p.w)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is written by the progress ticker while the test reads.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// trickleReader returns one byte per read, as fast as asked, until a deadline.
+type trickleReader struct{ until time.Time }
+
+func (t *trickleReader) Read(p []byte) (int, error) {
+	if time.Now().After(t.until) {
+		return 0, io.EOF
+	}
+	p[0] = 'x'
+	return 1, nil
+}
+
+func Test_progressBounded(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	const d = 200 * time.Millisecond
+	var out lockedBuffer
+	p := newProgress(&trickleReader{time.Now().Add(d)}, &out, "big.bin", -1, interval, false)
+	reads := 0
+	buf := make([]byte, 1)
+	for {
+		_, err := p.Read(buf)
+		if err != nil {
+			break
+		}
+		reads++
+	}
+	p.stop()
+
+	updates := strings.Count(out.String(), "\r")
+	// one per tick, give or take scheduling, and the last
+	if max := int(d/interval) + 2; updates > max || updates < 2 {
+		t.Errorf("Expected 2 to %d updates for %d reads, got %d", max, reads, updates)
+	}
+	if reads < 1000 {
+		t.Errorf("Expected many more reads than updates, got %d", reads)
+	}
+	if want := fmt.Sprintf("big.bin: %d bytes\n", reads); !strings.HasSuffix(out.String(), want) {
+		t.Errorf("Expected final report %q, got %q", want, out.String())
+	}
+}
+
+func Test_progressPercent(t *testing.T) {
+	var out lockedBuffer
+	p := newProgress(strings.NewReader("hello"), &out, "a.txt", 10, time.Hour, false)
+	io.Copy(io.Discard, p)
+	p.stop()
+	if got, want := out.String(), "\ra.txt: 5 of 10 bytes (50%)\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func Test_progressStyle(t *testing.T) {
+	for _, tc := range []struct {
+		mode         string
+		terminal, ci bool
+		show, plain  bool
+	}{
+		{progressAuto, true, false, true, false},
+		{progressAuto, true, true, false, false},
+		{progressAuto, false, false, false, false},
+		{progressAlways, true, false, true, false},
+		{progressAlways, true, true, true, true},
+		{progressAlways, false, false, true, true},
+		{progressNever, true, false, false, false},
+	} {
+		show, plain := progressStyle(tc.mode, tc.terminal, tc.ci)
+		if show != tc.show || plain != tc.plain {
+			t.Errorf("%+v: Expected show %v plain %v, got %v %v", tc, tc.show, tc.plain, show, plain)
+		}
+	}
+}
+
+func Test_progressInCI(t *testing.T) {
+	t.Setenv("CI", "true")
+	if !inCI(os.Getenv) {
+		t.Fatal("Expected CI=true to be CI")
+	}
+	if show, _ := progressStyle(progressAuto, true, inCI(os.Getenv)); show {
+		t.Errorf("Expected no progress by default in CI, even on a terminal")
+	}
+	if !inCI(func(name string) string { return map[string]string{"GITHUB_ACTIONS": "true"}[name] }) {
+		t.Errorf("Expected $GITHUB_ACTIONS to be CI")
+	}
+	if inCI(func(name string) string { return map[string]string{"CI": "false"}[name] }) {
+		t.Errorf("Expected CI=false not to be CI")
+	}
+
+	var out lockedBuffer
+	p := newProgress(strings.NewReader("hello"), &out, "a.txt", 10, time.Hour, true)
+	io.Copy(io.Discard, p)
+	p.stop()
+	if got, want := out.String(), "a.txt: 5 of 10 bytes (50%)\n"; got != want {
+		t.Errorf("plain: Expected %q, got %q", want, got)
+	}
+}
+
+func Test_progressJSON(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	var out lockedBuffer
+	p := newJSONProgress(&trickleReader{time.Now().Add(100 * time.Millisecond)}, &out, "big.bin", 1<<30, interval)
+	n, _ := io.Copy(io.Discard, p)
+	p.stop()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) < 2 || len(lines) > 7 {
+		t.Fatalf("Expected a few events, one per tick and the last, got %d: %q", len(lines), out.String())
+	}
+	var last int64
+	for _, line := range lines {
+		var e struct {
+			SchemaVersion int    `json:"schema_version"`
+			Version       string `json:"version"`
+			Artifact      string `json:"artifact"`
+			Bytes         int64  `json:"bytes"`
+			Total         *int64 `json:"total"`
+			Rate          *int64 `json:"rate"`
+		}
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Expected an event, got %q: %v", line, err)
+		}
+		if e.SchemaVersion != jsonSchemaVersion || e.Version == "" || e.Artifact != "big.bin" || e.Total == nil || *e.Total != 1<<30 || e.Rate == nil || e.Bytes < last {
+			t.Errorf("Unexpected event %q", line)
+		}
+		last = e.Bytes
+	}
+	if last != n {
+		t.Errorf("Expected the last event at %d bytes, got %d", n, last)
+	}
+
+	out = lockedBuffer{}
+	p = newJSONProgress(strings.NewReader("hello"), &out, "a.txt", -1, time.Hour)
+	io.Copy(io.Discard, p)
+	p.stop()
+	if got := out.String(); strings.Contains(got, "total") || !strings.Contains(got, `"bytes":5`) {
+		t.Errorf("Expected no total when unknown, got %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "progress.ndjson")
+	w, err := openProgressJSON(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = newJSONProgress(strings.NewReader("hello"), w, "a.txt", 5, time.Hour)
+	io.Copy(io.Discard, p)
+	p.stop()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); err != nil || !strings.Contains(string(b), `"bytes":5,"total":5`) {
+		t.Errorf("Expected the event in the file, got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// CircleCI builds projects from several VCS hosts, which API v1.1 tells
+// apart by a path segment, eg /project/github/nbio/cart.  A Provider builds
+// the API's URLs for its host, and knows how to recognize a git remote
+// there, so that adding a host is adding a Provider.  The provider is chosen
+// with -vcs, or else by the git remote (or -from-url), or else is GitHub.
+//
+// GitLab isn't one: CircleCI addresses its GitLab projects not by a VCS type
+// and username/repo, but as circleci/<org-id>/<project-id>, which API v1.1
+// doesn't serve, and which no git remote says.
+
+type Provider interface {
+	// VCSType is the provider's name in API paths, eg "github".
+	VCSType() string
+	// BuildListURL returns the URL listing the recent builds of opts.
+	BuildListURL(opts URLOptions) (*url.URL, error)
+	// ArtifactsURL returns the URL listing the artifacts of opts.BuildNum.
+	ArtifactsURL(opts URLOptions) (*url.URL, error)
+	// BuildURL returns the URL of the summary of opts.BuildNum.
+	BuildURL(opts URLOptions) (*url.URL, error)
+	// ParseRemote returns the username/repo of a git remote URL at the
+	// provider's host, or "" if it's not one of those.
+	ParseRemote(remote string) string
+}
+
+// circleV11 builds the URLs of API v1.1, which differ between providers only
+// by the VCS type.
+type circleV11 struct{ vcsType string }
+
+func (p circleV11) VCSType() string { return p.vcsType }
+
+// expander is opts' Expander, with the provider's VCS type.
+func (p circleV11) expander(opts URLOptions) (Expander, error) {
+	e, err := opts.expander()
+	if err != nil {
+		return nil, err
+	}
+	e["vcs"] = p.vcsType
+	return e, nil
+}
+
+func (p circleV11) BuildListURL(opts URLOptions) (*url.URL, error) {
+	e, err := p.expander(opts)
+	if err != nil {
+		return nil, err
+	}
+	q, err := buildListQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := buildListURL
+	if opts.Branch == "" {
+		tmpl = projectBuildsURL
+	}
+	u, err := url.Parse(e.ExpandURL(tmpl))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = q.Encode()
+	return u, nil
+}
+
+func (p circleV11) ArtifactsURL(opts URLOptions) (*url.URL, error) {
+	e, err := p.expander(opts)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(e.ExpandURL(artifactsURL))
+}
+
+func (p circleV11) BuildURL(opts URLOptions) (*url.URL, error) {
+	e, err := p.expander(opts)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(e.ExpandURL(buildURL))
+}
+
+// remoteProject returns the username/repo which re captures from remote.
+func remoteProject(re *regexp.Regexp, remote string) string {
+	if m := re.FindStringSubmatch(remote); len(m) > 1 {
+		return strings.Replace(m[1], ".git", "", 1)
+	}
+	return ""
+}
+
+type githubProvider struct{ circleV11 }
+
+var githubRemote = regexp.MustCompile(`github\.com(?:/|:)(\w+/\w+)`)
+
+func (githubProvider) ParseRemote(remote string) string { return remoteProject(githubRemote, remote) }
+
+type bitbucketProvider struct{ circleV11 }
+
+var bitbucketRemote = regexp.MustCompile(`bitbucket\.org(?:/|:)(\w+/\w+)`)
+
+func (bitbucketProvider) ParseRemote(remote string) string {
+	return remoteProject(bitbucketRemote, remote)
+}
+
+var (
+	github    Provider = githubProvider{circleV11{"github"}}
+	bitbucket Provider = bitbucketProvider{circleV11{"bitbucket"}}
+
+	// providers are tried in order when detecting one from a remote.
+	providers = []Provider{github, bitbucket}
+)
+
+// providerNamed returns the provider of VCS type name, or nil.  The old
+// UI's short names, eg "gh" in circleci.com/gh/nbio/cart, are known too.
+func providerNamed(name string) Provider {
+	switch name {
+	case "gh":
+		return github
+	case "bb":
+		return bitbucket
+	}
+	for _, p := range providers {
+		if p.VCSType() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// detectProvider returns the provider of a git remote URL, and the
+// username/repo within it, or nil if no provider recognizes it.
+func detectProvider(remote string) (Provider, string) {
+	for _, p := range providers {
+		if project := p.ParseRemote(remote); project != "" {
+			return p, project
+		}
+	}
+	return nil, ""
+}
+
+// urlProvider returns the provider named in the URL of a CircleCI page, or
+// nil.
+func urlProvider(s string) Provider {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if parts[0] == "pipelines" && len(parts) > 1 {
+		return providerNamed(parts[1])
+	}
+	return providerNamed(parts[0])
+}
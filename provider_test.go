@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func Test_providerURLs(t *testing.T) {
+	for _, tc := range []struct {
+		p             Provider
+		list, artList string
+	}{
+		{
+			github,
+			"https://circleci.com/api/v1.1/project/github/nbio/cart/tree/main?limit=10",
+			"https://circleci.com/api/v1.1/project/github/nbio/cart/42/artifacts",
+		},
+		{
+			bitbucket,
+			"https://circleci.com/api/v1.1/project/bitbucket/nbio/cart/tree/main?limit=10",
+			"https://circleci.com/api/v1.1/project/bitbucket/nbio/cart/42/artifacts",
+		},
+	} {
+		opts := URLOptions{Project: "nbio/cart", Branch: "main", BuildNum: 42, Limit: 10, Provider: tc.p}
+		if u, err := BuildListURL(opts); err != nil || u.String() != tc.list {
+			t.Errorf("%s: Expected %q, got %v (%v)", tc.p.VCSType(), tc.list, u, err)
+		}
+		if u, err := ArtifactsURL(opts); err != nil || u.String() != tc.artList {
+			t.Errorf("%s: Expected %q, got %v (%v)", tc.p.VCSType(), tc.artList, u, err)
+		}
+		// The provider's own methods, whatever opts says.
+		opts.Provider = nil
+		if u, err := tc.p.ArtifactsURL(opts); err != nil || u.String() != tc.artList {
+			t.Errorf("%s: Expected %q, got %v (%v)", tc.p.VCSType(), tc.artList, u, err)
+		}
+		if u, err := tc.p.BuildURL(opts); err != nil || u.String() != "https://circleci.com/api/v1.1/project/"+tc.p.VCSType()+"/nbio/cart/42" {
+			t.Errorf("%s: Expected the build URL of the provider, got %v (%v)", tc.p.VCSType(), u, err)
+		}
+		if u, err := BuildURL(URLOptions{Project: "nbio/cart", BuildNum: 42, Provider: tc.p}); err != nil ||
+			u.String() != "https://circleci.com/api/v1.1/project/"+tc.p.VCSType()+"/nbio/cart/42" {
+			t.Errorf("%s: Expected the build URL of the provider, got %v (%v)", tc.p.VCSType(), u, err)
+		}
+	}
+}
+
+func Test_providerRemotes(t *testing.T) {
+	for _, tc := range []struct {
+		remote  string
+		want    Provider
+		project string
+	}{
+		{"https://github.com/nbio/cart", github, "nbio/cart"},
+		{"git@github.com:nbio/cart.git", github, "nbio/cart"},
+		{"https://bitbucket.org/nbio/cart.git", bitbucket, "nbio/cart"},
+		{"git@bitbucket.org:nbio/cart.git", bitbucket, "nbio/cart"},
+		{"https://gitlab.com/nbio/cart", nil, ""},
+		{"ssh://git@mirror.internal/scm/nbio/cart.git", nil, ""},
+	} {
+		p, project := detectProvider(tc.remote)
+		if p != tc.want || project != tc.project {
+			t.Errorf("%s: Expected %v %q, got %v %q", tc.remote, tc.want, tc.project, p, project)
+		}
+	}
+	if got := bitbucket.ParseRemote("https://github.com/nbio/cart"); got != "" {
+		t.Errorf("Expected bitbucket not to parse a github remote, got %q", got)
+	}
+
+	for name, want := range map[string]Provider{"github": github, "gh": github, "bb": bitbucket, "gitlab": nil, "svn": nil} {
+		if got := providerNamed(name); got != want {
+			t.Errorf("%s: Expected %v, got %v", name, want, got)
+		}
+	}
+	if got := urlProvider("https://app.circleci.com/pipelines/bitbucket/nbio/cart/7/workflows/x/jobs/42"); got != bitbucket {
+		t.Errorf("Expected bitbucket from its pipeline URL, got %v", got)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// -limit-rate caps the bandwidth of each download, so that cart doesn't
+// starve other jobs on a shared runner.  Downloads are made one at a time,
+// so the cap on each is also the cap on cart as a whole.  The reader is a
+// token bucket: each read spends tokens, which refill at the rate, and the
+// reader sleeps off any debt.
+
+var limitRate int64 // bytes per second, or 0 for no limit
+
+type rateLimitedReader struct {
+	r      io.Reader
+	rate   float64 // bytes per second
+	burst  int     // the most read at once
+	tokens float64 // may go negative: a debt to sleep off
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newRateLimitedReader(r io.Reader, rate int64) *rateLimitedReader {
+	burst := int(rate / 10) // reads of at most 100ms worth
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimitedReader{
+		r:     r,
+		rate:  float64(rate),
+		burst: burst,
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.burst {
+		p = p[:l.burst]
+	}
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+	}
+	l.last = now
+	n, err := l.r.Read(p)
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		l.sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+	return n, err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func Test_rateLimitedReader(t *testing.T) {
+	const rate = 2000 // bytes a second
+	payload := bytes.Repeat([]byte("x"), 5000)
+
+	var clock time.Time
+	clock = clock.Add(time.Hour)
+	l := newRateLimitedReader(bytes.NewReader(payload), rate)
+	l.now = func() time.Time { return clock }
+	l.sleep = func(d time.Duration) { clock = clock.Add(d) }
+
+	start := clock
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, l); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("Expected the payload through unchanged, got %d bytes", out.Len())
+	}
+	// 5000 bytes at 2000 a second, less a burst at most
+	elapsed := clock.Sub(start)
+	if elapsed < 2400*time.Millisecond || elapsed > 2600*time.Millisecond {
+		t.Errorf("Expected the copy to take about 2.5s, took %s", elapsed)
+	}
+}
+
+func Test_rateLimitedReaderRealClock(t *testing.T) {
+	const rate = 100000
+	l := newRateLimitedReader(bytes.NewReader(make([]byte, 20000)), rate)
+	start := time.Now()
+	io.Copy(io.Discard, l)
+	// 200ms, with room for the first burst
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected the copy to take at least 150ms, took %s", elapsed)
+	}
+}
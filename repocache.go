@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Finding the project and branch runs `git remote get-url origin` and `git
+// symbolic-ref HEAD`, which in a large repository are slow enough to notice
+// when running cart in a loop.  So the remote URL and branch are cached for
+// each working directory.  The remote is set in the repository's git
+// config, and the branch in its HEAD, so the entry holds a digest of the
+// config's contents, and HEAD as it was: if either has changed since, that
+// part of the entry is stale, without asking git.  -no-repo-cache skips the
+// cache.
+
+var noRepoCache bool
+
+type repoCache struct {
+	dir string
+}
+
+type repoCacheEntry struct {
+	WorkDir   string `json:"work_dir"`
+	GitConfig string `json:"git_config"`
+	ConfigSum string `json:"config_sha256"`
+	RemoteURL string `json:"remote_url"`
+
+	// Head is the contents of HEAD when Branch was found, or empty if it
+	// hasn't been; Branch is empty on a detached HEAD.
+	Head   string `json:"head,omitempty"`
+	Branch string `json:"branch,omitempty"`
+}
+
+// repoState is what a repoCacheEntry is checked against.
+type repoState struct {
+	config, configSum, head string
+}
+
+// gitConfigPath returns the config file of the git repository containing
+// dir.  Worktrees and submodules, whose .git is a file pointing elsewhere,
+// aren't handled, and go uncached.
+func gitConfigPath(dir string) (string, bool) {
+	for {
+		fi, err := os.Stat(filepath.Join(dir, ".git"))
+		if err == nil {
+			if !fi.IsDir() {
+				return "", false
+			}
+			return filepath.Join(dir, ".git", "config"), true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// readRepoState reads the config and HEAD of the repository containing wd.
+func readRepoState(wd string) (repoState, bool) {
+	config, ok := gitConfigPath(wd)
+	if !ok {
+		return repoState{}, false
+	}
+	b, err := os.ReadFile(config)
+	if err != nil {
+		return repoState{}, false
+	}
+	head, err := os.ReadFile(filepath.Join(filepath.Dir(config), "HEAD"))
+	if err != nil {
+		return repoState{}, false
+	}
+	sum := sha256.Sum256(b)
+	return repoState{config, hex.EncodeToString(sum[:]), string(bytes.TrimSpace(head))}, true
+}
+
+func (c repoCache) path(wd string) string {
+	key := sha256.Sum256([]byte(wd))
+	return filepath.Join(c.dir, hex.EncodeToString(key[:])+".json")
+}
+
+// get returns the entry for wd, if it has a remote URL found with the
+// repository's config as it is now.
+func (c repoCache) get(wd string, st repoState) (repoCacheEntry, bool) {
+	var entry repoCacheEntry
+	b, err := os.ReadFile(c.path(wd))
+	if err != nil || json.Unmarshal(b, &entry) != nil {
+		return repoCacheEntry{}, false
+	}
+	ok := entry.WorkDir == wd && entry.GitConfig == st.config && entry.ConfigSum == st.configSum && entry.RemoteURL != ""
+	return entry, ok
+}
+
+// remoteURL returns the URL of the origin remote of the repository at wd,
+// from the cache if the repository's config hasn't changed since it was
+// cached, or else from git, caching it.
+func (c repoCache) remoteURL(wd string, timeout time.Duration) (string, error) {
+	st, ok := readRepoState(wd)
+	if !ok {
+		return gitRemoteURL(timeout)
+	}
+	if entry, ok := c.get(wd, st); ok {
+		verboseln("Remote URL cached:", wd)
+		return entry.RemoteURL, nil
+	}
+
+	u, err := gitRemoteURL(timeout)
+	if err != nil {
+		return "", err
+	}
+	// A new config may come with a new HEAD, so the branch is found anew.
+	entry := repoCacheEntry{WorkDir: wd, GitConfig: st.config, ConfigSum: st.configSum, RemoteURL: u}
+	if err := c.put(wd, entry); err != nil {
+		verboseln("Remote URL not cached:", err)
+	}
+	return u, nil
+}
+
+// branch returns the branch checked out in the repository at wd, from the
+// cache if neither its config nor HEAD have changed since it was cached, or
+// else from git, caching it along with the remote URL.  A detached HEAD is
+// cached as errNoBranch; other errors aren't cached.
+func (c repoCache) branch(wd string, timeout time.Duration) (string, error) {
+	st, ok := readRepoState(wd)
+	if !ok {
+		return gitBranch(timeout)
+	}
+	entry, ok := c.get(wd, st)
+	if ok && entry.Head == st.head {
+		verboseln("Branch cached:", wd)
+		if entry.Branch == "" {
+			return "", errNoBranch
+		}
+		return entry.Branch, nil
+	}
+
+	b, err := gitBranch(timeout)
+	if err != nil && !errors.Is(err, errNoBranch) {
+		return "", err
+	}
+	if ok {
+		entry.Head, entry.Branch = st.head, b
+		if err := c.put(wd, entry); err != nil {
+			verboseln("Branch not cached:", err)
+		}
+	}
+	return b, err
+}
+
+func (c repoCache) put(wd string, entry repoCacheEntry) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(wd), b, 0600)
+}
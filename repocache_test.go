@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_repoCache(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	remote := filepath.Join(t.TempDir(), "remote")
+	branch := filepath.Join(t.TempDir(), "branch")
+	fakeGit(t, `echo "$1" >> '`+calls+`'
+case "$1" in
+remote) cat '`+remote+`' ;;
+symbolic-ref) cat '`+branch+`' ;;
+*) exit 1 ;;
+esac`)
+	countCalls := func(cmd string) int {
+		b, _ := os.ReadFile(calls)
+		return strings.Count(string(b), cmd+"\n")
+	}
+
+	wd := t.TempDir()
+	config := filepath.Join(wd, ".git", "config")
+	head := filepath.Join(wd, ".git", "HEAD")
+	if err := os.MkdirAll(filepath.Dir(config), 0755); err != nil {
+		t.Fatal(err)
+	}
+	then := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(path, s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// as if within the file system's mtime granularity
+		if err := os.Chtimes(path, then, then); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setRemote := func(u string) {
+		t.Helper()
+		write(remote, u+"\n")
+		write(config, "[remote \"origin\"]\n\turl = "+u+"\n")
+	}
+	setBranch := func(b string) {
+		t.Helper()
+		write(branch, b+"\n")
+		write(head, "ref: refs/heads/"+b+"\n")
+	}
+	setRemote("git@github.com:nbio/cart.git")
+	setBranch("main")
+
+	c := repoCache{dir: t.TempDir()}
+	for i := 0; i < 3; i++ {
+		u, err := c.remoteURL(wd, time.Second)
+		if err != nil || gitProject(u) != "nbio/cart" {
+			t.Fatalf("Expected nbio/cart, got %q, %v", u, err)
+		}
+		b, err := c.branch(wd, time.Second)
+		if err != nil || b != "main" {
+			t.Fatalf("Expected main, got %q, %v", b, err)
+		}
+	}
+	if n, m := countCalls("remote"), countCalls("symbolic-ref"); n != 1 || m != 1 {
+		t.Errorf("Expected git run once each, then cached, got %d and %d runs", n, m)
+	}
+
+	// The same size and modification time, but another remote.
+	setRemote("git@github.com:nbio/fork.git")
+	u, err := c.remoteURL(wd, time.Second)
+	if err != nil || gitProject(u) != "nbio/fork" {
+		t.Errorf("Expected the changed remote, got %q, %v", u, err)
+	}
+	if n := countCalls("remote"); n != 2 {
+		t.Errorf("Expected git run again for the changed remote, got %d runs", n)
+	}
+
+	setBranch("dev1")
+	if b, err := c.branch(wd, time.Second); err != nil || b != "dev1" {
+		t.Errorf("Expected the changed branch, got %q, %v", b, err)
+	}
+	if b, err := c.branch(wd, time.Second); err != nil || b != "dev1" {
+		t.Errorf("Expected the changed branch cached, got %q, %v", b, err)
+	}
+	if n := countCalls("symbolic-ref"); n != 2 {
+		t.Errorf("Expected git run once for the changed branch, got %d runs", n)
+	}
+
+	// A detached HEAD has no branch, and that's cached too.
+	write(branch, "")
+	write(head, "0123456789abcdef0123456789abcdef01234567\n")
+	for i := 0; i < 2; i++ {
+		if _, err := c.branch(wd, time.Second); !errors.Is(err, errNoBranch) {
+			t.Errorf("Expected no branch, got %v", err)
+		}
+	}
+	if n := countCalls("symbolic-ref"); n != 3 {
+		t.Errorf("Expected git run once for the detached HEAD, got %d runs", n)
+	}
+
+	// Not in a repository, there's nothing to key upon.
+	if _, err := c.remoteURL(t.TempDir(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.remoteURL(t.TempDir(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := countCalls("remote"); n != 4 {
+		t.Errorf("Expected git run each time outside a repository, got %d runs", n)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// With -json, downloads are reported as JSON on stdout, as the structured
+// counterpart of the "Wrote ..." lines, which go to stderr instead: one
+// result for the one <artifact>, or "results" for -all, -pick and -last-n.
+
+const (
+	statusDownloaded = "downloaded"
+	statusSkipped    = "skipped" // -dry-run, or unchanged with -output-if-changed
+	statusFailed     = "failed"
+	statusMissing    = "missing" // gone, with -allow-missing
+)
+
+type downloadResult struct {
+	Artifact   string `json:"artifact"`
+	Path       string `json:"path,omitempty"`
+	URL        string `json:"url,omitempty"` // censored
+	Bytes      int64  `json:"bytes"`
+	SHA256     string `json:"sha256,omitempty"`
+	BuildNum   int    `json:"build_num,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+type resultLog struct {
+	buildNum int // that of artifacts which don't know their own
+	results  []downloadResult
+}
+
+// results records the downloads, when not nil.
+var results *resultLog
+
+// record notes the download of a (known to the user as name) to path, begun
+// at start, with its outcome.  The SHA-256 is that of the file written, if
+// it's a regular file.
+func (l *resultLog) record(a artifact, name, path string, buildNum int, start time.Time, n int64, written bool, err error) {
+	if l == nil {
+		return
+	}
+	if buildNum == 0 && a.build != nil {
+		buildNum = a.build.BuildNum
+	}
+	if buildNum == 0 {
+		buildNum = l.buildNum
+	}
+	r := downloadResult{
+		Artifact:   name,
+		Path:       path,
+		Bytes:      n,
+		BuildNum:   buildNum,
+		DurationMS: time.Since(start).Milliseconds(),
+		Status:     statusDownloaded,
+	}
+	if a.URL != "" {
+		r.URL = censorURL(a.URL)
+	}
+	switch {
+	case missed(err):
+		r.Status, r.Error = statusMissing, err.Error()
+	case err != nil:
+		r.Status, r.Error = statusFailed, err.Error()
+	case !written:
+		r.Status = statusSkipped
+	}
+	if fi, serr := os.Stat(path); err == nil && serr == nil && fi.Mode().IsRegular() {
+		if sum, err := fileSHA256(path); err == nil {
+			r.SHA256 = hex.EncodeToString(sum)
+		}
+	}
+	l.results = append(l.results, r)
+}
+
+// writeResults writes the results recorded, as one "result" unless many.
+func writeResults(w io.Writer, l *resultLog, many bool) error {
+	if !many && len(l.results) == 1 {
+		return json.NewEncoder(w).Encode(struct {
+			jsonHeader
+			Result downloadResult `json:"result"`
+		}{newJSONHeader(), l.results[0]})
+	}
+	return json.NewEncoder(w).Encode(struct {
+		jsonHeader
+		Results []downloadResult `json:"results"`
+	}{newJSONHeader(), l.results})
+}
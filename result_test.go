@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_downloadResultsJSON(t *testing.T) {
+	defer func(r *resultLog, w io.Writer) { results, diag = r, w }(results, diag)
+	results = &resultLog{buildNum: 42}
+	diag = io.Discard
+	circleToken = "secret-token"
+	defer func() { circleToken = "" }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0/gone.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	plan, err := planDownloads([]artifact{
+		{Path: "hello.txt", URL: ts.URL + "/0/hello.txt?circle-token=secret-token"},
+		{Path: "gone.txt", URL: ts.URL + "/0/gone.txt"},
+	}, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(p errorPolicy) { batchPolicy = p }(batchPolicy)
+	batchPolicy = policyKeepGoing
+	if err := downloadAll(plan); err == nil {
+		t.Errorf("Expected the failure reported")
+	}
+
+	var buf bytes.Buffer
+	if err := writeResults(&buf, results, true); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(circleToken)) {
+		t.Errorf("Expected the token censored, got %s", buf.Bytes())
+	}
+	var doc struct {
+		SchemaVersion int              `json:"schema_version"`
+		Results       []downloadResult `json:"results"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Results) != 2 {
+		t.Fatalf("Expected 2 results, got %+v", doc.Results)
+	}
+	ok, failed := doc.Results[0], doc.Results[1]
+	// sha256 of "hello"
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if ok.Status != statusDownloaded || ok.Bytes != 5 || ok.SHA256 != sum || ok.BuildNum != 42 ||
+		ok.Path != filepath.Join(dir, "hello.txt") || ok.Artifact != "hello.txt" || ok.Error != "" {
+		t.Errorf("Expected hello.txt downloaded, got %+v", ok)
+	}
+	if failed.Status != statusFailed || failed.Error == "" || failed.SHA256 != "" || failed.URL != ts.URL+"/0/gone.txt" {
+		t.Errorf("Expected gone.txt failed, got %+v", failed)
+	}
+
+	buf.Reset()
+	results.results = results.results[:1]
+	if err := writeResults(&buf, results, false); err != nil {
+		t.Fatal(err)
+	}
+	var single struct {
+		Result downloadResult `json:"result"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &single); err != nil || single.Result.Artifact != "hello.txt" {
+		t.Errorf("Expected a single result, got %s (%v)", buf.Bytes(), err)
+	}
+}
+
+func Test_recordUnparsableURL(t *testing.T) {
+	r := &resultLog{}
+	// A URL from the server which doesn't parse is redacted, not a panic.
+	const bad = "https://example.com/0/a.txt?circle-token=secret;%zz"
+	r.record(artifact{Path: "a.txt", URL: bad}, "a.txt", "a.txt", 42, time.Now(), 0, false, nil)
+	if got := r.results[0].URL; got != unparsableURL {
+		t.Errorf("Expected %q, got %q", unparsableURL, got)
+	}
+	if got := censorURL("http://[::1"); got != unparsableURL {
+		t.Errorf("Expected %q, got %q", unparsableURL, got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// All of the requests which cart makes today are GETs: listing builds,
+// listing artifacts and downloading those artifacts.  Those are idempotent,
+// so we can safely repeat them when the network or the server has a
+// transient problem.
+//
+// If cart ever gains operations with side-effects (eg, triggering a build)
+// then retrying those blindly could double-act, so only idempotent requests
+// are retried by default.  A caller can opt a request in by setting an
+// Idempotency-Key header, which is the same convention net/http uses for its
+// own internal retries.
+
+const defaultRetries = 3
+
+var maxRetries = defaultRetries
+
+// -retries bounds the retries of each request, but a run of -all against a
+// storage host which is down would spend them on every artifact in turn.
+// -host-retry-budget bounds the retries to each host over the whole run,
+// each host having its own: once a flaky host has spent its budget, its
+// requests fail at once, while those to a healthy host are still retried.
+
+// retryBudgets counts the retries spent on each host.
+type retryBudgets struct {
+	mu   sync.Mutex
+	per  int // retries allowed per host, or 0 for no limit
+	used map[string]int
+}
+
+var hostRetries = &retryBudgets{}
+
+// take spends one retry of host's budget, if any is left.
+func (b *retryBudgets) take(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.per <= 0 {
+		return true
+	}
+	if b.used[host] >= b.per {
+		return false
+	}
+	if b.used == nil {
+		b.used = map[string]int{}
+	}
+	b.used[host]++
+	return true
+}
+
+// defaultRetryStatus lists the HTTP response codes which are transient as
+// standard.  Some CDNs and proxies have codes of their own (eg, Cloudflare's
+// 520 and 522), so -retry-status may replace the list.
+const defaultRetryStatus = "429,502,503,504"
+
+// retryStatus holds the HTTP response codes which we consider transient.
+var retryStatus, _ = parseRetryStatus(defaultRetryStatus)
+
+func parseRetryStatus(s string) (map[int]bool, error) {
+	codes := map[int]bool{}
+	for _, field := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("bad -retry-status %q: want a comma-separated list of HTTP status codes", field)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// isIdempotent reports whether req may be sent more than once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := req.Header["X-Idempotency-Key"]
+	return ok
+}
+
+// doRequest sends req with httpClient, retrying transient failures (with
+// backoff) for requests which are idempotent.
+func doRequest(req *http.Request) (*http.Response, error) {
+	addExtraHeaders(req)
+	authorize(req)
+	attempts := 1
+	if isIdempotent(req) && (req.Body == nil || req.GetBody != nil) {
+		attempts += maxRetries
+	}
+	for i := 0; ; i++ {
+		apiCalls.count(req)
+		res, err := httpClient.Do(req)
+		if i+1 >= attempts || (err == nil && !retryStatus[res.StatusCode]) || req.Context().Err() != nil {
+			return res, err
+		}
+		if !hostRetries.take(req.URL.Host) {
+			verbosef("no retry: the -host-retry-budget of %s is spent\n", req.URL.Host)
+			return res, err
+		}
+		if err != nil {
+			verbosef("retry %d/%d: %s\n", i+1, maxRetries, err)
+		} else {
+			verbosef("retry %d/%d: %s responded %s\n", i+1, maxRetries, censorURL(req.URL.String()), res.Status)
+			res.Body.Close()
+		}
+		if err := sleep(req.Context(), retryBackoff.delay(i)); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_doRequestIdempotent(t *testing.T) {
+	defer func(b backoff) { retryBackoff = b }(retryBackoff)
+	retryBackoff = fixedBackoff{0}
+	hits := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		method string
+		key    bool
+		hits   int
+	}{
+		{http.MethodGet, false, 1 + maxRetries},
+		{http.MethodPost, false, 1},
+		{http.MethodPost, true, 1 + maxRetries},
+	} {
+		hits = 0
+		req, err := http.NewRequest(tc.method, ts.URL, strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.key {
+			req.Header.Set("Idempotency-Key", "x")
+		}
+		res, err := doRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if hits != tc.hits {
+			t.Errorf("%s (idempotency-key %t): Expected %d requests, got %d", tc.method, tc.key, tc.hits, hits)
+		}
+	}
+}
+
+func Test_newHTTPClientCompression(t *testing.T) {
+	var acceptEncoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+	}))
+	defer ts.Close()
+
+	for _, noCompression := range []bool{false, true} {
+		res, err := newHTTPClient(noCompression).Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if want := map[bool]string{false: "gzip", true: ""}[noCompression]; acceptEncoding != want {
+			t.Errorf("no-compression %t: Expected Accept-Encoding %q, got %q", noCompression, want, acceptEncoding)
+		}
+	}
+}
+
+func Test_retryStatusCustom(t *testing.T) {
+	defer func(b backoff) { retryBackoff = b }(retryBackoff)
+	defer func(s map[int]bool) { retryStatus = s }(retryStatus)
+	retryBackoff = fixedBackoff{0}
+
+	var err error
+	if retryStatus, err = parseRetryStatus("502, 520,522"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ status, hits int }{
+		{522, 1 + maxRetries},
+		{503, 1},
+	} {
+		hits := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			w.WriteHeader(tc.status)
+		}))
+		res, err := httpGet(t, ts.URL)
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status || hits != tc.hits {
+			t.Errorf("%d: Expected %d requests, got %d", tc.status, tc.hits, hits)
+		}
+	}
+
+	for _, bad := range []string{"", "502,", "5o2", "999"} {
+		if _, err := parseRetryStatus(bad); err == nil {
+			t.Errorf("%q: Expected error", bad)
+		}
+	}
+}
+
+func httpGet(t *testing.T, u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := doRequest(req)
+	if err == nil {
+		res.Body.Close()
+	}
+	return res, err
+}
+
+func Test_hostRetryBudget(t *testing.T) {
+	defer func(b backoff) { retryBackoff = b }(retryBackoff)
+	defer func(b *retryBudgets) { hostRetries = b }(hostRetries)
+	retryBackoff = fixedBackoff{0}
+	hostRetries = &retryBudgets{per: 4}
+
+	flakyHits := 0
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flakyHits++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer flaky.Close()
+	healthyHits := 0
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every first attempt blips.
+		if healthyHits++; healthyHits%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer healthy.Close()
+
+	// The flaky host spends its budget of 4 over two requests.
+	for i := 0; i < 3; i++ {
+		if res, err := httpGet(t, flaky.URL); err != nil || res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("flaky: Expected 503, got %v (%v)", res, err)
+		}
+	}
+	if want := 1 + maxRetries + (1 + 1) + 1; flakyHits != want {
+		t.Errorf("flaky: Expected %d requests, its budget spent, got %d", want, flakyHits)
+	}
+
+	// The healthy host still has its own.
+	for i := 0; i < 4; i++ {
+		if res, err := httpGet(t, healthy.URL); err != nil || res.StatusCode != http.StatusOK {
+			t.Errorf("healthy %d: Expected 200 on retry, got %v (%v)", i, res, err)
+		}
+	}
+	if res, err := httpGet(t, healthy.URL); err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("healthy: Expected its budget spent too, got %v (%v)", res, err)
+	}
+}
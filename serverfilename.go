@@ -0,0 +1,34 @@
+package main
+
+import (
+	"mime"
+	"strings"
+)
+
+// -use-server-filename names the download, when -o doesn't, as a browser or
+// `curl -OJ` would: by the filename of the Content-Disposition the server
+// gives (asked for with a HEAD, as for -probe), rather than the base name of
+// the artifact's path.  The name is the server's to choose, so it's kept to
+// a plain file name in the current directory.
+
+var useServerFilename bool
+
+// serverFilename returns the file name of a Content-Disposition header, if
+// it has a safe one.
+func serverFilename(contentDisposition string) (string, bool) {
+	if contentDisposition == "" {
+		return "", false
+	}
+	_, params, err := mime.ParseMediaType(contentDisposition)
+	if err != nil {
+		return "", false
+	}
+	name := params["filename"] // mime decodes any filename* into this
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsFunc(name, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_serverFilename(t *testing.T) {
+	for _, tc := range []struct {
+		header, want string
+		ok           bool
+	}{
+		{`attachment; filename="cart-1.2.0-linux-amd64.tar.gz"`, "cart-1.2.0-linux-amd64.tar.gz", true},
+		{`attachment; filename*=UTF-8''caf%C3%A9.txt`, "café.txt", true},
+		{`attachment; filename="../../etc/passwd"`, "passwd", true},
+		{`attachment; filename="C:\\Windows\\evil.dll"`, "evil.dll", true},
+		{`attachment; filename=".."`, "", false},
+		{`attachment; filename="dir/"`, "", false},
+		{`attachment; filename="a` + "\x01" + `b"`, "", false},
+		{`attachment`, "", false},
+		{``, "", false},
+		{`attachment; filename="unterminated`, "", false},
+	} {
+		got, ok := serverFilename(tc.header)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%q: Expected %q %v, got %q %v", tc.header, tc.want, tc.ok, got, ok)
+		}
+	}
+}
+
+func Test_serverOutputPath(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0/dist/latest.tar.gz" {
+			w.Header().Set("Content-Disposition", `attachment; filename="cart-1.2.0.tar.gz"`)
+		}
+		io.WriteString(w, "tarball")
+	}))
+	defer ts.Close()
+
+	artifacts := []artifact{
+		{Path: "dist/latest.tar.gz", URL: ts.URL + "/0/dist/latest.tar.gz"},
+		{Path: "dist/notes.txt", URL: ts.URL + "/0/dist/notes.txt"},
+	}
+	if got := serverOutputPath(artifacts, "dist/latest.tar.gz", "latest.tar.gz"); got != "cart-1.2.0.tar.gz" {
+		t.Errorf("Expected the server's name, got %q", got)
+	}
+	if got := serverOutputPath(artifacts, "dist/notes.txt", "notes.txt"); got != "notes.txt" {
+		t.Errorf("Expected the fallback without Content-Disposition, got %q", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A download can hang without failing: the connection stays open but no
+// bytes arrive (eg, a stalled CDN node).  An overall timeout would have to be
+// long enough for the largest artifact, so instead -stall-timeout bounds the
+// time between reads.  A stalled download is abandoned and, like other
+// transient failures, tried again within the -retries budget.
+
+var (
+	stallTimeout time.Duration
+
+	errStalled = errors.New("download stalled")
+)
+
+// stallReader reads from r, cancelling its request (via cancel) if no bytes
+// arrive for timeout.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel context.CancelCauseFunc) *stallReader {
+	return &stallReader{
+		r:       r,
+		timeout: timeout,
+		timer: time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("%w: no data received for %s", errStalled, timeout))
+		}),
+	}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+// stop disarms the watchdog, once the copy is done.
+func (s *stallReader) stop() {
+	s.timer.Stop()
+}
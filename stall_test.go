@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_saveArtifactStall(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "half")
+		if hits.Add(1) == 1 {
+			// stall mid-stream, until the client gives up
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, " and the rest")
+	}))
+	defer ts.Close()
+
+	defer func(s time.Duration, b backoff, n int) { stallTimeout, retryBackoff, maxRetries = s, b, n }(stallTimeout, retryBackoff, maxRetries)
+	stallTimeout, retryBackoff, maxRetries = 50*time.Millisecond, fixedBackoff{time.Millisecond}, 1
+
+	a := artifact{URL: ts.URL + "/blob.txt", Path: "blob.txt"}
+	out := filepath.Join(t.TempDir(), "blob.txt")
+	if _, err := saveArtifact(a, "blob.txt", out); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "half and the rest" {
+		t.Errorf("Expected %q, got %q", "half and the rest", got)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("Expected 2 requests, got %d", hits.Load())
+	}
+
+	hits.Store(0)
+	maxRetries = 0
+	if _, err := saveArtifact(a, "blob.txt", out); !errors.Is(err, errStalled) {
+		t.Errorf("Expected stall error without retries, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// -stat profiles what a build emits: rather than list the artifacts, it
+// tallies them by file extension, most common first.  With -long, it also
+// probes the size of each, as -probe-all does, and totals those too.
+
+// noExt stands for the extension of artifacts without one.
+const noExt = "(none)"
+
+type extStat struct {
+	Ext          string
+	Files        int
+	Bytes        int64 // of the files of known size
+	UnknownFiles int   // not in Bytes
+}
+
+// artifactExt returns the extension of p, counting a compressed tarball's
+// as one, eg .tar.gz, which is what folks would expect to see.
+func artifactExt(p string) string {
+	ext := path.Ext(p)
+	if ext == "" {
+		return noExt
+	}
+	if base := strings.TrimSuffix(p, ext); path.Ext(base) == ".tar" {
+		return ".tar" + ext
+	}
+	return ext
+}
+
+// statArtifacts tallies artifacts by extension, with sizes from sizeOf
+// (-1 for unknown), unless that's nil, probed a few at a time.
+func statArtifacts(artifacts []artifact, sizeOf func(artifact) int64) []extStat {
+	var sizes []int64
+	if sizeOf != nil {
+		sizes = probeEach(artifacts, sizeOf, probeConcurrency)
+	}
+	index := map[string]int{}
+	var stats []extStat
+	for i, a := range artifacts {
+		ext := artifactExt(a.Path)
+		j, ok := index[ext]
+		if !ok {
+			j = len(stats)
+			index[ext] = j
+			stats = append(stats, extStat{Ext: ext})
+		}
+		stats[j].Files++
+		switch {
+		case sizes == nil:
+		case sizes[i] < 0:
+			stats[j].UnknownFiles++
+		default:
+			stats[j].Bytes += sizes[i]
+		}
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].Files != stats[j].Files {
+			return stats[i].Files > stats[j].Files
+		}
+		return stats[i].Ext < stats[j].Ext
+	})
+	return stats
+}
+
+func writeStats(w io.Writer, stats []extStat, sized bool) error {
+	for _, s := range stats {
+		var err error
+		switch {
+		case !sized:
+			_, err = fmt.Fprintf(w, "%d %s\n", s.Files, s.Ext)
+		case s.UnknownFiles > 0:
+			_, err = fmt.Fprintf(w, "%d %s %d bytes (%d of unknown size)\n", s.Files, s.Ext, s.Bytes, s.UnknownFiles)
+		default:
+			_, err = fmt.Fprintf(w, "%d %s %d bytes\n", s.Files, s.Ext, s.Bytes)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_statArtifacts(t *testing.T) {
+	var artifacts []artifact
+	for _, p := range []string{
+		"test-results/a.xml", "test-results/b.xml", "test-results/c.xml",
+		"dist/cart.tar.gz", "dist/cart-src.tar.gz",
+		"coverage.json", "LICENSE", "dist/cart.gz",
+	} {
+		artifacts = append(artifacts, artifact{Path: p, URL: "https://example.com/" + p})
+	}
+
+	var out bytes.Buffer
+	if err := writeStats(&out, statArtifacts(artifacts, nil), false); err != nil {
+		t.Fatal(err)
+	}
+	want := "3 .xml\n2 .tar.gz\n1 (none)\n1 .gz\n1 .json\n"
+	if out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+
+	sizeOf := func(a artifact) int64 {
+		if a.Path == "LICENSE" {
+			return -1
+		}
+		return int64(len(a.Path))
+	}
+	out.Reset()
+	if err := writeStats(&out, statArtifacts(artifacts[3:7], sizeOf), true); err != nil {
+		t.Fatal(err)
+	}
+	want = "2 .tar.gz 36 bytes\n1 (none) 0 bytes (1 of unknown size)\n1 .json 13 bytes\n"
+	if out.String() != want {
+		t.Errorf("sized: Expected %q, got %q", want, out.String())
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// -strict-json checks builds and artifacts for drift in the API (or in a
+// test's fixtures) which would otherwise go unnoticed: each field cart reads
+// must be there, if perhaps null, and of the type cart expects, and any other
+// field must be one the API is known to send, listed in unreadFields.  A
+// renamed or retyped field fails loudly, rather than decoding as empty, as
+// does a field the API has added since.  A field which the API leaves out of
+// some builds (eg workflows, for a build outside any) is tagged
+// strict:"optional".
+
+var strictJSON bool
+
+// decodeJSON decodes a single JSON value from r into v, checking it under
+// -strict-json.
+func decodeJSON(r io.Reader, v interface{}) error {
+	if !strictJSON {
+		return json.NewDecoder(r).Decode(v)
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return err
+	}
+	if err := checkFields(raw, reflect.TypeOf(v).Elem(), ""); err != nil {
+		return fmt.Errorf("-strict-json: %w", err)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// unmarshalJSON is decodeJSON for a body already read.
+func unmarshalJSON(data []byte, v interface{}) error {
+	return decodeJSON(bytes.NewReader(data), v)
+}
+
+var jsonNull = []byte("null")
+
+// unreadFields are the fields of v1.1 responses which cart doesn't read,
+// by the type they're decoded into.
+var unreadFields = map[reflect.Type][]string{
+	reflect.TypeOf(build{}): {
+		"all_commit_details", "all_commit_details_truncated", "author_date",
+		"author_email", "author_name", "body", "build_parameters",
+		"build_time_millis", "build_url", "canceled", "canceler", "circle_yml",
+		"committer_date", "committer_email", "committer_name", "compare",
+		"context_ids", "dont_build", "fail_reason", "failed", "has_artifacts",
+		"infrastructure_fail", "is_first_green_build", "job_name", "lifecycle",
+		"messages", "no_dependency_cache", "node", "oss", "parallel", "picard",
+		"platform", "previous", "previous_successful_build", "pull_requests",
+		"queued_at", "reponame", "retries", "retry_of", "ssh_disabled",
+		"ssh_users", "status", "steps", "timedout", "usage_queued_at",
+		"username", "vcs_type", "vcs_url",
+	},
+	reflect.TypeOf(workflow{}): {"upstream_concurrency_map", "upstream_job_ids", "workspace_id"},
+	reflect.TypeOf(user{}):     {"avatar_url", "id", "is_user", "name", "vcs_type"},
+	reflect.TypeOf(artifact{}): {"pretty_path"},
+}
+
+// checkFields checks that data has the fields of t which cart reads, with
+// the right types, and no others but its unreadFields, recursing into
+// objects and arrays.  at is where data is, eg "[2].workflows", for errors.
+func checkFields(data json.RawMessage, t reflect.Type, at string) error {
+	if bytes.Equal(bytes.TrimSpace(data), jsonNull) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return checkFields(data, t.Elem(), at)
+	case reflect.Slice:
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return fmt.Errorf("%s: want an array", strings.TrimPrefix(at, "."))
+		}
+		for i, e := range elems {
+			if err := checkFields(e, t.Elem(), fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return fmt.Errorf("%s: want an object", strings.TrimPrefix(at, "."))
+		}
+		known := map[string]bool{}
+		for _, name := range unreadFields[t] {
+			known[name] = true
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			known[name] = true
+			v, ok := fields[name]
+			if !ok {
+				if f.Tag.Get("strict") == "optional" {
+					continue
+				}
+				return fmt.Errorf("%s: missing", strings.TrimPrefix(at+"."+name, "."))
+			}
+			if err := checkFields(v, f.Type, at+"."+name); err != nil {
+				return err
+			}
+		}
+		var unknown []string
+		for name := range fields {
+			if !known[name] {
+				unknown = append(unknown, strings.TrimPrefix(at+"."+name, "."))
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return fmt.Errorf("unknown fields %s", strings.Join(unknown, ", "))
+		}
+		return nil
+	}
+	if err := json.Unmarshal(data, reflect.New(t).Interface()); err != nil {
+		return fmt.Errorf("%s: want %s, got %s", strings.TrimPrefix(at, "."), t.Kind(), data)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_strictJSON(t *testing.T) {
+	defer func(s bool) { strictJSON = s }(strictJSON)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"path": "bin/cart", "url": "https://example.com/bin/cart", "node_index": "0"}]`)
+	}))
+	defer ts.Close()
+
+	strictJSON = true
+	if _, err := fetchArtifacts(context.Background(), ts.URL); err == nil || !strings.Contains(err.Error(), "[0].node_index") {
+		t.Errorf("strict: Expected an error for the mistyped field, got %v", err)
+	}
+
+	const b = `{"build_num": 42, "outcome": "success", "parallel": 4}`
+	var got build
+	if err := unmarshalJSON([]byte(b), &got); err == nil || !strings.Contains(err.Error(), "branch: missing") {
+		t.Errorf("strict: Expected an error for the missing build field, got %v", err)
+	}
+	const extra = `[{"path": "bin/cart", "url": "https://example.com/bin/cart", "node_index": 0, "pretty_path": "bin/cart", "sha256": "ab", "etag": "cd"}]`
+	var artifacts []artifact
+	if err := unmarshalJSON([]byte(extra), &artifacts); err == nil || !strings.Contains(err.Error(), "unknown fields [0].etag, [0].sha256") {
+		t.Errorf("strict: Expected an error for the unknown fields, got %v", err)
+	}
+	strictJSON = false
+	if err := unmarshalJSON([]byte(extra), &artifacts); err != nil || len(artifacts) != 1 {
+		t.Errorf("lenient: Expected the artifact, got %+v, %v", artifacts, err)
+	}
+	if err := unmarshalJSON([]byte(b), &got); err != nil || got.BuildNum != 42 {
+		t.Errorf("lenient: Expected build 42, got %+v, %v", got, err)
+	}
+}
+
+// The fixtures are responses of the v1.1 API, with all of their fields.
+func Test_strictJSONRecorded(t *testing.T) {
+	defer func(s bool) { strictJSON = s }(strictJSON)
+	strictJSON = true
+
+	data, err := os.ReadFile("testdata/builds-v1.1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var builds []build
+	if err := unmarshalJSON(data, &builds); err != nil {
+		t.Fatalf("Expected the recorded builds to pass, got %v", err)
+	}
+	if len(builds) != 2 || builds[0].BuildNum != 1203 || builds[0].Workflows.JobName != "build" ||
+		builds[0].User.Login != "ada" || builds[1].Workflows != nil {
+		t.Errorf("Unexpected builds %+v", builds)
+	}
+
+	// A field renamed in the API fails, rather than decoding as empty.
+	renamed := strings.Replace(string(data), `"workflow_name"`, `"name"`, 1)
+	if err := unmarshalJSON([]byte(renamed), &builds); err == nil || !strings.Contains(err.Error(), "[0].workflows.workflow_name: missing") {
+		t.Errorf("Expected the renamed field to fail, got %v", err)
+	}
+	retyped := strings.Replace(string(data), `"build_num" : 12,`, `"build_num" : "12",`, 1)
+	if err := unmarshalJSON([]byte(retyped), &builds); err == nil || !strings.Contains(err.Error(), "[1].build_num: want int") {
+		t.Errorf("Expected the retyped field to fail, got %v", err)
+	}
+	added := strings.Replace(string(data), `"why" : "github",`, `"why" : "github", "trigger_actor" : "ada",`, 1)
+	if err := unmarshalJSON([]byte(added), &builds); err == nil || !strings.Contains(err.Error(), "unknown fields [0].trigger_actor") {
+		t.Errorf("Expected the added field to fail, got %v", err)
+	}
+
+	f, err := os.Open("testdata/artifacts-v1.1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var artifacts []artifact
+	if err := decodeJSON(f, &artifacts); err != nil || len(artifacts) != 2 || artifacts[0].Path != "bin/cart" {
+		t.Errorf("Expected the recorded artifacts to pass, got %+v, %v", artifacts, err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// A release pinned to a -build goes stale once a newer green build of the
+// same job comes along.  -warn-if-superseded and -fail-if-superseded check
+// for one: the pinned build is fetched, for its branch, workflow and job,
+// and the recent green builds of its branch searched for a newer one of the
+// same workflow and job.
+
+var warnIfSuperseded, failIfSuperseded bool
+
+// supersedes tells whether b is a newer green build of the same branch,
+// workflow and job as pinned.
+func supersedes(b, pinned build) bool {
+	if b.BuildNum <= pinned.BuildNum || b.Outcome != "success" || b.Branch != pinned.Branch {
+		return false
+	}
+	if pinned.Workflows == nil {
+		return true
+	}
+	return b.Workflows != nil &&
+		b.Workflows.WorkflowName == pinned.Workflows.WorkflowName &&
+		b.Workflows.JobName == pinned.Workflows.JobName
+}
+
+// supersededBy returns the newest of builds which supersedes pinned.
+func supersededBy(pinned build, builds []build) (build, bool) {
+	var newest build
+	for _, b := range builds {
+		if supersedes(b, pinned) && b.BuildNum > newest.BuildNum {
+			newest = b
+		}
+	}
+	return newest, newest.BuildNum > 0
+}
+
+// checkSuperseded returns an error naming the build which supersedes that
+// of opts.BuildNum, if there is one among the recent builds of its branch.
+func checkSuperseded(ctx context.Context, opts URLOptions) error {
+	pinned, err := fetchBuild(ctx, opts)
+	if err != nil {
+		return err
+	}
+	opts.Branch = pinned.Branch
+	opts.Filter = "successful"
+	builds, err := fetchBuilds(ctx, opts)
+	if err != nil {
+		return err
+	}
+	newer, ok := supersededBy(pinned, builds)
+	if !ok {
+		return nil
+	}
+	of := ""
+	if w := pinned.Workflows; w != nil {
+		of = fmt.Sprintf(" of workflow %q job %q", w.WorkflowName, w.JobName)
+	}
+	return fmt.Errorf("build %d is superseded by build %d%s on branch %q", pinned.BuildNum, newer.BuildNum, of, pinned.Branch)
+}
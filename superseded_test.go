@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_checkSuperseded(t *testing.T) {
+	const list = `[
+		{"build_num": 45, "branch": "main", "outcome": "success", "workflows": {"workflow_name": "release", "job_name": "test"}},
+		{"build_num": 44, "branch": "main", "outcome": "success", "workflows": {"workflow_name": "release", "job_name": "build"}},
+		{"build_num": 43, "branch": "main", "outcome": "success", "workflows": {"workflow_name": "nightly", "job_name": "build"}},
+		{"build_num": 42, "branch": "main", "outcome": "success", "workflows": {"workflow_name": "release", "job_name": "build"}},
+		{"build_num": 40, "branch": "main", "outcome": "success", "workflows": {"workflow_name": "release", "job_name": "build"}}
+	]`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1.1/project/github/nbio/cart/tree/main":
+			io.WriteString(w, list)
+		case "/api/v1.1/project/github/nbio/cart/42":
+			io.WriteString(w, `{"build_num": 42, "branch": "main", "outcome": "success", "workflows": {"workflow_name": "release", "job_name": "build"}}`)
+		case "/api/v1.1/project/github/nbio/cart/44":
+			io.WriteString(w, `{"build_num": 44, "branch": "main", "outcome": "success", "workflows": {"workflow_name": "release", "job_name": "build"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Limit: 10, BuildNum: 42}
+	err := checkSuperseded(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "build 42 is superseded by build 44") {
+		t.Errorf("Expected build 42 superseded by 44, not 43 or 45 of other jobs, got %v", err)
+	}
+
+	opts.BuildNum = 44
+	if err := checkSuperseded(context.Background(), opts); err != nil {
+		t.Errorf("Expected the newest build not superseded, got %s", err)
+	}
+}
+
+func Test_supersedes(t *testing.T) {
+	pinned := build{BuildNum: 10, Branch: "main", Outcome: "success"}
+	for _, tc := range []struct {
+		b    build
+		want bool
+	}{
+		{build{BuildNum: 11, Branch: "main", Outcome: "success"}, true},
+		{build{BuildNum: 11, Branch: "main", Outcome: "failed"}, false},
+		{build{BuildNum: 11, Branch: "dev", Outcome: "success"}, false},
+		{build{BuildNum: 9, Branch: "main", Outcome: "success"}, false},
+	} {
+		if got := supersedes(tc.b, pinned); got != tc.want {
+			t.Errorf("%+v: Expected %v, got %v", tc.b, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With -tar, the artifacts of -all or -pick are written as one tar archive
+// to -o, rather than as files, so that with `-o -` they can be piped into
+// another process: `cart -all -tar -o - | tar xf - -C dest`.  Each entry is
+// named as the file would have been within -output-dir.
+//
+// A tar header gives the size of the entry, so it must be written before the
+// body.  If the server gives the size, the body streams straight into the
+// archive; otherwise it's first buffered in a temporary file.
+
+var tarMode bool
+
+// createTarOutput opens path for writing, or returns stdout for "-".
+func createTarOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{output.Out}, nil
+	}
+	return createOutput(path)
+}
+
+// saveTar writes the archive of plan to path, or stdout for "-".
+func saveTar(path string, plan []plannedDownload) error {
+	if dryRun {
+		return writeTar(io.Discard, plan)
+	}
+	f, err := createTarOutput(path)
+	if err != nil {
+		return err
+	}
+	err = writeTar(f, plan)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeTar downloads the artifacts of plan, in order, into a tar archive
+// written to w.  A failure leaves the archive unusable, so it stops there;
+// but a 404 comes before the entry's header, so under -allow-missing the
+// artifact is left out, as downloadAll leaves out its file.
+func writeTar(w io.Writer, plan []plannedDownload) error {
+	tw := tar.NewWriter(w)
+	for _, d := range plan {
+		start := time.Now()
+		name := filepath.ToSlash(d.path)
+		if dryRun {
+			fmt.Fprintf(diag, "Dry run: skipped download of %s to tar entry %s\n", d.artifact.Path, name)
+			results.record(d.artifact, d.artifact.Path, name, 0, start, 0, false, nil)
+			continue
+		}
+		fmt.Fprintf(diag, "Downloading %s...\n", d.artifact.Path)
+		e := &tarEntry{tw: tw, name: name, modTime: start}
+		n, err := fetchArtifact(d.artifact, d.artifact.Path, e.create)
+		if err == nil {
+			err = e.finish()
+		}
+		e.discard()
+		if missed(err) {
+			fmt.Fprintf(diag, "Missing %s: %s\n", d.artifact.Path, err)
+			results.record(d.artifact, d.artifact.Path, name, 0, start, 0, false, err)
+			continue
+		}
+		results.record(d.artifact, d.artifact.Path, name, 0, start, n, err == nil, err)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.artifact.Path, err)
+		}
+		fmt.Fprintf(diag, "Wrote %s (%d bytes) to tar entry %s\n", d.artifact.Path, n, name)
+	}
+	return tw.Close()
+}
+
+// tarEntry is one artifact's entry in the archive, written by fetchArtifact.
+type tarEntry struct {
+	tw      *tar.Writer
+	name    string
+	modTime time.Time
+	started bool     // the header is written, so there's no going back
+	buf     *os.File // the body, if its size was unknown
+}
+
+var errTarRetry = errors.New("tar: cannot retry a download already partly written to the archive")
+
+func (e *tarEntry) header(size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     e.name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  e.modTime,
+	}
+}
+
+func (e *tarEntry) create(size int64) (io.WriteCloser, error) {
+	if e.started {
+		return nil, errTarRetry
+	}
+	e.discard()
+	if size < 0 {
+		f, err := os.CreateTemp("", "cart-tar-*")
+		if err != nil {
+			return nil, err
+		}
+		e.buf = f
+		return nopCloser{f}, nil
+	}
+	e.started = true
+	if err := e.tw.WriteHeader(e.header(size)); err != nil {
+		return nil, err
+	}
+	return nopCloser{e.tw}, nil
+}
+
+// finish writes to the archive the body buffered, if any, once it is all
+// here.
+func (e *tarEntry) finish() error {
+	if e.buf == nil {
+		return nil
+	}
+	defer e.discard()
+	size, err := e.buf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := e.buf.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	e.started = true
+	if err := e.tw.WriteHeader(e.header(size)); err != nil {
+		return err
+	}
+	_, err = io.Copy(e.tw, e.buf)
+	return err
+}
+
+// discard removes the buffer of an earlier attempt, if any.
+func (e *tarEntry) discard() {
+	if e.buf != nil {
+		e.buf.Close()
+		os.Remove(e.buf.Name())
+		e.buf = nil
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_writeTar(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0/logs/test.log" {
+			// Flushed before done, so sent chunked, with no size.
+			io.WriteString(w, "some ")
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	artifacts := []artifact{
+		{Path: "bin/linux/cart", URL: ts.URL + "/0/bin/linux/cart"},
+		{Path: "logs/test.log", URL: ts.URL + "/0/logs/test.log"},
+	}
+	plan, err := planDownloads(artifacts, ".", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writeTar(&out, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"bin/linux/cart": "/0/bin/linux/cart",
+		"logs/test.log":  "some /0/logs/test.log",
+	}
+	tr := tar.NewReader(&out)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want[h.Name] || h.Size != int64(len(body)) {
+			t.Errorf("%s: Expected %q, got %q (size %d)", h.Name, want[h.Name], body, h.Size)
+		}
+		names = append(names, h.Name)
+	}
+	if len(names) != 2 || names[0] != "bin/linux/cart" || names[1] != "logs/test.log" {
+		t.Errorf("Expected entries in order %v, got %v", []string{"bin/linux/cart", "logs/test.log"}, names)
+	}
+}
+
+func Test_writeTarAllowMissing(t *testing.T) {
+	defer func(b bool) { allowMissing = b }(allowMissing)
+	defer func(r *resultLog) { results = r }(results)
+	defer func(n int) { maxRetries = n }(maxRetries)
+	maxRetries = 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0/expired.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	var artifacts []artifact
+	for _, name := range []string{"first.txt", "expired.txt", "last.txt"} {
+		artifacts = append(artifacts, artifact{Path: name, URL: ts.URL + "/0/" + name})
+	}
+	plan, err := planDownloads(artifacts, ".", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowMissing = true
+	results = &resultLog{}
+	var out bytes.Buffer
+	if err := writeTar(&out, plan); err != nil {
+		t.Fatalf("Expected the missing artifact left out, got %s", err)
+	}
+	tr := tar.NewReader(&out)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	if len(names) != 2 || names[0] != "first.txt" || names[1] != "last.txt" {
+		t.Errorf("Expected entries %v, got %v", []string{"first.txt", "last.txt"}, names)
+	}
+	if got := results.results[1]; got.Status != statusMissing {
+		t.Errorf("Expected expired.txt reported missing, got %+v", got)
+	}
+
+	allowMissing = false
+	if err := writeTar(io.Discard, plan); !errors.Is(err, errMissing) {
+		t.Errorf("Expected a missing artifact to fail without -allow-missing, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Downloads are written to a temporary file beside the output, and renamed
+// into place once complete.  The file is created as any other would be, with
+// mode 0666 less the umask, rather than os.CreateTemp's 0600, so that the
+// output gets the mode a plain download would.  If cart is interrupted
+// (SIGINT or SIGTERM), it removes such files before exiting, rather than
+// leave hidden partial downloads behind, unless -keep-temp.
+
+var temps = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+var tempRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// createTemp creates a new file in dir, named prefix and a random suffix,
+// with mode 0666 less the umask, and tracks it for removal on interrupt.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for i := 0; ; i++ {
+		temps.Lock()
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(tempRand.Uint32()), 36))
+		temps.Unlock()
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, fs.ErrExist) && i < 100 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		trackTemp(name)
+		return f, nil
+	}
+}
+
+func trackTemp(path string) {
+	temps.Lock()
+	defer temps.Unlock()
+	temps.paths[path] = true
+}
+
+// untrackTemp stops tracking path, once renamed, removed or kept.
+func untrackTemp(path string) {
+	temps.Lock()
+	defer temps.Unlock()
+	delete(temps.paths, path)
+}
+
+// removeTemps removes the temporary files being tracked.
+func removeTemps() {
+	temps.Lock()
+	defer temps.Unlock()
+	for path := range temps.paths {
+		os.Remove(path)
+		delete(temps.paths, path)
+	}
+}
+
+// removeTempsOnSignal removes the temporary files being tracked when cart is
+// interrupted, and exits as the signal would have.
+func removeTempsOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		if !keepTemp {
+			removeTemps()
+		}
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		exit(code)
+	}()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// -trigger-type keeps to builds whose pipeline was triggered in one of the
+// given ways, eg only webhook (a push), never api (which anyone with a token
+// could trigger).  That's API v2's pipeline trigger type: v1.1 builds don't
+// carry it, so for each candidate build cart asks v2 for its workflow, then
+// for that workflow's pipeline.  That's two requests per workflow run among
+// the builds searched, once each.  A build outside any workflow has no
+// pipeline, and so no trigger type to allow.
+
+const (
+	workflowByIDURL = "${host}/api/v2/workflow/${workflow_id}"
+	pipelineByIDURL = "${host}/api/v2/pipeline/${pipeline_id}"
+)
+
+// knownTriggerTypes are the pipeline trigger types of API v2, sorted.
+var knownTriggerTypes = []string{"api", "explicit", "scheduled_pipeline", "webhook"}
+
+// parseTriggerTypes parses a comma-separated list of trigger types.
+func parseTriggerTypes(s string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		i := sort.SearchStrings(knownTriggerTypes, t)
+		if i == len(knownTriggerTypes) || knownTriggerTypes[i] != t {
+			return nil, fmt.Errorf("bad -trigger-type %q: want %s", t, strings.Join(knownTriggerTypes, ", "))
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// pipelineTriggers looks up the trigger types of builds' pipelines,
+// remembering them by workflow ID.
+type pipelineTriggers struct {
+	ctx        context.Context
+	opts       URLOptions
+	byWorkflow map[string]string
+}
+
+func newPipelineTriggers(ctx context.Context, opts URLOptions) *pipelineTriggers {
+	return &pipelineTriggers{ctx: ctx, opts: opts, byWorkflow: map[string]string{}}
+}
+
+// of returns the trigger type of the pipeline of b, or "" if b is part of
+// no workflow.
+func (p *pipelineTriggers) of(b build) (string, error) {
+	if b.Workflows == nil || b.Workflows.WorkflowID == "" {
+		return "", nil
+	}
+	id := b.Workflows.WorkflowID
+	if t, ok := p.byWorkflow[id]; ok {
+		return t, nil
+	}
+	e, err := p.opts.expander()
+	if err != nil {
+		return "", err
+	}
+	e["workflow_id"] = url.PathEscape(id)
+	u, err := url.Parse(e.ExpandURL(workflowByIDURL))
+	if err != nil {
+		return "", err
+	}
+	verboseln("Workflow:", censorURL(u.String()))
+	var wf struct {
+		PipelineID string `json:"pipeline_id"`
+	}
+	if err := fetchV2(p.ctx, u, "workflow "+id, &wf); err != nil {
+		return "", err
+	}
+	e["pipeline_id"] = url.PathEscape(wf.PipelineID)
+	if u, err = url.Parse(e.ExpandURL(pipelineByIDURL)); err != nil {
+		return "", err
+	}
+	verboseln("Pipeline:", censorURL(u.String()))
+	var pipeline struct {
+		Trigger struct {
+			Type string `json:"type"`
+		} `json:"trigger"`
+	}
+	if err := fetchV2(p.ctx, u, "pipeline "+wf.PipelineID, &pipeline); err != nil {
+		return "", err
+	}
+	p.byWorkflow[id] = pipeline.Trigger.Type
+	return pipeline.Trigger.Type, nil
+}
+
+// allowsTrigger reports whether filter's -trigger-type allows trigger type t.
+func (f FilterSet) allowsTrigger(t string) bool {
+	for _, allowed := range f.triggerTypes {
+		if t == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_triggerType(t *testing.T) {
+	lookups := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1.1/project/github/nbio/cart/tree/master":
+			io.WriteString(w, `[{"build_num": 45, "outcome": "success", "workflows": {"job_name": "build", "workflow_name": "commit", "workflow_id": "w3"}},
+				{"build_num": 44, "outcome": "success", "workflows": {"job_name": "test", "workflow_name": "commit", "workflow_id": "w3"}},
+				{"build_num": 43, "outcome": "success"},
+				{"build_num": 42, "outcome": "success", "workflows": {"job_name": "build", "workflow_name": "commit", "workflow_id": "w2"}},
+				{"build_num": 41, "outcome": "success", "workflows": {"job_name": "build", "workflow_name": "nightly", "workflow_id": "w1"}}]`)
+		case "/api/v2/workflow/w3":
+			io.WriteString(w, `{"id": "w3", "pipeline_id": "p3", "pipeline_number": 3}`)
+		case "/api/v2/workflow/w2":
+			io.WriteString(w, `{"id": "w2", "pipeline_id": "p2", "pipeline_number": 2}`)
+		case "/api/v2/workflow/w1":
+			io.WriteString(w, `{"id": "w1", "pipeline_id": "p1", "pipeline_number": 1}`)
+		case "/api/v2/pipeline/p3":
+			io.WriteString(w, `{"id": "p3", "trigger": {"type": "api"}}`)
+		case "/api/v2/pipeline/p2":
+			io.WriteString(w, `{"id": "p2", "trigger": {"type": "webhook"}}`)
+		case "/api/v2/pipeline/p1":
+			io.WriteString(w, `{"id": "p1", "trigger": {"type": "scheduled_pipeline"}}`)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		lookups[r.URL.Path]++
+	}))
+	defer ts.Close()
+
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart", Branch: "master", Limit: 10}
+	types, err := parseTriggerTypes("webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err := circleFindBuild(opts, FilterSet{branch: "master", jobname: "build", triggerTypes: types}, "")
+	if err != nil || found.BuildNum != 42 {
+		t.Errorf("webhook: Expected build 42, not the api-triggered 45, got %d (%v)", found.BuildNum, err)
+	}
+	if lookups["/api/v2/workflow/w3"] != 1 || lookups["/api/v2/pipeline/p3"] != 1 {
+		t.Errorf("Expected w3's pipeline looked up once, got %v", lookups)
+	}
+
+	// With -workflow, the api-triggered latest run of commit isn't latched to.
+	found, _, err = circleFindBuild(opts, FilterSet{branch: "master", workflow: "commit", jobname: "build", triggerTypes: types}, "")
+	if err != nil || found.BuildNum != 42 {
+		t.Errorf("webhook, -workflow: Expected build 42, got %d (%v)", found.BuildNum, err)
+	}
+
+	types, _ = parseTriggerTypes("scheduled_pipeline, api")
+	found, _, err = circleFindBuild(opts, FilterSet{branch: "master", jobname: "build", triggerTypes: types}, "")
+	if err != nil || found.BuildNum != 45 {
+		t.Errorf("api: Expected build 45, got %d (%v)", found.BuildNum, err)
+	}
+
+	if _, err := parseTriggerTypes("webhook,schedule"); err == nil || !strings.Contains(err.Error(), `"schedule"`) {
+		t.Errorf("Expected an error for an unknown trigger type, got %v", err)
+	}
+}
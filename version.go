@@ -0,0 +1,33 @@
+package main
+
+import "runtime/debug"
+
+// jsonSchemaVersion is the version of the shape of cart's JSON output.  Bump
+// it whenever a field of that output is renamed, removed or changes meaning,
+// so that consumers can guard against the change; adding a field needs no
+// bump.
+const jsonSchemaVersion = 1
+
+// version may be set at build time with -ldflags "-X main.version=v1.2.3";
+// otherwise it's that of the module, as installed by go install.
+var version string
+
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "(devel)"
+}
+
+// jsonHeader leads every JSON document which cart writes.
+type jsonHeader struct {
+	SchemaVersion int    `json:"schema_version"`
+	Version       string `json:"version"`
+}
+
+func newJSONHeader() jsonHeader {
+	return jsonHeader{jsonSchemaVersion, toolVersion()}
+}
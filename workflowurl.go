@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The link people paste in chat is usually that of a workflow, not of one of
+// its jobs:
+//
+//	https://app.circleci.com/pipelines/github/nbio/cart/123/workflows/<uuid>
+//
+// API v1.1 knows nothing of workflows by ID, so -workflow-url asks API v2 for
+// the workflow's jobs, and takes the build number of the one named by -job,
+// or of the only one.  From there it's as if given -build.
+
+// workflowJobsURL lists the jobs of a workflow, a page at a time.
+const workflowJobsURL = "${host}/api/v2/workflow/${workflow_id}/job"
+
+var workflowUUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// parseWorkflowURL returns the project and workflow ID of the workflow at
+// CircleCI URL s.
+func parseWorkflowURL(s string) (project, workflowID string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 7 || parts[0] != "pipelines" || providerNamed(parts[1]) == nil || parts[5] != "workflows" {
+		if len(parts) == 9 && parts[7] == "jobs" {
+			return "", "", fmt.Errorf("workflow-url: %q is the URL of a job; use -from-url", s)
+		}
+		return "", "", fmt.Errorf("workflow-url: unrecognized CircleCI workflow URL %q", s)
+	}
+	if !workflowUUID.MatchString(parts[6]) {
+		return "", "", fmt.Errorf("workflow-url: bad workflow ID %q in %q", parts[6], s)
+	}
+	return parts[2] + "/" + parts[3], parts[6], nil
+}
+
+// workflowJob is a job as API v2 lists it.  Approval jobs have no number.
+type workflowJob struct {
+	Name      string `json:"name"`
+	JobNumber int    `json:"job_number"`
+	Status    string `json:"status"`
+	Type      string `json:"type"`
+}
+
+// WorkflowJobsURL returns the URL listing the jobs of workflowID, at the
+// page of pageToken if not empty.
+func WorkflowJobsURL(opts URLOptions, workflowID, pageToken string) (*url.URL, error) {
+	e, err := opts.expander()
+	if err != nil {
+		return nil, err
+	}
+	e["workflow_id"] = url.PathEscape(workflowID)
+	u, err := url.Parse(e.ExpandURL(workflowJobsURL))
+	if err != nil {
+		return nil, err
+	}
+	if pageToken != "" {
+		u.RawQuery = url.Values{"page-token": {pageToken}}.Encode()
+	}
+	return u, nil
+}
+
+// fetchWorkflowJobs lists the jobs of workflowID, following the pages.
+func fetchWorkflowJobs(ctx context.Context, opts URLOptions, workflowID string) ([]workflowJob, error) {
+	var jobs []workflowJob
+	pageToken := ""
+	for {
+		u, err := WorkflowJobsURL(opts, workflowID, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		verboseln("Workflow jobs:", censorURL(u.String()))
+		var page struct {
+			Items         []workflowJob `json:"items"`
+			NextPageToken string        `json:"next_page_token"`
+		}
+		if err := fetchV2(ctx, u, "workflow "+workflowID, &page); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, page.Items...)
+		if page.NextPageToken == "" {
+			return jobs, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// fetchV2 GETs u, a resource of API v2, decoding it into v.  what names it
+// for errors, eg "workflow <id>".
+func fetchV2(ctx context.Context, u *url.URL, what string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s responded %s", what, req.URL.Host, res.Status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s: %s", what, err)
+	}
+	return nil
+}
+
+// pickWorkflowJob returns the build number of the job named jobName, or if
+// that's empty, of the workflow's only job with a build.
+func pickWorkflowJob(jobs []workflowJob, workflowID, jobName string) (int, error) {
+	var builds []workflowJob
+	for _, j := range jobs {
+		if j.JobNumber > 0 {
+			builds = append(builds, j)
+		}
+	}
+	if jobName != "" {
+		for _, j := range builds {
+			if j.Name == jobName {
+				return j.JobNumber, nil
+			}
+		}
+		return 0, fmt.Errorf("workflow %s has no job %q with a build (it has: %s)", workflowID, jobName, jobNames(builds))
+	}
+	if len(builds) != 1 {
+		return 0, fmt.Errorf("workflow %s has %d jobs with builds, so name one with -job (it has: %s)", workflowID, len(builds), jobNames(builds))
+	}
+	return builds[0].JobNumber, nil
+}
+
+func jobNames(jobs []workflowJob) string {
+	names := make([]string, len(jobs))
+	for i, j := range jobs {
+		names[i] = j.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// resolveWorkflowURL returns the build number of the job named jobName (or
+// the only job) of the workflow with workflowID.
+func resolveWorkflowURL(ctx context.Context, opts URLOptions, workflowID, jobName string) (int, error) {
+	jobs, err := fetchWorkflowJobs(ctx, opts, workflowID)
+	if err != nil {
+		return 0, err
+	}
+	return pickWorkflowJob(jobs, workflowID, jobName)
+}
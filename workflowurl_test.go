@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testWorkflowID = "5034460f-c7c4-4c43-9457-de07e2029e7b"
+
+func Test_parseWorkflowURL(t *testing.T) {
+	project, id, err := parseWorkflowURL("https://app.circleci.com/pipelines/github/nbio/cart/123/workflows/" + testWorkflowID)
+	if err != nil || project != "nbio/cart" || id != testWorkflowID {
+		t.Errorf("Expected nbio/cart %s, got %q %q (%v)", testWorkflowID, project, id, err)
+	}
+	for _, s := range []string{
+		"https://app.circleci.com/pipelines/github/nbio/cart/123/workflows/" + testWorkflowID + "/jobs/42",
+		"https://app.circleci.com/pipelines/github/nbio/cart/123",
+		"https://app.circleci.com/pipelines/github/nbio/cart/123/workflows/not-a-uuid",
+	} {
+		if _, _, err := parseWorkflowURL(s); err == nil {
+			t.Errorf("%s: Expected error", s)
+		}
+	}
+}
+
+func Test_resolveWorkflowURL(t *testing.T) {
+	defer func(s string) { circleToken = s }(circleToken)
+	defer func(h []string) { trustedHosts = h }(trustedHosts)
+	circleToken = "secret-token"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/workflow/"+testWorkflowID+"/job" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("circle-token") != circleToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// Two pages, the first with an approval job, which has no number.
+		if r.URL.Query().Get("page-token") == "" {
+			fmt.Fprint(w, `{"items": [
+				{"name": "hold", "type": "approval", "status": "success"},
+				{"name": "build", "job_number": 41, "type": "build", "status": "success"}
+			], "next_page_token": "p2"}`)
+			return
+		}
+		fmt.Fprint(w, `{"items": [{"name": "test", "job_number": 42, "type": "build", "status": "success"}], "next_page_token": null}`)
+	}))
+	defer ts.Close()
+	trustedHosts = []string{urlHostname(ts.URL)}
+	opts := URLOptions{Host: ts.URL, Project: "nbio/cart"}
+
+	n, err := resolveWorkflowURL(context.Background(), opts, testWorkflowID, "test")
+	if err != nil || n != 42 {
+		t.Errorf("Expected job test's build 42, got %d (%v)", n, err)
+	}
+	if _, err := resolveWorkflowURL(context.Background(), opts, testWorkflowID, ""); err == nil || !strings.Contains(err.Error(), "build, test") {
+		t.Errorf("Expected error naming the jobs to choose from, got %v", err)
+	}
+	if _, err := resolveWorkflowURL(context.Background(), opts, testWorkflowID, "hold"); err == nil {
+		t.Errorf("Expected no build for the approval job")
+	}
+}